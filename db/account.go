@@ -0,0 +1,74 @@
+package db
+
+import (
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"time"
+)
+
+// AccountBalances computes the balance of the accounts from everything dated before until,
+// nil until for the current balance. Bills and transfers dated before the opening date of
+// an account are taken as part of its opening balance.
+func AccountBalances(tx *gorm.DB, accounts []models.Account, until *time.Time) (map[uint]int64, error) {
+	balances := map[uint]int64{}
+	if len(accounts) == 0 {
+		return balances, nil
+	}
+
+	accountIDs := make([]uint, 0, len(accounts))
+	for _, account := range accounts {
+		accountIDs = append(accountIDs, account.ID)
+		if until == nil || account.OpeningDate.Before(*until) {
+			balances[account.ID] = int64(account.OpeningBalance)
+		}
+	}
+
+	type accountSum struct {
+		AccountID uint
+		Total     int64
+	}
+	sums := []struct {
+		query *gorm.DB
+		date  string
+	}{
+		{
+			tx.Table(consts.BillTable).
+				Select("bill.account_id, SUM(CASE WHEN bill.type = 'income' THEN bill.amount ELSE -bill.amount END) AS total").
+				Joins("JOIN account ON account.id = bill.account_id AND bill.date >= account.opening_date").
+				Where("bill.account_id IN ? AND bill.deleted_at IS NULL", accountIDs).
+				Group("bill.account_id"),
+			"bill.date",
+		},
+		{
+			tx.Table(consts.TransferTable).
+				Select("transfer.from_account_id AS account_id, -SUM(transfer.amount) AS total").
+				Joins("JOIN account ON account.id = transfer.from_account_id AND transfer.date >= account.opening_date").
+				Where("transfer.from_account_id IN ? AND transfer.deleted_at IS NULL", accountIDs).
+				Group("transfer.from_account_id"),
+			"transfer.date",
+		},
+		{
+			tx.Table(consts.TransferTable).
+				Select("transfer.to_account_id AS account_id, SUM(transfer.to_amount) AS total").
+				Joins("JOIN account ON account.id = transfer.to_account_id AND transfer.date >= account.opening_date").
+				Where("transfer.to_account_id IN ? AND transfer.deleted_at IS NULL", accountIDs).
+				Group("transfer.to_account_id"),
+			"transfer.date",
+		},
+	}
+	for _, sum := range sums {
+		query := sum.query
+		if until != nil {
+			query = query.Where(sum.date+" < ?", *until)
+		}
+		var rows []accountSum
+		if err := query.Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			balances[row.AccountID] += row.Total
+		}
+	}
+	return balances, nil
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/password"
+	"github.com/joho/godotenv"
+	"log"
+	"os"
+)
+
+// InitAdmin creates the operator account from config/admin if it does not exist yet
+func InitAdmin() {
+	if err := godotenv.Load(consts.AdminEnvFile); err != nil {
+		log.Println("no admin config file, skip creating admin account")
+		return
+	}
+
+	username := os.Getenv("ADMIN_USERNAME")
+	pass := os.Getenv("ADMIN_PASSWORD")
+	if username == "" || len(pass) < 6 {
+		log.Fatal("invalid ADMIN_USERNAME or ADMIN_PASSWORD in admin config file")
+	}
+
+	result := DB.Table(consts.AdminTable).Where("username = ?", username).Limit(1).Find(models.NewAdmin())
+	if result.Error != nil {
+		log.Fatal(result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return
+	}
+
+	hashedPassword, err := password.HashPassword(pass)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	admin := models.NewAdmin()
+	admin.Username = username
+	admin.Password = hashedPassword
+	if err := DB.Table(consts.AdminTable).Create(admin).Error; err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("\033[32mAdmin account created\033[0m")
+}
@@ -0,0 +1,18 @@
+package db
+
+import (
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+)
+
+// RecordBillRevision must run in the same transaction as the change of the bill
+func RecordBillRevision(tx *gorm.DB, bill *models.Bill, action string, editorID uint, changes models.BillChanges) error {
+	return tx.Table(consts.BillRevisionTable).Create(&models.BillRevision{
+		BillID:   bill.ID,
+		FamilyID: bill.FamilyID,
+		Action:   action,
+		EditorID: editorID,
+		Changes:  changes,
+	}).Error
+}
@@ -0,0 +1,18 @@
+package db
+
+import (
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+)
+
+// SeedCategories creates models.DefaultCategories for a family
+func SeedCategories(tx *gorm.DB, familyID uint) error {
+	categories := make([]models.Category, 0, len(models.DefaultCategories))
+	for i, category := range models.DefaultCategories {
+		category.FamilyID = familyID
+		category.SortOrder = i
+		categories = append(categories, category)
+	}
+	return tx.Table(consts.CategoryTable).Create(&categories).Error
+}
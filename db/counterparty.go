@@ -0,0 +1,49 @@
+package db
+
+import (
+	"errors"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"strings"
+)
+
+// NormalizeCounterpartyName trims a name and collapses the spaces inside it, so "张三 " is "张三"
+func NormalizeCounterpartyName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// FindCounterparty finds the counterparty of a family by its name or an alias, case-insensitive, nil if none
+func FindCounterparty(tx *gorm.DB, familyID uint, name string) (*models.Counterparty, error) {
+	name = NormalizeCounterpartyName(name)
+
+	counterparty := models.NewCounterparty()
+	err := tx.Table(consts.CounterpartyTable).
+		Where("family_id = ? AND (LOWER(name) = LOWER(?) OR id IN (SELECT counterparty_id FROM "+consts.CounterpartyAliasTable+
+			" WHERE family_id = ? AND LOWER(alias) = LOWER(?)))", familyID, name, familyID, name).
+		Order("id").First(counterparty).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return counterparty, nil
+}
+
+// ResolveCounterparty is FindCounterparty that creates the counterparty when there is none
+func ResolveCounterparty(tx *gorm.DB, familyID uint, name string) (*models.Counterparty, error) {
+	counterparty, err := FindCounterparty(tx, familyID, name)
+	if err != nil || counterparty != nil {
+		return counterparty, err
+	}
+
+	counterparty = models.NewCounterparty()
+	counterparty.FamilyID = familyID
+	counterparty.Name = NormalizeCounterpartyName(name)
+	counterparty.Kind = consts.CounterpartyOther
+	if err := tx.Table(consts.CounterpartyTable).Create(counterparty).Error; err != nil {
+		return nil, err
+	}
+	return counterparty, nil
+}
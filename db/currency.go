@@ -0,0 +1,123 @@
+package db
+
+import (
+	"errors"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"math"
+	"time"
+)
+
+// rateSQL is the rate of bill.currency in family.base_currency on bill.date: the latest rate
+// dated on or before it, or the earliest rate when the bill is older than every rate
+const rateSQL = `COALESCE(
+	(SELECT r.rate FROM ` + consts.ExchangeRateTable + ` r WHERE r.family_id = bill.family_id AND r.currency = bill.currency
+		AND r.base_currency = family.base_currency AND r.date <= bill.date ORDER BY r.date DESC LIMIT 1),
+	(SELECT r.rate FROM ` + consts.ExchangeRateTable + ` r WHERE r.family_id = bill.family_id AND r.currency = bill.currency
+		AND r.base_currency = family.base_currency ORDER BY r.date LIMIT 1))`
+
+// ConvertBills recomputes bill.base_amount of the bills of a family, of one currency or of all
+// when currency is empty. It must run after the rates or the base currency of the family change.
+func ConvertBills(tx *gorm.DB, familyID uint, currency string) error {
+	sql := `UPDATE ` + consts.BillTable + ` AS bill SET base_amount = CASE WHEN bill.currency = family.base_currency
+		THEN bill.amount ELSE ROUND(bill.amount * ` + rateSQL + `) END
+		FROM ` + consts.FamilyTable + ` AS family WHERE family.id = bill.family_id AND bill.family_id = ?`
+	args := []interface{}{familyID}
+	if currency != "" {
+		sql += " AND bill.currency = ?"
+		args = append(args, currency)
+	}
+	return tx.Exec(sql, args...).Error
+}
+
+// ConvertBill sets bill.BaseAmount after the bill is saved
+func ConvertBill(tx *gorm.DB, bill *models.Bill) error {
+	if err := tx.Exec(`UPDATE `+consts.BillTable+` AS bill SET base_amount = CASE WHEN bill.currency = family.base_currency
+		THEN bill.amount ELSE ROUND(bill.amount * `+rateSQL+`) END
+		FROM `+consts.FamilyTable+` AS family WHERE family.id = bill.family_id AND bill.id = ?`, bill.ID).Error; err != nil {
+		return err
+	}
+	return tx.Table(consts.BillTable).Unscoped().Where("id = ?", bill.ID).Select("base_amount").Row().Scan(&bill.BaseAmount)
+}
+
+// ExchangeRateAt returns the rate of currency in base on date picked as in ConvertBills, false if there is none
+func ExchangeRateAt(tx *gorm.DB, familyID uint, currency string, base string, date time.Time) (float64, bool, error) {
+	if currency == base {
+		return 1, true, nil
+	}
+
+	var rates []float64
+	if err := tx.Table(consts.ExchangeRateTable).
+		Where("family_id = ? AND currency = ? AND base_currency = ? AND date <= ?", familyID, currency, base, date).
+		Order("date DESC").Limit(1).Pluck("rate", &rates).Error; err != nil {
+		return 0, false, err
+	}
+	if len(rates) == 0 {
+		if err := tx.Table(consts.ExchangeRateTable).
+			Where("family_id = ? AND currency = ? AND base_currency = ?", familyID, currency, base).
+			Order("date").Limit(1).Pluck("rate", &rates).Error; err != nil {
+			return 0, false, err
+		}
+	}
+	if len(rates) == 0 {
+		return 0, false, nil
+	}
+	return rates[0], true, nil
+}
+
+// ErrNoBaseRate means the amounts kept in the old base currency cannot be converted to the new one
+var ErrNoBaseRate = errors.New("no exchange rate between the old and the new base currency")
+
+// baseAmountColumns hold amounts in the base currency of the family, they have to follow when it changes
+var baseAmountColumns = []struct{ table, column string }{
+	{consts.SettlementTable, "amount"},
+	{consts.BudgetTable, "amount"},
+	{consts.SavingsGoalTable, "target_amount"},
+	{consts.GoalContributionTable, "amount"},
+}
+
+// RebaseAmounts converts the amounts of baseAmountColumns of a family from old to base at the rate on date,
+// a rate of base in old does too. It fails with ErrNoBaseRate when there are amounts to convert but no rate.
+func RebaseAmounts(tx *gorm.DB, familyID uint, old string, base string, date time.Time) error {
+	if old == base {
+		return nil
+	}
+
+	rate, ok, err := ExchangeRateAt(tx, familyID, old, base, date)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		inverse, found, err := ExchangeRateAt(tx, familyID, base, old, date)
+		if err != nil {
+			return err
+		}
+		if found && inverse > 0 {
+			rate, ok = 1/inverse, true
+		}
+	}
+
+	for _, amounts := range baseAmountColumns {
+		if !ok {
+			var count int64
+			if err := tx.Table(amounts.table).Where("family_id = ?", familyID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrNoBaseRate
+			}
+			continue
+		}
+		if err := tx.Exec("UPDATE "+amounts.table+" SET "+amounts.column+" = ROUND("+amounts.column+" * ?) WHERE family_id = ?",
+			rate, familyID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConvertAmount rounds amount times rate to 分
+func ConvertAmount(amount int64, rate float64) int64 {
+	return int64(math.Round(float64(amount) * rate))
+}
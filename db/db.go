@@ -28,10 +28,143 @@ func UpdateDB() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = DB.Table(consts.BillRevisionTable).AutoMigrate(&models.BillRevision{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.CategoryTable).AutoMigrate(&models.Category{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.TagTable).AutoMigrate(&models.Tag{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.BillTagTable).AutoMigrate(&models.BillTag{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.AttachmentTable).AutoMigrate(&models.Attachment{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.BillSplitTable).AutoMigrate(&models.BillSplit{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.SettlementTable).AutoMigrate(&models.Settlement{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.CounterpartyTable).AutoMigrate(&models.Counterparty{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.CounterpartyAliasTable).AutoMigrate(&models.CounterpartyAlias{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.AccountTable).AutoMigrate(&models.Account{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.TransferTable).AutoMigrate(&models.Transfer{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.ExchangeRateTable).AutoMigrate(&models.ExchangeRate{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.AssetTable).AutoMigrate(&models.Asset{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.NetWorthSnapshotTable).AutoMigrate(&models.NetWorthSnapshot{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.BudgetTable).AutoMigrate(&models.Budget{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.SavingsGoalTable).AutoMigrate(&models.SavingsGoal{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.GoalContributionTable).AutoMigrate(&models.GoalContribution{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.LoanTable).AutoMigrate(&models.Loan{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.LoanRepaymentTable).AutoMigrate(&models.LoanRepayment{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.RecurringBillTable).AutoMigrate(&models.RecurringBill{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.RecurringOccurrenceTable).AutoMigrate(&models.RecurringOccurrence{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.RefreshTokenTable).AutoMigrate(&models.RefreshToken{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.RevokedTokenTable).AutoMigrate(&models.RevokedToken{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.AdminTable).AutoMigrate(&models.Admin{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.FamilyInvitationTable).AutoMigrate(&models.FamilyInvitation{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = DB.Table(consts.FamilyJoinRequestTable).AutoMigrate(&models.FamilyJoinRequest{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// created_at comes from gorm.Model and cannot carry the index tag
+	err = DB.Exec("CREATE INDEX IF NOT EXISTS idx_bill_family_created ON bill (family_id, created_at)").Error
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	addForeignKey(consts.BillTable, "family_id", consts.FamilyTable)
+	addForeignKey(consts.FamilyUserTable, "family_id", consts.FamilyTable)
 
 	log.Println("\033[32mAutoMigrate success\033[0m")
 }
 
+// addForeignKey adds table.column -> refTable.id if missing.
+// NOT VALID skips checking old rows, so orphans written before do not stop the server.
+func addForeignKey(table string, column string, refTable string) {
+	name := "fk_" + table + "_" + column
+
+	var count int64
+	if err := DB.Raw("SELECT COUNT(*) FROM pg_constraint WHERE conname = ?", name).Scan(&count).Error; err != nil {
+		log.Fatal(err)
+	}
+	if count > 0 {
+		return
+	}
+
+	err := DB.Exec(fmt.Sprintf(`ALTER TABLE %q ADD CONSTRAINT %q FOREIGN KEY (%q) REFERENCES %q (id) ON DELETE CASCADE NOT VALID`,
+		table, name, column, refTable)).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func ConnectDB() {
 
 	if err := godotenv.Load(consts.DBEnvFile); err != nil {
@@ -3,4 +3,6 @@ package db
 func Init() {
 	ConnectDB()
 	UpdateDB()
+	MigrateData()
+	InitAdmin()
 }
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/password"
+	"gorm.io/gorm"
+	"log"
+	"strings"
+)
+
+// MigrateData fixes up rows written by older versions, every step must be idempotent
+func MigrateData() {
+	if err := migrateFamilyOwner(); err != nil {
+		log.Fatal(err)
+	}
+	if err := migrateFamilyPassword(); err != nil {
+		log.Fatal(err)
+	}
+	if err := migrateBillCategory(); err != nil {
+		log.Fatal(err)
+	}
+	if err := migrateCurrency(); err != nil {
+		log.Fatal(err)
+	}
+	if err := migrateCounterparty(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("\033[32mMigrate data success\033[0m")
+}
+
+// migrateFamilyOwner makes the earliest member the owner of families that have none
+func migrateFamilyOwner() error {
+	return DB.Exec(`UPDATE `+consts.FamilyUserTable+` AS fu SET permission = ?
+		FROM (
+			SELECT DISTINCT ON (family_id) family_id, user_id FROM `+consts.FamilyUserTable+`
+			WHERE deleted_at IS NULL ORDER BY family_id, created_at, user_id
+		) AS first
+		WHERE fu.family_id = first.family_id AND fu.user_id = first.user_id
+		AND NOT EXISTS (
+			SELECT 1 FROM `+consts.FamilyUserTable+` AS o
+			WHERE o.family_id = fu.family_id AND o.permission = ? AND o.deleted_at IS NULL
+		)`, consts.FamilyOwner, consts.FamilyOwner).Error
+}
+
+// migrateFamilyPassword hashes family passwords that were stored in plaintext
+func migrateFamilyPassword() error {
+	var families []models.Family
+	if err := DB.Table(consts.FamilyTable).Where("password <> ''").Find(&families).Error; err != nil {
+		return err
+	}
+
+	for _, family := range families {
+		if strings.HasPrefix(family.Password, "$2") {
+			continue
+		}
+
+		hashedPassword, err := password.HashPassword(family.Password)
+		if err != nil {
+			return err
+		}
+		if err := DB.Table(consts.FamilyTable).Where("id = ?", family.ID).Update("password", hashedPassword).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateBillCategory seeds categories for old families and links bills to the category of the same name,
+// names not in the catalog become new top level categories
+func migrateBillCategory() error {
+	var familyIDs []uint
+	if err := DB.Table(consts.FamilyTable).Unscoped().
+		Where("NOT EXISTS (SELECT 1 FROM "+consts.CategoryTable+" WHERE category.family_id = family.id)").
+		Pluck("id", &familyIDs).Error; err != nil {
+		return err
+	}
+	for _, familyID := range familyIDs {
+		if err := SeedCategories(DB, familyID); err != nil {
+			return err
+		}
+	}
+
+	type billCategory struct {
+		FamilyID uint
+		Type     string
+		Category string
+	}
+	var names []billCategory
+	if err := DB.Table(consts.BillTable).Unscoped().
+		Select("DISTINCT family_id, type, category").
+		Where("category_id = 0").
+		Scan(&names).Error; err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			categoryName := strings.TrimSpace(name.Category)
+			if categoryName == "" {
+				categoryName = consts.OtherCategoryName
+			}
+
+			category := models.NewCategory()
+			result := tx.Table(consts.CategoryTable).
+				Where("family_id = ? AND type = ? AND LOWER(name) = LOWER(?)", name.FamilyID, name.Type, categoryName).
+				Order("parent_id, id").Limit(1).Find(category)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				category.FamilyID = name.FamilyID
+				category.Type = name.Type
+				category.Name = categoryName
+				if err := tx.Table(consts.CategoryTable).Create(category).Error; err != nil {
+					return err
+				}
+			}
+
+			return tx.Table(consts.BillTable).Unscoped().
+				Where("family_id = ? AND type = ? AND category = ? AND category_id = 0", name.FamilyID, name.Type, name.Category).
+				Updates(map[string]interface{}{"category_id": category.ID, "category": category.Name}).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateCurrency converts the bills written before base_amount existed
+// and fills the received amount of transfers between accounts of one currency
+func migrateCurrency() error {
+	if err := DB.Exec(`UPDATE ` + consts.BillTable + ` AS bill SET base_amount = bill.amount
+		FROM ` + consts.FamilyTable + ` AS family
+		WHERE family.id = bill.family_id AND bill.base_amount IS NULL AND bill.currency = family.base_currency`).Error; err != nil {
+		return err
+	}
+	return DB.Exec(`UPDATE ` + consts.TransferTable + ` SET to_amount = amount WHERE to_amount = 0`).Error
+}
+
+// migrateCounterparty links bills, recurring bills and loans to the counterparty of their object, names that only
+// differ in case or spaces become one counterparty, the others are created
+func migrateCounterparty() error {
+	for _, table := range []string{consts.BillTable, consts.RecurringBillTable, consts.LoanTable} {
+		var objects []struct {
+			FamilyID uint
+			Object   string
+		}
+		if err := DB.Table(table).Unscoped().
+			Select("DISTINCT family_id, object").
+			Where("counterparty_id = 0 AND TRIM(object) <> ''").
+			Scan(&objects).Error; err != nil {
+			return err
+		}
+
+		for _, object := range objects {
+			err := DB.Transaction(func(tx *gorm.DB) error {
+				counterparty, err := ResolveCounterparty(tx, object.FamilyID, object.Object)
+				if err != nil {
+					return err
+				}
+				return tx.Table(table).Unscoped().
+					Where("family_id = ? AND object = ? AND counterparty_id = 0", object.FamilyID, object.Object).
+					Updates(map[string]interface{}{"counterparty_id": counterparty.ID, "object": counterparty.Name}).Error
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
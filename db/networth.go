@@ -0,0 +1,106 @@
+package db
+
+import (
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"time"
+)
+
+// NetWorth computes the net worth of a family now from the balances of its accounts and its assets and
+// liabilities, archived ones left out. Everything is converted to base at the rates of today.
+func NetWorth(tx *gorm.DB, familyID uint, base string) (*models.NetWorthSnapshot, error) {
+	now := BillNow()
+	snapshot := &models.NetWorthSnapshot{FamilyID: familyID, Date: now, BaseCurrency: base, Items: models.NetWorthItems{}}
+
+	var accounts []models.Account
+	if err := tx.Table(consts.AccountTable).Where("family_id = ? AND archived_at IS NULL", familyID).
+		Order("sort_order, id").Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+	balances, err := AccountBalances(tx, accounts, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts {
+		snapshot.Items = append(snapshot.Items, models.NetWorthItem{
+			Kind:     consts.NetWorthAccount,
+			ID:       account.ID,
+			Name:     account.Name,
+			Currency: account.Currency,
+			Amount:   balances[account.ID],
+		})
+	}
+
+	var assets []models.Asset
+	if err := tx.Table(consts.AssetTable).Where("family_id = ? AND archived_at IS NULL", familyID).
+		Order("kind, id").Find(&assets).Error; err != nil {
+		return nil, err
+	}
+	for _, asset := range assets {
+		amount := int64(asset.Value)
+		if asset.Kind == consts.NetWorthLiability {
+			amount = -amount
+		}
+		snapshot.Items = append(snapshot.Items, models.NetWorthItem{
+			Kind:     asset.Kind,
+			ID:       asset.ID,
+			Name:     asset.Name,
+			Currency: asset.Currency,
+			Amount:   amount,
+		})
+	}
+
+	// an overdrawn account or a credit card in debt counts as a liability
+	for i := range snapshot.Items {
+		item := &snapshot.Items[i]
+		rate, ok, err := ExchangeRateAt(tx, familyID, item.Currency, base, now)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			snapshot.Unconverted++
+			continue
+		}
+		amount := ConvertAmount(item.Amount, rate)
+		item.BaseAmount = &amount
+		if amount >= 0 {
+			snapshot.Assets += amount
+		} else {
+			snapshot.Liabilities -= amount
+		}
+	}
+	snapshot.NetWorth = snapshot.Assets - snapshot.Liabilities
+	return snapshot, nil
+}
+
+// TakeNetWorthSnapshot saves the net worth of a family now, userID is 0 for automatic snapshots
+func TakeNetWorthSnapshot(tx *gorm.DB, familyID uint, source string, userID uint) (*models.NetWorthSnapshot, error) {
+	family := models.NewFamily()
+	if err := tx.Table(consts.FamilyTable).Where("id = ?", familyID).First(family).Error; err != nil {
+		return nil, err
+	}
+
+	snapshot, err := NetWorth(tx, familyID, family.BaseCurrency)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Source = source
+	snapshot.CreatedBy = userID
+	if err := tx.Table(consts.NetWorthSnapshotTable).Create(snapshot).Error; err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// FamiliesWithoutSnapshot returns the families without an automatic snapshot since since,
+// archived or deleted families are skipped
+func FamiliesWithoutSnapshot(since time.Time) ([]uint, error) {
+	var familyIDs []uint
+	err := DB.Table(consts.FamilyTable).
+		Where("deleted_at IS NULL AND archived_at IS NULL").
+		Where("NOT EXISTS (SELECT 1 FROM "+consts.NetWorthSnapshotTable+" s WHERE s.family_id = family.id AND s.source = ? AND s.date >= ?)",
+			consts.SnapshotAuto, since).
+		Pluck("id", &familyIDs).Error
+	return familyIDs, err
+}
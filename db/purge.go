@@ -0,0 +1,138 @@
+package db
+
+import (
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+)
+
+// PurgeFamily permanently removes a family and everything that belongs to it, run it in a transaction.
+// It returns the storage keys of the attachments, delete them with storage.DeleteAll after commit.
+func PurgeFamily(tx *gorm.DB, familyID uint) ([]string, error) {
+	keys, err := deleteAttachments(tx, "family_id = ?", familyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.BillRevisionTable).Where("family_id = ?", familyID).Delete(&models.BillRevision{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.BillTagTable).Where("tag_id IN (?)", tx.Table(consts.TagTable).Unscoped().Select("id").Where("family_id = ?", familyID)).Delete(&models.BillTag{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.BillSplitTable).Where("family_id = ?", familyID).Delete(&models.BillSplit{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.SettlementTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.Settlement{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.GoalContributionTable).Where("family_id = ?", familyID).Delete(&models.GoalContribution{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.SavingsGoalTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.SavingsGoal{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.LoanRepaymentTable).Where("family_id = ?", familyID).Delete(&models.LoanRepayment{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.LoanTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.Loan{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.NetWorthSnapshotTable).Where("family_id = ?", familyID).Delete(&models.NetWorthSnapshot{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.AssetTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.Asset{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.BudgetTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.Budget{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.ExchangeRateTable).Where("family_id = ?", familyID).Delete(&models.ExchangeRate{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.TransferTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.Transfer{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.AccountTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.Account{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.CounterpartyAliasTable).Where("family_id = ?", familyID).Delete(&models.CounterpartyAlias{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.CounterpartyTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.Counterparty{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.TagTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.Tag{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.BillTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.Bill{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.RecurringOccurrenceTable).Where("rule_id IN (?)", tx.Table(consts.RecurringBillTable).Unscoped().Select("id").Where("family_id = ?", familyID)).Delete(&models.RecurringOccurrence{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.RecurringBillTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.RecurringBill{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.CategoryTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.Category{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.FamilyInvitationTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.FamilyInvitation{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.FamilyJoinRequestTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.FamilyJoinRequest{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.FamilyUserTable).Unscoped().Where("family_id = ?", familyID).Delete(&models.FamilyUser{}).Error; err != nil {
+		return nil, err
+	}
+	return keys, tx.Table(consts.FamilyTable).Unscoped().Where("id = ?", familyID).Delete(&models.Family{}).Error
+}
+
+// PurgeBills permanently removes bills and their history, run it in a transaction.
+// Like PurgeFamily it returns the storage keys of the attachments.
+func PurgeBills(tx *gorm.DB, billIDs []uint) ([]string, error) {
+	if len(billIDs) == 0 {
+		return nil, nil
+	}
+	keys, err := deleteAttachments(tx, "bill_id IN ?", billIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.BillRevisionTable).Where("bill_id IN ?", billIDs).Delete(&models.BillRevision{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.BillTagTable).Where("bill_id IN ?", billIDs).Delete(&models.BillTag{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.BillSplitTable).Where("bill_id IN ?", billIDs).Delete(&models.BillSplit{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.GoalContributionTable).Where("bill_id IN ?", billIDs).Delete(&models.GoalContribution{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table(consts.LoanRepaymentTable).Where("bill_id IN ?", billIDs).Delete(&models.LoanRepayment{}).Error; err != nil {
+		return nil, err
+	}
+	return keys, tx.Table(consts.BillTable).Unscoped().Where("id IN ?", billIDs).Delete(&models.Bill{}).Error
+}
+
+// deleteAttachments deletes the attachment rows matching the condition and returns their storage keys
+func deleteAttachments(tx *gorm.DB, query string, args ...interface{}) ([]string, error) {
+	var attachments []models.Attachment
+	if err := tx.Table(consts.AttachmentTable).Unscoped().Where(query, args...).Find(&attachments).Error; err != nil {
+		return nil, err
+	}
+	if len(attachments) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, 2*len(attachments))
+	for _, attachment := range attachments {
+		keys = append(keys, attachment.StorageKey)
+		if attachment.ThumbKey != "" {
+			keys = append(keys, attachment.ThumbKey)
+		}
+	}
+
+	return keys, tx.Table(consts.AttachmentTable).Unscoped().Where(query, args...).Delete(&models.Attachment{}).Error
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"errors"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// BillNow is the current wall clock time as a bill date.
+// Dates of bills are typed in local time and parsed as UTC, so now must be read the same way.
+func BillNow() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.UTC)
+}
+
+// DueRecurringBills returns the rules with an occurrence due, rules of archived or deleted families wait
+func DueRecurringBills() ([]uint, error) {
+	var ruleIDs []uint
+	err := DB.Table(consts.RecurringBillTable).
+		Joins("JOIN family ON family.id = recurring_bill.family_id AND family.deleted_at IS NULL AND family.archived_at IS NULL").
+		Where("recurring_bill.deleted_at IS NULL AND recurring_bill.paused_at IS NULL AND recurring_bill.next_date <= ?", BillNow()).
+		Pluck("recurring_bill.id", &ruleIDs).Error
+	return ruleIDs, err
+}
+
+// GenerateRecurringBills creates the bills of every due occurrence of a rule up to now.
+// The rule row is locked and every occurrence is recorded, so running it twice creates nothing new.
+func GenerateRecurringBills(ruleID uint) (int, error) {
+	now := BillNow()
+	created := 0
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		rule := models.NewRecurringBill()
+		if err := tx.Table(consts.RecurringBillTable).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND paused_at IS NULL AND next_date <= ?", ruleID, now).First(rule).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil // paused, ended or done by someone else meanwhile
+			}
+			return err
+		}
+
+		category := models.NewCategory()
+		if err := tx.Table(consts.CategoryTable).Unscoped().Where("id = ?", rule.CategoryID).Limit(1).Find(category).Error; err != nil {
+			return err
+		}
+		if category.Name != "" {
+			rule.Category = category.Name
+		}
+
+		for i := 0; i < consts.MaxOccurrencesPerRun && !rule.Ended(rule.Generated); i++ {
+			date := rule.Occurrence(rule.Generated)
+			if date.After(now) {
+				break
+			}
+
+			occurrence := models.RecurringOccurrence{}
+			result := tx.Table(consts.RecurringOccurrenceTable).Where("rule_id = ? AND seq = ?", rule.ID, rule.Generated).Limit(1).Find(&occurrence)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			if result.RowsAffected == 0 || occurrence.Status == consts.OccurrencePending {
+				bill := recurringBill(rule, date, &occurrence)
+				if err := tx.Table(consts.BillTable).Create(bill).Error; err != nil {
+					return err
+				}
+				if err := ConvertBill(tx, bill); err != nil {
+					return err
+				}
+				if err := RecordBillRevision(tx, bill, consts.BillActionCreate, rule.CreatedBy, models.DiffBill(&models.Bill{}, bill)); err != nil {
+					return err
+				}
+
+				occurrence.RuleID = rule.ID
+				occurrence.Seq = rule.Generated
+				occurrence.Date = date
+				occurrence.Status = consts.OccurrenceGenerated
+				occurrence.BillID = bill.ID
+				if err := tx.Table(consts.RecurringOccurrenceTable).Save(&occurrence).Error; err != nil {
+					return err
+				}
+				created++
+			}
+
+			rule.Generated++
+		}
+
+		return tx.Table(consts.RecurringBillTable).Where("id = ?", rule.ID).Updates(map[string]interface{}{
+			"generated": rule.Generated,
+			"next_date": NextRecurringDate(rule),
+		}).Error
+	})
+
+	return created, err
+}
+
+// NextRecurringDate is the date of the next occurrence to generate, nil when the rule has ended
+func NextRecurringDate(rule *models.RecurringBill) *time.Time {
+	if rule.Ended(rule.Generated) {
+		return nil
+	}
+	next := rule.Occurrence(rule.Generated)
+	return &next
+}
+
+func recurringBill(rule *models.RecurringBill, date time.Time, occurrence *models.RecurringOccurrence) *models.Bill {
+	bill := &models.Bill{
+		Date:           date,
+		Type:           rule.Type,
+		Amount:         rule.Amount,
+		Currency:       rule.Currency,
+		Category:       rule.Category,
+		CategoryID:     rule.CategoryID,
+		Description:    rule.Description,
+		Object:         rule.Object,
+		CounterpartyID: rule.CounterpartyID,
+		Username:       rule.Username,
+		FamilyID:       rule.FamilyID,
+		CreatedBy:      rule.CreatedBy,
+		RecurringID:    rule.ID,
+	}
+	if occurrence.Amount != nil {
+		bill.Amount = *occurrence.Amount
+	}
+	if occurrence.Description != nil {
+		bill.Description = *occurrence.Description
+	}
+	if occurrence.BillDate != nil {
+		bill.Date = *occurrence.BillDate
+	}
+	return bill
+}
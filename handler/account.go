@@ -0,0 +1,581 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errAccountNotFound  = errors.New("account not found")
+	errAccountArchived  = errors.New("account is archived")
+	errAccountNameTaken = errors.New("account with the same name already exists")
+	errAccountCurrency  = errors.New("bill must be in the currency of its account")
+)
+
+// accountErrorResponse writes the response of the errors above, anything else is a 500
+func accountErrorResponse(c *gin.Context, err error, prefix string) {
+	switch {
+	case errors.Is(err, errAccountNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": err.Error(),
+		})
+	case errors.Is(err, errAccountArchived), errors.Is(err, errAccountNameTaken), errors.Is(err, errAccountCurrency):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": prefix + err.Error(),
+		})
+	}
+	c.Abort()
+}
+
+// usableAccount loads the account, it must be a not archived account of the family
+func usableAccount(tx *gorm.DB, familyID uint, accountID uint) (*models.Account, error) {
+	account := models.NewAccount()
+	if err := tx.Table(consts.AccountTable).Where("id = ? AND family_id = ?", accountID, familyID).First(account).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errAccountNotFound
+		}
+		return nil, err
+	}
+	if account.ArchivedAt != nil {
+		return nil, errAccountArchived
+	}
+	return account, nil
+}
+
+// checkBillAccount checks the account of a bill if it has one, the bill must be in the currency of the account
+func checkBillAccount(tx *gorm.DB, bill *models.Bill) error {
+	if bill.AccountID == 0 {
+		return nil
+	}
+	account, err := usableAccount(tx, bill.FamilyID, bill.AccountID)
+	if err != nil {
+		return err
+	}
+	if account.Currency != bill.Currency {
+		return errAccountCurrency
+	}
+	return nil
+}
+
+// checkAccountName keeps account names unique in a family, case-insensitive
+func checkAccountName(tx *gorm.DB, account *models.Account) error {
+	var count int64
+	if err := tx.Table(consts.AccountTable).
+		Where("family_id = ? AND LOWER(name) = LOWER(?) AND id <> ?", account.FamilyID, account.Name, account.ID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errAccountNameTaken
+	}
+	return nil
+}
+
+// parseBalanceDate returns the moment right after value, a date without time means the end of that day
+func parseBalanceDate(value string) (time.Time, error) {
+	if t, err := time.Parse(consts.TimeFormat, value); err == nil {
+		return t.Add(time.Second), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+type AccountResponse struct {
+	models.Account
+	Balance int64 `json:"balance"`
+}
+
+// ListAccounts returns the accounts with their balance, ?date= for the balance at the end of a past day
+func ListAccounts(c *gin.Context) {
+	var until *time.Time
+	if value := c.Query("date"); value != "" {
+		date, err := parseBalanceDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		until = &date
+	}
+
+	query := db.DB.Table(consts.AccountTable).Where("family_id = ?", c.GetUint("family_id"))
+	if c.Query("include_archived") != "true" {
+		query = query.Where("archived_at IS NULL")
+	}
+
+	var accounts []models.Account
+	if err := query.Order("sort_order, id").Find(&accounts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list accounts: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	balances, err := db.AccountBalances(db.DB, accounts, until)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to compute balances: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	// the total is in the base currency, accounts without an exchange rate are left out of it
+	base := baseCurrency(c)
+	rateDate := db.BillNow()
+	if until != nil {
+		rateDate = *until
+	}
+	result := make([]AccountResponse, 0, len(accounts))
+	var total, unconverted int64
+	for _, account := range accounts {
+		result = append(result, AccountResponse{Account: account, Balance: balances[account.ID]})
+
+		rate, ok, err := db.ExchangeRateAt(db.DB, account.FamilyID, account.Currency, base, rateDate)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to query exchange rate: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		if !ok {
+			unconverted++
+			continue
+		}
+		total += db.ConvertAmount(balances[account.ID], rate)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":         20000,
+		"message":       "List Accounts Successfully",
+		"data":          result,
+		"total":         total,
+		"base_currency": base,
+		"unconverted":   unconverted,
+	})
+}
+
+type createAccountRequest struct {
+	Name           string `json:"name" binding:"required,max=100"`
+	Type           string `json:"type" binding:"required,oneof=cash debit credit ewallet"`
+	Currency       string `json:"currency" binding:"omitempty,iso4217"` // defaults to the base currency, cannot be changed later
+	OpeningBalance int    `json:"opening_balance"`
+	OpeningDate    string `json:"opening_date"` // defaults to now
+	Note           string `json:"note" binding:"max=255"`
+	SortOrder      int    `json:"sort_order"`
+}
+
+func CreateAccount(c *gin.Context) {
+	var req createAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateAccount Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	account := models.NewAccount()
+	account.FamilyID = c.GetUint("family_id")
+	account.Name = strings.TrimSpace(req.Name)
+	account.Type = req.Type
+	account.Currency = baseCurrency(c)
+	if req.Currency != "" {
+		account.Currency = req.Currency
+	}
+	account.OpeningBalance = req.OpeningBalance
+	account.OpeningDate = db.BillNow()
+	account.Note = req.Note
+	account.SortOrder = req.SortOrder
+	if req.OpeningDate != "" {
+		date, err := time.Parse(consts.TimeFormat, req.OpeningDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse opening_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		account.OpeningDate = date
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkAccountName(tx, account); err != nil {
+			return err
+		}
+		return tx.Table(consts.AccountTable).Create(account).Error
+	})
+	if err != nil {
+		accountErrorResponse(c, err, "failed to save account: ")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Create Account Successfully",
+		"data":    AccountResponse{Account: *account, Balance: int64(account.OpeningBalance)},
+	})
+}
+
+// findAccount loads the account of :account_id in the family, aborts if not found
+func findAccount(c *gin.Context) *models.Account {
+	accountID, err := strconv.ParseUint(c.Param("account_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid account_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	account := models.NewAccount()
+	if err := db.DB.Table(consts.AccountTable).Where("id = ? AND family_id = ?", uint(accountID), c.GetUint("family_id")).First(account).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "account not found: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+	return account
+}
+
+type updateAccountRequest struct {
+	Name           *string `json:"name" binding:"omitnil,min=1,max=100"`
+	Type           *string `json:"type" binding:"omitnil,oneof=cash debit credit ewallet"`
+	OpeningBalance *int    `json:"opening_balance"`
+	OpeningDate    *string `json:"opening_date" binding:"omitnil,min=1"`
+	Note           *string `json:"note" binding:"omitnil,max=255"`
+	SortOrder      *int    `json:"sort_order"`
+}
+
+func UpdateAccount(c *gin.Context) {
+	var req updateAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateAccount Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	account := findAccount(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if req.Name != nil {
+		account.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Type != nil {
+		account.Type = *req.Type
+	}
+	if req.OpeningBalance != nil {
+		account.OpeningBalance = *req.OpeningBalance
+	}
+	if req.OpeningDate != nil {
+		date, err := time.Parse(consts.TimeFormat, *req.OpeningDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse opening_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		account.OpeningDate = date
+	}
+	if req.Note != nil {
+		account.Note = *req.Note
+	}
+	if req.SortOrder != nil {
+		account.SortOrder = *req.SortOrder
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkAccountName(tx, account); err != nil {
+			return err
+		}
+		return tx.Table(consts.AccountTable).Save(account).Error
+	})
+	if err != nil {
+		accountErrorResponse(c, err, "failed to save account: ")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Update Account Successfully",
+		"data":    account,
+	})
+}
+
+// ArchiveAccount hides the account from new bills and transfers, its history stays
+func ArchiveAccount(c *gin.Context) {
+	account := findAccount(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if err := db.DB.Table(consts.AccountTable).Where("id = ?", account.ID).Update("archived_at", time.Now()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to archive account: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "account archived successfully",
+	})
+}
+
+func UnarchiveAccount(c *gin.Context) {
+	account := findAccount(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if err := db.DB.Table(consts.AccountTable).Where("id = ?", account.ID).Update("archived_at", nil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to unarchive account: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "account unarchived successfully",
+	})
+}
+
+// DeleteAccount only deletes an account no bill or transfer uses, archive it otherwise
+func DeleteAccount(c *gin.Context) {
+	account := findAccount(c)
+	if c.IsAborted() {
+		return
+	}
+
+	var bills, transfers int64
+	if err := db.DB.Table(consts.BillTable).Unscoped().Where("account_id = ?", account.ID).Count(&bills).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if err := db.DB.Table(consts.TransferTable).
+		Where("(from_account_id = ? OR to_account_id = ?) AND deleted_at IS NULL", account.ID, account.ID).
+		Count(&transfers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if bills > 0 || transfers > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": "account is used by bills or transfers, archive it instead",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := db.DB.Table(consts.AccountTable).Unscoped().Where("id = ?", account.ID).Delete(&models.Account{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete account: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "account deleted successfully",
+	})
+}
+
+// LedgerEntry is a bill or a transfer of an account, Amount is negative when money left it
+type LedgerEntry struct {
+	Date        time.Time `json:"date"`
+	Kind        string    `json:"kind"` // bill or transfer
+	ID          uint      `json:"id"`
+	Amount      int64     `json:"amount"`
+	Balance     int64     `json:"balance"` // after this entry
+	Category    string    `json:"category,omitempty"`
+	Description string    `json:"description"`
+	AccountID   uint      `json:"account_id,omitempty"` // other account of a transfer
+}
+
+// ledgerOpening is the balance a ledger from start to end begins with, balanceAtStart is the balance
+// before start. An account opened within the range begins with its opening balance, its entries follow.
+func ledgerOpening(account *models.Account, start, end time.Time, balanceAtStart int64) int64 {
+	if !account.OpeningDate.Before(start) && account.OpeningDate.Before(end) {
+		return int64(account.OpeningBalance)
+	}
+	return balanceAtStart
+}
+
+// AccountLedger lists the bills and transfers of an account between start_date and end_date
+// with the running balance, the range defaults to the current month
+func AccountLedger(c *gin.Context) {
+	account := findAccount(c)
+	if c.IsAborted() {
+		return
+	}
+
+	now := db.BillNow()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	if value := c.Query("start_date"); value != "" {
+		date, err := parseFilterDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse start_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		start = date
+	}
+	if value := c.Query("end_date"); value != "" {
+		date, err := parseBalanceDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse end_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		end = date
+	}
+
+	balances, err := db.AccountBalances(db.DB, []models.Account{*account}, &start)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to compute balance: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	opening := ledgerOpening(account, start, end, balances[account.ID])
+
+	// entries before the opening date are part of the opening balance
+	from := start
+	if account.OpeningDate.After(from) {
+		from = account.OpeningDate
+	}
+
+	var bills []models.Bill
+	if err := db.DB.Table(consts.BillTable).
+		Where("account_id = ? AND date >= ? AND date < ?", account.ID, from, end).
+		Order("date, id").Limit(consts.MaxLedgerEntries + 1).Find(&bills).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list bills: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	var transfers []models.Transfer
+	if err := db.DB.Table(consts.TransferTable).
+		Where("(from_account_id = ? OR to_account_id = ?) AND date >= ? AND date < ?", account.ID, account.ID, from, end).
+		Order("date, id").Limit(consts.MaxLedgerEntries + 1).Find(&transfers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list transfers: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if len(bills)+len(transfers) > consts.MaxLedgerEntries {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": "more than " + strconv.Itoa(consts.MaxLedgerEntries) + " entries, narrow the date range",
+		})
+		c.Abort()
+		return
+	}
+
+	entries := make([]LedgerEntry, 0, len(bills)+len(transfers))
+	for _, bill := range bills {
+		amount := int64(bill.Amount)
+		if bill.Type != consts.BillTypeIncome {
+			amount = -amount
+		}
+		entries = append(entries, LedgerEntry{
+			Date: bill.Date, Kind: "bill", ID: bill.ID, Amount: amount,
+			Category: bill.Category, Description: bill.Description,
+		})
+	}
+	for _, transfer := range transfers {
+		entry := LedgerEntry{
+			Date: transfer.Date, Kind: "transfer", ID: transfer.ID, Amount: int64(transfer.ToAmount),
+			Description: transfer.Description, AccountID: transfer.FromAccountID,
+		}
+		if transfer.FromAccountID == account.ID {
+			entry.Amount, entry.AccountID = -int64(transfer.Amount), transfer.ToAccountID
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Date.Before(entries[j].Date) })
+
+	balance := opening
+	for i := range entries {
+		balance += entries[i].Amount
+		entries[i].Balance = balance
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Account Ledger Successfully",
+		"data": gin.H{
+			"account":         account,
+			"opening_balance": opening,
+			"closing_balance": balance,
+			"entries":         entries,
+		},
+	})
+}
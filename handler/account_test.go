@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"github.com/hewo233/hdu-dx2/models"
+	"testing"
+	"time"
+)
+
+func TestLedgerOpening(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+
+	tests := []struct {
+		name           string
+		openingDate    time.Time
+		balanceAtStart int64
+		want           int64
+	}{
+		{"opened before the range", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 4200, 4200},
+		{"opened mid-range", time.Date(2024, 5, 10, 9, 0, 0, 0, time.UTC), 0, 1000},
+		{"opened at the start", start, 0, 1000},
+		{"opened after the range", end, 0, 0},
+	}
+
+	for _, tt := range tests {
+		account := models.NewAccount()
+		account.OpeningBalance = 1000
+		account.OpeningDate = tt.openingDate
+		if got := ledgerOpening(account, start, end, tt.balanceAtStart); got != tt.want {
+			t.Errorf("%s: opening = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/password"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type AdminLoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+func AdminLogin(c *gin.Context) {
+	var req AdminLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind AdminLogin Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	admin := models.NewAdmin()
+	if err := db.DB.Table(consts.AdminTable).Where("username = ?", req.Username).First(admin).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40007,
+				"message": "invalid username or password",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to query database: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	if err := password.CheckHashed(req.Password, admin.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40007,
+			"message": "invalid username or password",
+		})
+		c.Abort()
+		return
+	}
+
+	tokens, err := issueTokens(db.DB, admin.Username, consts.Admin)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50004,
+			"message": "failed to generate JWT: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "login successfully",
+		"results": tokens,
+	})
+}
+
+// parsePage reads page and page_size from query, page starts from 1
+func parsePage(c *gin.Context) (int, int) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	return page, pageSize
+}
+
+type AdminUserResponse struct {
+	ID        uint      `json:"id"`
+	Phone     string    `json:"phone"`
+	Username  string    `json:"username"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AdminListUsers lists users, keyword matches username or phone
+func AdminListUsers(c *gin.Context) {
+	page, pageSize := parsePage(c)
+
+	query := db.DB.Table(consts.UserTable).Where("deleted_at IS NULL")
+	if keyword := c.Query("keyword"); keyword != "" {
+		like := "%" + keyword + "%"
+		query = query.Where("username LIKE ? OR phone LIKE ?", like, like)
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	var users []AdminUserResponse
+	if err := query.Select("id, phone, username, disabled, created_at").
+		Order("id").Offset((page - 1) * pageSize).Limit(pageSize).
+		Scan(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "get user list successfully",
+		"total":   total,
+		"results": users,
+	})
+}
+
+type AdminFamilyResponse struct {
+	ID          uint      `json:"id"`
+	Name        string    `json:"name"`
+	MemberCount int64     `json:"member_count"`
+	BillCount   int64     `json:"bill_count"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// AdminListFamilies lists families with member and bill counts, keyword matches family name
+func AdminListFamilies(c *gin.Context) {
+	page, pageSize := parsePage(c)
+
+	query := db.DB.Table(consts.FamilyTable).Where("family.deleted_at IS NULL")
+	if keyword := c.Query("keyword"); keyword != "" {
+		query = query.Where("family.name LIKE ?", "%"+keyword+"%")
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	var families []AdminFamilyResponse
+	if err := query.Select("family.id, family.name, family.created_at, " +
+		"(SELECT COUNT(*) FROM family_user WHERE family_user.family_id = family.id AND family_user.deleted_at IS NULL) AS member_count, " +
+		"(SELECT COUNT(*) FROM bill WHERE bill.family_id = family.id AND bill.deleted_at IS NULL) AS bill_count").
+		Order("family.id").Offset((page - 1) * pageSize).Limit(pageSize).
+		Scan(&families).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "get family list successfully",
+		"total":   total,
+		"results": families,
+	})
+}
+
+// AdminFamilyBillCount returns bill counts of one family grouped by type
+func AdminFamilyBillCount(c *gin.Context) {
+	familyID, err := strconv.ParseUint(c.Param("family_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "invalid family_id: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	result := db.DB.Table(consts.FamilyTable).Where("id = ?", uint(familyID)).Limit(1).Find(models.NewFamily())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + result.Error.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40004,
+			"message": "this family does not exist",
+		})
+		c.Abort()
+		return
+	}
+
+	var counts []struct {
+		Type  string `json:"type"`
+		Count int64  `json:"count"`
+	}
+	if err := db.DB.Table(consts.BillTable).Where("family_id = ? AND deleted_at IS NULL", uint(familyID)).
+		Select("type, COUNT(*) AS count").Group("type").Scan(&counts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	var total int64
+	for _, item := range counts {
+		total += item.Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "get bill count successfully",
+		"total":   total,
+		"results": counts,
+	})
+}
+
+// findUserByParam loads the user of :user_id, aborts if not found
+func findUserByParam(c *gin.Context) *models.User {
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "invalid user_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	user := models.NewUser()
+	if err := db.DB.Table(consts.UserTable).Where("id = ?", uint(userID)).First(user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40005,
+				"message": "this user does not exist",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to query database: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return nil
+	}
+
+	return user
+}
+
+// revokeUserSessions kicks user out of every device
+func revokeUserSessions(tx *gorm.DB, user *models.User) error {
+	now := time.Now().Truncate(time.Microsecond) // stored exactly, tokens are compared to it in microseconds
+	if err := tx.Table(consts.UserTable).Where("id = ?", user.ID).Update("tokens_revoked_at", now).Error; err != nil {
+		return err
+	}
+	user.TokensRevokedAt = &now
+	return revokeAllRefreshTokens(tx, user.Phone, consts.User)
+}
+
+func setUserDisabled(c *gin.Context, disabled bool) {
+	user := findUserByParam(c)
+	if c.IsAborted() {
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.UserTable).Where("id = ?", user.ID).Update("disabled", disabled).Error; err != nil {
+			return err
+		}
+		if disabled {
+			return revokeUserSessions(tx, user)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to update user: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "user updated successfully",
+	})
+}
+
+func AdminDisableUser(c *gin.Context) {
+	setUserDisabled(c, true)
+}
+
+func AdminEnableUser(c *gin.Context) {
+	setUserDisabled(c, false)
+}
+
+type AdminResetPasswordRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// AdminResetPassword sets a new password for the user and logs them out everywhere
+func AdminResetPassword(c *gin.Context) {
+	var req AdminResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind AdminResetPassword Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	if len(req.Password) < 6 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40014,
+			"message": "password must be at least 6 characters long",
+		})
+		c.Abort()
+		return
+	}
+
+	user := findUserByParam(c)
+	if c.IsAborted() {
+		return
+	}
+
+	hashedPassword, err := password.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50001,
+			"message": "failed to hash password: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.UserTable).Where("id = ?", user.ID).Update("password", hashedPassword).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, user)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to reset password: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "password reset successfully",
+	})
+}
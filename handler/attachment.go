@@ -0,0 +1,343 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/storage"
+	"github.com/hewo233/hdu-dx2/utils/thumbnail"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// findActiveBill loads the not deleted bill of :bill_id in the family, aborts if not found
+func findActiveBill(c *gin.Context) *models.Bill {
+	billID, err := strconv.ParseUint(c.Param("bill_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid bill_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	bill := models.NewBill()
+	if err := db.DB.Table(consts.BillTable).Where("id = ? AND family_id = ?", uint(billID), c.GetUint("family_id")).First(bill).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "bill not found: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+	return bill
+}
+
+func attachmentKey(familyID uint, billID uint) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("bill/%d/%d/%s", familyID, billID, hex.EncodeToString(b)), nil
+}
+
+// UploadAttachment takes one file in the multipart field "file"
+func UploadAttachment(c *gin.Context) {
+	bill := findActiveBill(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if !canModifyBill(c, bill) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can modify bills created by others",
+		})
+		c.Abort()
+		return
+	}
+
+	var count int64
+	if err := db.DB.Table(consts.AttachmentTable).Where("bill_id = ?", bill.ID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if count >= consts.MaxBillAttachments {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": "a bill can have at most " + strconv.Itoa(consts.MaxBillAttachments) + " attachments",
+		})
+		c.Abort()
+		return
+	}
+
+	// room for the multipart headers around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, consts.MaxAttachmentSize+consts.MB)
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to read file, it must be in field \"file\" and at most 3MB: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if header.Size > consts.MaxAttachmentSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40004,
+			"message": "file must be at most 3MB",
+		})
+		c.Abort()
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50001,
+			"message": "failed to open file: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, consts.MaxAttachmentSize+1))
+	if err != nil || len(data) > consts.MaxAttachmentSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40004,
+			"message": "file must be at most 3MB",
+		})
+		c.Abort()
+		return
+	}
+
+	// the type the client claims is ignored, only the content counts
+	mimeType, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	canThumb, ok := consts.AttachmentMimeTypes[mimeType]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40005,
+			"message": "only jpeg, png, gif, webp images and pdf can be uploaded, got " + mimeType,
+		})
+		c.Abort()
+		return
+	}
+
+	key, err := attachmentKey(bill.FamilyID, bill.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50001,
+			"message": "failed to generate storage key: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	if err := storage.Default.Put(key, data, mimeType); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50002,
+			"message": "failed to store file: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	attachment := models.NewAttachment()
+	attachment.BillID = bill.ID
+	attachment.FamilyID = bill.FamilyID
+	attachment.FileName = attachmentFileName(header.Filename)
+	attachment.MimeType = mimeType
+	attachment.Size = int64(len(data))
+	attachment.StorageKey = key
+	attachment.UploadedBy = c.GetUint("user_id")
+
+	// an image that cannot be decoded is still kept, it just has no thumbnail
+	if canThumb {
+		if thumb, err := thumbnail.Make(data, consts.ThumbnailSize); err == nil {
+			if err := storage.Default.Put(key+".thumb.jpg", thumb, "image/jpeg"); err == nil {
+				attachment.ThumbKey = key + ".thumb.jpg"
+				attachment.HasThumb = true
+			}
+		}
+	}
+
+	if err := db.DB.Table(consts.AttachmentTable).Create(attachment).Error; err != nil {
+		storage.DeleteAll([]string{attachment.StorageKey, attachment.ThumbKey})
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save attachment: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Upload Attachment Successfully",
+		"data":    attachment,
+	})
+}
+
+// attachmentFileName keeps only the base name, at most 255 characters
+func attachmentFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		name = "file"
+	}
+	if runes := []rune(name); len(runes) > 255 {
+		name = string(runes[len(runes)-255:])
+	}
+	return name
+}
+
+// ListAttachments lists the attachments of a bill, also of a bill in trash
+func ListAttachments(c *gin.Context) {
+	billID, err := strconv.ParseUint(c.Param("bill_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid bill_id: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	attachments := []models.Attachment{}
+	if err := db.DB.Table(consts.AttachmentTable).
+		Where("bill_id = ? AND family_id = ?", uint(billID), c.GetUint("family_id")).
+		Order("id").Find(&attachments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list attachments: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Attachments Successfully",
+		"data":    attachments,
+	})
+}
+
+// findAttachment loads the attachment of :attachment_id in the family, aborts if not found
+func findAttachment(c *gin.Context) *models.Attachment {
+	attachmentID, err := strconv.ParseUint(c.Param("attachment_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid attachment_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	attachment := models.NewAttachment()
+	if err := db.DB.Table(consts.AttachmentTable).
+		Where("id = ? AND family_id = ?", uint(attachmentID), c.GetUint("family_id")).
+		First(attachment).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "attachment not found: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+	return attachment
+}
+
+// DownloadAttachment streams the file, ?thumb=true for the thumbnail of an image
+func DownloadAttachment(c *gin.Context) {
+	attachment := findAttachment(c)
+	if c.IsAborted() {
+		return
+	}
+
+	key, size, contentType := attachment.StorageKey, attachment.Size, attachment.MimeType
+	if c.Query("thumb") == "true" {
+		if attachment.ThumbKey == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40003,
+				"message": "attachment has no thumbnail",
+			})
+			c.Abort()
+			return
+		}
+		key, size, contentType = attachment.ThumbKey, -1, "image/jpeg"
+	}
+
+	reader, err := storage.Default.Get(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50002,
+			"message": "failed to read file: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	defer reader.Close()
+
+	c.DataFromReader(http.StatusOK, size, contentType, reader, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType("inline", map[string]string{"filename": attachment.FileName}),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=86400",
+	})
+}
+
+// DeleteAttachment needs the same permission as modifying the bill
+func DeleteAttachment(c *gin.Context) {
+	attachment := findAttachment(c)
+	if c.IsAborted() {
+		return
+	}
+
+	bill := models.NewBill()
+	if err := db.DB.Table(consts.BillTable).Where("id = ?", attachment.BillID).First(bill).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "bill not found, restore it from trash first: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	if !canModifyBill(c, bill) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can modify bills created by others",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := db.DB.Table(consts.AttachmentTable).Unscoped().Where("id = ?", attachment.ID).Delete(&models.Attachment{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete attachment: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	storage.DeleteAll([]string{attachment.StorageKey, attachment.ThumbKey})
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "attachment deleted successfully",
+	})
+}
@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/filter"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// fields usable in the filter query parameter, see package filter for the grammar
+var billFilterFields = map[string]filter.Field{
+	"type":            {Column: "bill.type", Kind: filter.Text},
+	"category":        {Column: "bill.category", Kind: filter.Text},
+	"category_id":     {Column: "bill.category_id", Kind: filter.Int},
+	"object":          {Column: "bill.object", Kind: filter.Text},
+	"counterparty_id": {Column: "bill.counterparty_id", Kind: filter.Int},
+	"username":        {Column: "bill.username", Kind: filter.Text},
+	"description":     {Column: "bill.description", Kind: filter.Text},
+	"amount":          {Column: "bill.amount", Kind: filter.Int},
+	"currency":        {Column: "bill.currency", Kind: filter.Text},
+	"base_amount":     {Column: "bill.base_amount", Kind: filter.Int},
+	"date":            {Column: "bill.date", Kind: filter.Time},
+	"account_id":      {Column: "bill.account_id", Kind: filter.Int},
+	// tag=3 means the bill has tag 3, use NOT tag=3 for bills without it
+	"tag": {Column: "bill_tag.tag_id", Kind: filter.Int, Format: "bill.id IN (SELECT bill_tag.bill_id FROM bill_tag WHERE %s)"},
+}
+
+// billFilterRequest is read from the query string, list fields take repeated or comma separated values:
+// ?category=餐饮,交通&not_object=张三&amount_min=1000&q=报销&filter=type=expense OR amount>10000
+type billFilterRequest struct {
+	Type           string   `form:"type" binding:"omitempty,oneof=income expense"`
+	Category       []string `form:"category"`
+	NotCategory    []string `form:"not_category"`
+	CategoryID     []uint   `form:"category_id"` // also matches the children of the category
+	TagID          []uint   `form:"tag_id"`
+	TagMode        string   `form:"tag_mode" binding:"omitempty,oneof=any all"` // bills with any (default) or all of tag_id
+	NotTagID       []uint   `form:"not_tag_id"`
+	AccountID      []uint   `form:"account_id"`
+	CounterpartyID []uint   `form:"counterparty_id"`
+	Object         []string `form:"object"`
+	NotObject      []string `form:"not_object"`
+	Currency       []string `form:"currency"`
+	Username       []string `form:"username"`
+	NotUsername    []string `form:"not_username"`
+	AmountMin      *int     `form:"amount_min" binding:"omitnil,gte=0"`
+	AmountMax      *int     `form:"amount_max" binding:"omitnil,gte=0"`
+	Q              string   `form:"q"` // substring of description
+	StartDate      string   `form:"start_date"`
+	EndDate        string   `form:"end_date"`
+	Filter         string   `form:"filter"`
+}
+
+// splitValues flattens ?a=x,y&a=z into [x y z]
+func splitValues(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				result = append(result, v)
+			}
+		}
+	}
+	return result
+}
+
+func parseFilterDate(value string) (time.Time, error) {
+	if t, err := time.Parse(consts.TimeFormat, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// applyBillFilters adds the conditions of billFilterRequest to query, all of them are ANDed
+func applyBillFilters(c *gin.Context, query *gorm.DB) (*gorm.DB, error) {
+	var req billFilterRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		return nil, err
+	}
+
+	if req.Type != "" {
+		query = query.Where("bill.type = ?", req.Type)
+	}
+
+	in := []struct {
+		column string
+		values []string
+		not    bool
+	}{
+		{"bill.category", req.Category, false},
+		{"bill.category", req.NotCategory, true},
+		{"bill.object", req.Object, false},
+		{"bill.object", req.NotObject, true},
+		{"bill.currency", req.Currency, false},
+		{"bill.username", req.Username, false},
+		{"bill.username", req.NotUsername, true},
+	}
+	for _, cond := range in {
+		values := splitValues(cond.values)
+		if len(values) == 0 {
+			continue
+		}
+		if cond.not {
+			query = query.Where(cond.column+" NOT IN ?", values)
+		} else {
+			query = query.Where(cond.column+" IN ?", values)
+		}
+	}
+
+	if len(req.CategoryID) > 0 {
+		query = query.Where("bill.category_id IN (SELECT id FROM "+consts.CategoryTable+" WHERE family_id = bill.family_id AND (id IN ? OR parent_id IN ?))",
+			req.CategoryID, req.CategoryID)
+	}
+
+	if len(req.TagID) > 0 {
+		if req.TagMode == "all" {
+			query = query.Where("bill.id IN (SELECT bill_id FROM "+consts.BillTagTable+" WHERE tag_id IN ? GROUP BY bill_id HAVING COUNT(DISTINCT tag_id) = ?)",
+				req.TagID, len(uniqueIDs(req.TagID)))
+		} else {
+			query = query.Where("bill.id IN (SELECT bill_id FROM "+consts.BillTagTable+" WHERE tag_id IN ?)", req.TagID)
+		}
+	}
+	if len(req.NotTagID) > 0 {
+		query = query.Where("bill.id NOT IN (SELECT bill_id FROM "+consts.BillTagTable+" WHERE tag_id IN ?)", req.NotTagID)
+	}
+
+	if len(req.CounterpartyID) > 0 {
+		query = query.Where("bill.counterparty_id IN ?", req.CounterpartyID)
+	}
+
+	if len(req.AccountID) > 0 {
+		query = query.Where("bill.account_id IN ?", req.AccountID)
+	}
+
+	if req.AmountMin != nil {
+		query = query.Where("bill.amount >= ?", *req.AmountMin)
+	}
+	if req.AmountMax != nil {
+		query = query.Where("bill.amount <= ?", *req.AmountMax)
+	}
+	if req.Q != "" {
+		query = query.Where("bill.description ILIKE ?", "%"+filter.EscapeLike(req.Q)+"%")
+	}
+
+	if req.StartDate != "" {
+		startDate, err := parseFilterDate(req.StartDate)
+		if err != nil {
+			return nil, errors.New("failed to parse start_date: " + err.Error())
+		}
+		query = query.Where("bill.date >= ?", startDate)
+	}
+	if req.EndDate != "" {
+		endDate, err := parseFilterDate(req.EndDate)
+		if err != nil {
+			return nil, errors.New("failed to parse end_date: " + err.Error())
+		}
+		query = query.Where("bill.date <= ?", endDate)
+	}
+
+	if strings.TrimSpace(req.Filter) != "" {
+		sql, args, err := filter.Compile(req.Filter, billFilterFields)
+		if err != nil {
+			return nil, errors.New("invalid filter: " + err.Error())
+		}
+		query = query.Where(sql, args...)
+	}
+
+	return query, nil
+}
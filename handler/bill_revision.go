@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"net/http"
+	"strconv"
+)
+
+type BillRevisionResponse struct {
+	models.BillRevision
+	EditorName string `json:"editor_name"`
+}
+
+// ListBillRevisions shows the history of a bill, also for deleted bills
+func ListBillRevisions(c *gin.Context) {
+	billID, err := strconv.ParseUint(c.Param("bill_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid bill_id: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	familyID := c.GetUint("family_id")
+
+	result := db.DB.Table(consts.BillTable).Unscoped().Where("id = ? AND family_id = ?", uint(billID), familyID).Limit(1).Find(&models.Bill{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + result.Error.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "bill not found",
+		})
+		c.Abort()
+		return
+	}
+
+	var revisions []BillRevisionResponse
+	if err := db.DB.Table(consts.BillRevisionTable).
+		Select("bill_revision.*, \"user\".username AS editor_name").
+		Joins("LEFT JOIN \"user\" ON bill_revision.editor_id = \"user\".id").
+		Where("bill_revision.bill_id = ? AND bill_revision.family_id = ?", uint(billID), familyID).
+		Order("bill_revision.id").
+		Scan(&revisions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list bill revisions: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Bill Revisions Successfully",
+		"data":    revisions,
+	})
+}
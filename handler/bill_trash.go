@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/storage"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type TrashBillResponse struct {
+	models.Bill
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+// ListTrashBills lists soft deleted bills that are not purged yet
+func ListTrashBills(c *gin.Context) {
+	family := c.MustGet("family").(*models.Family)
+
+	var bills []models.Bill
+	if err := db.DB.Table(consts.BillTable).Unscoped().
+		Where("family_id = ? AND deleted_at IS NOT NULL", family.ID).
+		Order("deleted_at DESC").Find(&bills).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list trash: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	retention := time.Duration(family.TrashRetentionDays) * consts.OneDay
+	rep := make([]TrashBillResponse, 0, len(bills))
+	for _, bill := range bills {
+		rep = append(rep, TrashBillResponse{
+			Bill:    bill,
+			PurgeAt: bill.DeletedAt.Time.Add(retention),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Trash Successfully",
+		"data":    rep,
+	})
+}
+
+// findTrashBill loads the deleted bill of :bill_id, aborts if it is not in trash
+func findTrashBill(c *gin.Context) *models.Bill {
+	billID, err := strconv.ParseUint(c.Param("bill_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid bill_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	bill := models.NewBill()
+	if err := db.DB.Table(consts.BillTable).Unscoped().
+		Where("id = ? AND family_id = ? AND deleted_at IS NOT NULL", uint(billID), c.GetUint("family_id")).
+		First(bill).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "bill not found in trash: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	return bill
+}
+
+func RestoreBill(c *gin.Context) {
+	bill := findTrashBill(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if !canModifyBill(c, bill) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can modify bills created by others",
+		})
+		c.Abort()
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.BillTable).Unscoped().Where("id = ?", bill.ID).Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		return db.RecordBillRevision(tx, bill, consts.BillActionRestore, c.GetUint("user_id"), models.BillChanges{})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to restore bill: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Restore Bill Successfully",
+	})
+}
+
+// PurgeBill removes a bill in trash at once, it cannot be restored anymore
+func PurgeBill(c *gin.Context) {
+	bill := findTrashBill(c)
+	if c.IsAborted() {
+		return
+	}
+
+	var keys []string
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		keys, err = db.PurgeBills(tx, []uint{bill.ID})
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to purge bill: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	storage.DeleteAll(keys)
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Purge Bill Successfully",
+	})
+}
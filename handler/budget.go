@@ -0,0 +1,456 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBudgetCategory = errors.New("budget category must be an expense category of the family")
+
+// date_trunc units of the periods that repeat
+var budgetPeriodUnits = map[string]string{
+	consts.BudgetWeekly:  "week",
+	consts.BudgetMonthly: "month",
+	consts.BudgetYearly:  "year",
+}
+
+// BudgetStatus is a budget in one period, amounts in 分 of the base currency
+type BudgetStatus struct {
+	BudgetID    uint      `json:"budget_id"`
+	Name        string    `json:"name"`
+	CategoryID  uint      `json:"category_id"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"` // exclusive
+	Amount      int64     `json:"amount"`
+	Rollover    int64     `json:"rollover"`  // unspent amount of the earlier periods
+	Available   int64     `json:"available"` // amount + rollover
+	Spent       int64     `json:"spent"`
+	Remaining   int64     `json:"remaining"`
+	Percent     float64   `json:"percent"` // spent of available
+	Status      string    `json:"status"`  // ok, warning, exceeded
+}
+
+// budgetBills is the query of the expense the budget counts, bills without an exchange rate are left out
+func budgetBills(tx *gorm.DB, budget *models.Budget) *gorm.DB {
+	query := tx.Table(consts.BillTable).
+		Where("bill.family_id = ? AND bill.type = ? AND bill.deleted_at IS NULL", budget.FamilyID, consts.BillTypeExpense)
+	if budget.CategoryID != 0 {
+		query = query.Where("bill.category_id IN (SELECT id FROM "+consts.CategoryTable+" WHERE id = ? OR parent_id = ?)",
+			budget.CategoryID, budget.CategoryID)
+	}
+	return query
+}
+
+// budgetStatus computes the budget in the period containing at, false if the budget does not cover at
+func budgetStatus(tx *gorm.DB, budget *models.Budget, at time.Time) (*BudgetStatus, bool, error) {
+	start, end, ok := budget.PeriodAt(at)
+	if !ok {
+		return nil, false, nil
+	}
+
+	status := &BudgetStatus{
+		BudgetID:    budget.ID,
+		Name:        budget.Name,
+		CategoryID:  budget.CategoryID,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Amount:      int64(budget.Amount),
+	}
+
+	if err := budgetBills(tx, budget).Where("bill.date >= ? AND bill.date < ?", start, end).
+		Select("COALESCE(SUM(bill.base_amount), 0)").Row().Scan(&status.Spent); err != nil {
+		return nil, false, err
+	}
+
+	// the unspent amount of every earlier period is carried, an overspent period carries nothing
+	first := budget.PeriodStart(budget.StartDate)
+	if unit, ok := budgetPeriodUnits[budget.Period]; ok && budget.Rollover && first.Before(start) {
+		var rows []struct {
+			Period time.Time
+			Spent  int64
+		}
+		if err := budgetBills(tx, budget).Where("bill.date >= ? AND bill.date < ?", first, start).
+			Select("date_trunc('" + unit + "', bill.date AT TIME ZONE 'UTC') AS period, " +
+				"COALESCE(SUM(bill.base_amount), 0) AS spent").
+			Group("period").Scan(&rows).Error; err != nil {
+			return nil, false, err
+		}
+		spent := map[int64]int64{}
+		for _, row := range rows {
+			spent[row.Period.Unix()] = row.Spent
+		}
+		for period := first; period.Before(start); period = budget.PeriodEnd(period) {
+			status.Rollover = max(0, status.Rollover+int64(budget.Amount)-spent[period.Unix()])
+		}
+	}
+
+	status.Available = status.Amount + status.Rollover
+	status.Remaining = status.Available - status.Spent
+	if status.Available > 0 {
+		status.Percent = math.Round(float64(status.Spent)*1000/float64(status.Available)) / 10
+	}
+	switch {
+	case status.Spent > status.Available:
+		status.Status = consts.BudgetExceeded
+	case status.Percent >= float64(budget.WarnPercent):
+		status.Status = consts.BudgetWarning
+	default:
+		status.Status = consts.BudgetOK
+	}
+	return status, true, nil
+}
+
+// budgetWarnings returns the budgets a new expense bill pushed over the warn percent or over the limit
+func budgetWarnings(tx *gorm.DB, bill *models.Bill) ([]BudgetStatus, error) {
+	warnings := []BudgetStatus{}
+	if bill.Type != consts.BillTypeExpense || bill.BaseAmount == nil {
+		return warnings, nil
+	}
+
+	var budgets []models.Budget
+	if err := tx.Table(consts.BudgetTable).
+		Where("family_id = ? AND (category_id = 0 OR category_id = ? OR category_id = (SELECT parent_id FROM "+consts.CategoryTable+" WHERE id = ?))",
+			bill.FamilyID, bill.CategoryID, bill.CategoryID).
+		Find(&budgets).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range budgets {
+		status, ok, err := budgetStatus(tx, &budgets[i], bill.Date)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || status.Status == consts.BudgetOK {
+			continue
+		}
+
+		before := status.Spent - int64(*bill.BaseAmount)
+		wasExceeded := before > status.Available
+		wasWarning := status.Available > 0 && float64(before)*100 >= float64(budgets[i].WarnPercent)*float64(status.Available)
+		if (status.Status == consts.BudgetExceeded && !wasExceeded) || (status.Status == consts.BudgetWarning && !wasWarning) {
+			warnings = append(warnings, *status)
+		}
+	}
+	return warnings, nil
+}
+
+// checkBudgetCategory allows 0 for the whole family, or an expense category of the family
+func checkBudgetCategory(tx *gorm.DB, familyID uint, categoryID uint) error {
+	if categoryID == 0 {
+		return nil
+	}
+	var count int64
+	if err := tx.Table(consts.CategoryTable).
+		Where("id = ? AND family_id = ? AND type = ? AND deleted_at IS NULL", categoryID, familyID, consts.BillTypeExpense).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return errBudgetCategory
+	}
+	return nil
+}
+
+func ListBudgets(c *gin.Context) {
+	budgets := []models.Budget{}
+	if err := db.DB.Table(consts.BudgetTable).Where("family_id = ?", c.GetUint("family_id")).Order("id").Find(&budgets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list budgets: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Budgets Successfully",
+		"data":    budgets,
+	})
+}
+
+// BudgetStatuses returns every budget covering ?date=, today by default
+func BudgetStatuses(c *gin.Context) {
+	at := db.BillNow()
+	if value := c.Query("date"); value != "" {
+		date, err := parseFilterDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		at = date
+	}
+
+	var budgets []models.Budget
+	if err := db.DB.Table(consts.BudgetTable).Where("family_id = ?", c.GetUint("family_id")).Order("id").Find(&budgets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list budgets: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	statuses := []BudgetStatus{}
+	for i := range budgets {
+		status, ok, err := budgetStatus(db.DB, &budgets[i], at)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to compute budget: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		if ok {
+			statuses = append(statuses, *status)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":         20000,
+		"message":       "Budget Statuses Successfully",
+		"data":          statuses,
+		"base_currency": baseCurrency(c),
+	})
+}
+
+type createBudgetRequest struct {
+	Name        string `json:"name" binding:"required,max=100"`
+	CategoryID  uint   `json:"category_id"` // 0 for every expense
+	Amount      int    `json:"amount" binding:"required,gt=0"`
+	Period      string `json:"period" binding:"required,oneof=weekly monthly yearly custom"`
+	StartDate   string `json:"start_date"` // defaults to today
+	EndDate     string `json:"end_date" binding:"required_if=Period custom"`
+	Rollover    bool   `json:"rollover"`
+	WarnPercent int    `json:"warn_percent" binding:"omitempty,min=1,max=100"` // defaults to 80
+}
+
+// parseBudgetDate returns the start of the day of value
+func parseBudgetDate(value string) (time.Time, error) {
+	date, err := parseFilterDate(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+func CreateBudget(c *gin.Context) {
+	var req createBudgetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateBudget Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	budget := models.NewBudget()
+	budget.FamilyID = c.GetUint("family_id")
+	budget.CategoryID = req.CategoryID
+	budget.Name = strings.TrimSpace(req.Name)
+	budget.Amount = req.Amount
+	budget.Period = req.Period
+	budget.Rollover = req.Rollover
+	budget.WarnPercent = req.WarnPercent
+	if budget.WarnPercent == 0 {
+		budget.WarnPercent = consts.DefaultBudgetWarnPercent
+	}
+	budget.CreatedBy = c.GetUint("user_id")
+
+	now := db.BillNow()
+	budget.StartDate = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if req.StartDate != "" {
+		date, err := parseBudgetDate(req.StartDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse start_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		budget.StartDate = date
+	}
+	if req.EndDate != "" {
+		date, err := parseBudgetDate(req.EndDate)
+		if err != nil || date.Before(budget.StartDate) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "end_date must be a date not before start_date",
+			})
+			c.Abort()
+			return
+		}
+		budget.EndDate = &date
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkBudgetCategory(tx, budget.FamilyID, budget.CategoryID); err != nil {
+			return err
+		}
+		return tx.Table(consts.BudgetTable).Create(budget).Error
+	})
+	if err != nil {
+		budgetErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Create Budget Successfully",
+		"data":    budget,
+	})
+}
+
+func budgetErrorResponse(c *gin.Context, err error) {
+	if errors.Is(err, errBudgetCategory) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": err.Error(),
+		})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save budget: " + err.Error(),
+		})
+	}
+	c.Abort()
+}
+
+// findBudget loads the budget of :budget_id in the family, aborts if not found
+func findBudget(c *gin.Context) *models.Budget {
+	budgetID, err := strconv.ParseUint(c.Param("budget_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid budget_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	budget := models.NewBudget()
+	if err := db.DB.Table(consts.BudgetTable).Where("id = ? AND family_id = ?", uint(budgetID), c.GetUint("family_id")).First(budget).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "budget not found: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+	return budget
+}
+
+// updateBudgetRequest cannot change the period, create another budget for that
+type updateBudgetRequest struct {
+	Name        *string `json:"name" binding:"omitnil,min=1,max=100"`
+	CategoryID  *uint   `json:"category_id"`
+	Amount      *int    `json:"amount" binding:"omitnil,gt=0"`
+	EndDate     *string `json:"end_date"` // "" removes the end date, not for custom budgets
+	Rollover    *bool   `json:"rollover"`
+	WarnPercent *int    `json:"warn_percent" binding:"omitnil,min=1,max=100"`
+}
+
+func UpdateBudget(c *gin.Context) {
+	var req updateBudgetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateBudget Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	budget := findBudget(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if req.Name != nil {
+		budget.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.CategoryID != nil {
+		budget.CategoryID = *req.CategoryID
+	}
+	if req.Amount != nil {
+		budget.Amount = *req.Amount
+	}
+	if req.Rollover != nil {
+		budget.Rollover = *req.Rollover
+	}
+	if req.WarnPercent != nil {
+		budget.WarnPercent = *req.WarnPercent
+	}
+	if req.EndDate != nil {
+		if *req.EndDate == "" && budget.Period != consts.BudgetCustom {
+			budget.EndDate = nil
+		} else {
+			date, err := parseBudgetDate(*req.EndDate)
+			if err != nil || date.Before(budget.StartDate) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"errno":   40001,
+					"message": "end_date must be a date not before start_date",
+				})
+				c.Abort()
+				return
+			}
+			budget.EndDate = &date
+		}
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if req.CategoryID != nil {
+			if err := checkBudgetCategory(tx, budget.FamilyID, budget.CategoryID); err != nil {
+				return err
+			}
+		}
+		return tx.Table(consts.BudgetTable).Save(budget).Error
+	})
+	if err != nil {
+		budgetErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Update Budget Successfully",
+		"data":    budget,
+	})
+}
+
+func DeleteBudget(c *gin.Context) {
+	budget := findBudget(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if err := db.DB.Table(consts.BudgetTable).Unscoped().Where("id = ?", budget.ID).Delete(&models.Budget{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete budget: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "budget deleted successfully",
+	})
+}
@@ -0,0 +1,441 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errCategoryNotFound     = errors.New("category not found")
+	errCategoryArchived     = errors.New("category is archived")
+	errCategoryTypeMismatch = errors.New("category type does not match bill type")
+	errCategoryParent       = errors.New("parent must be a top level category of the same type, and a category with children cannot have a parent")
+	errCategoryNameTaken    = errors.New("category with the same name already exists")
+)
+
+// categoryErrorResponse writes the response of the errors above, anything else is a 500
+func categoryErrorResponse(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errCategoryNotFound), errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": errCategoryNotFound.Error(),
+		})
+	case errors.Is(err, errCategoryArchived), errors.Is(err, errCategoryTypeMismatch),
+		errors.Is(err, errCategoryParent), errors.Is(err, errCategoryNameTaken):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save category: " + err.Error(),
+		})
+	}
+	c.Abort()
+}
+
+// resolveBillCategory finds the category of a bill by id, or by name for clients that still send text.
+// An unknown name creates a new top level category so those clients keep working.
+func resolveBillCategory(tx *gorm.DB, familyID uint, billType string, categoryID uint, name string) (*models.Category, error) {
+	category := models.NewCategory()
+
+	if categoryID != 0 {
+		if err := tx.Table(consts.CategoryTable).Where("id = ? AND family_id = ?", categoryID, familyID).First(category).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, errCategoryNotFound
+			}
+			return nil, err
+		}
+		if category.ArchivedAt != nil {
+			return nil, errCategoryArchived
+		}
+		if category.Type != billType {
+			return nil, errCategoryTypeMismatch
+		}
+		return category, nil
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errCategoryNotFound
+	}
+
+	result := tx.Table(consts.CategoryTable).
+		Where("family_id = ? AND type = ? AND LOWER(name) = LOWER(?) AND archived_at IS NULL", familyID, billType, name).
+		Order("parent_id, id").Limit(1).Find(category)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return category, nil
+	}
+
+	category.FamilyID = familyID
+	category.Type = billType
+	category.Name = name
+	if err := tx.Table(consts.CategoryTable).Create(category).Error; err != nil {
+		return nil, err
+	}
+	return category, nil
+}
+
+// checkCategoryParent checks that category can be put under parentID
+func checkCategoryParent(tx *gorm.DB, category *models.Category, parentID uint) error {
+	if parentID == 0 {
+		return nil
+	}
+	if parentID == category.ID {
+		return errCategoryParent
+	}
+
+	parent := models.NewCategory()
+	if err := tx.Table(consts.CategoryTable).Where("id = ? AND family_id = ?", parentID, category.FamilyID).First(parent).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errCategoryParent
+		}
+		return err
+	}
+	if parent.ParentID != 0 || parent.Type != category.Type {
+		return errCategoryParent
+	}
+
+	if category.ID != 0 {
+		var children int64
+		if err := tx.Table(consts.CategoryTable).Where("parent_id = ? AND deleted_at IS NULL", category.ID).Count(&children).Error; err != nil {
+			return err
+		}
+		if children > 0 {
+			return errCategoryParent
+		}
+	}
+
+	return nil
+}
+
+// checkCategoryName keeps names unique among siblings, case-insensitive
+func checkCategoryName(tx *gorm.DB, category *models.Category) error {
+	var count int64
+	if err := tx.Table(consts.CategoryTable).
+		Where("family_id = ? AND type = ? AND parent_id = ? AND LOWER(name) = LOWER(?) AND id <> ? AND deleted_at IS NULL",
+			category.FamilyID, category.Type, category.ParentID, category.Name, category.ID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errCategoryNameTaken
+	}
+	return nil
+}
+
+type CategoryNode struct {
+	models.Category
+	Children []CategoryNode `json:"children"`
+}
+
+// ListCategories returns the catalog as a tree, ?include_archived=true also returns archived ones
+func ListCategories(c *gin.Context) {
+	query := db.DB.Table(consts.CategoryTable).Where("family_id = ?", c.GetUint("family_id"))
+	if c.Query("include_archived") != "true" {
+		query = query.Where("archived_at IS NULL")
+	}
+	if billType := c.Query("type"); billType != "" {
+		query = query.Where("type = ?", billType)
+	}
+
+	var categories []models.Category
+	if err := query.Order("sort_order, id").Find(&categories).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list categories: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	children := map[uint][]CategoryNode{}
+	for _, category := range categories {
+		if category.ParentID != 0 {
+			children[category.ParentID] = append(children[category.ParentID], CategoryNode{Category: category, Children: []CategoryNode{}})
+		}
+	}
+	tree := make([]CategoryNode, 0)
+	for _, category := range categories {
+		if category.ParentID == 0 {
+			node := CategoryNode{Category: category, Children: children[category.ID]}
+			if node.Children == nil {
+				node.Children = []CategoryNode{}
+			}
+			tree = append(tree, node)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Categories Successfully",
+		"data":    tree,
+	})
+}
+
+type createCategoryRequest struct {
+	Name      string `json:"name" binding:"required,max=100"`
+	Type      string `json:"type" binding:"required,oneof=income expense"`
+	ParentID  uint   `json:"parent_id"`
+	Icon      string `json:"icon" binding:"max=100"`
+	Color     string `json:"color" binding:"omitempty,hexcolor"`
+	SortOrder int    `json:"sort_order"`
+}
+
+func CreateCategory(c *gin.Context) {
+	var req createCategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateCategory Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	category := models.NewCategory()
+	category.FamilyID = c.GetUint("family_id")
+	category.ParentID = req.ParentID
+	category.Name = strings.TrimSpace(req.Name)
+	category.Type = req.Type
+	category.Icon = req.Icon
+	category.Color = req.Color
+	category.SortOrder = req.SortOrder
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkCategoryParent(tx, category, req.ParentID); err != nil {
+			return err
+		}
+		if err := checkCategoryName(tx, category); err != nil {
+			return err
+		}
+		return tx.Table(consts.CategoryTable).Create(category).Error
+	})
+	if err != nil {
+		categoryErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Create Category Successfully",
+		"data":    category,
+	})
+}
+
+// findCategory loads the category of :category_id in the family, aborts if not found
+func findCategory(c *gin.Context) *models.Category {
+	categoryID, err := strconv.ParseUint(c.Param("category_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid category_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	category := models.NewCategory()
+	if err := db.DB.Table(consts.CategoryTable).Where("id = ? AND family_id = ?", uint(categoryID), c.GetUint("family_id")).First(category).Error; err != nil {
+		categoryErrorResponse(c, err)
+		return nil
+	}
+	return category
+}
+
+// type cannot be changed, the bills of the category would no longer match it
+type updateCategoryRequest struct {
+	Name      *string `json:"name" binding:"omitnil,min=1,max=100"`
+	ParentID  *uint   `json:"parent_id"`
+	Icon      *string `json:"icon" binding:"omitnil,max=100"`
+	Color     *string `json:"color" binding:"omitnil,omitempty,hexcolor"`
+	SortOrder *int    `json:"sort_order"`
+}
+
+// UpdateCategory also renames the category text of its bills
+func UpdateCategory(c *gin.Context) {
+	var req updateCategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateCategory Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	category := findCategory(c)
+	if c.IsAborted() {
+		return
+	}
+
+	oldName := category.Name
+	if req.Name != nil {
+		category.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Icon != nil {
+		category.Icon = *req.Icon
+	}
+	if req.Color != nil {
+		category.Color = *req.Color
+	}
+	if req.SortOrder != nil {
+		category.SortOrder = *req.SortOrder
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if req.ParentID != nil && *req.ParentID != category.ParentID {
+			if err := checkCategoryParent(tx, category, *req.ParentID); err != nil {
+				return err
+			}
+			category.ParentID = *req.ParentID
+		}
+		if err := checkCategoryName(tx, category); err != nil {
+			return err
+		}
+		if err := tx.Table(consts.CategoryTable).Save(category).Error; err != nil {
+			return err
+		}
+		if category.Name == oldName {
+			return nil
+		}
+		return tx.Table(consts.BillTable).Unscoped().Where("category_id = ?", category.ID).Update("category", category.Name).Error
+	})
+	if err != nil {
+		categoryErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Update Category Successfully",
+		"data":    category,
+	})
+}
+
+// ArchiveCategory hides a category and its children from new bills, old bills keep it
+func ArchiveCategory(c *gin.Context) {
+	category := findCategory(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if err := db.DB.Table(consts.CategoryTable).
+		Where("(id = ? OR parent_id = ?) AND archived_at IS NULL AND deleted_at IS NULL", category.ID, category.ID).
+		Update("archived_at", time.Now()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to archive category: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "category archived successfully",
+	})
+}
+
+// UnarchiveCategory only restores the category itself, a child needs its parent restored first
+func UnarchiveCategory(c *gin.Context) {
+	category := findCategory(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if category.ParentID != 0 {
+		var archivedParent int64
+		if err := db.DB.Table(consts.CategoryTable).Where("id = ? AND archived_at IS NOT NULL AND deleted_at IS NULL", category.ParentID).Count(&archivedParent).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to query database: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		if archivedParent > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40003,
+				"message": "parent category is archived",
+			})
+			c.Abort()
+			return
+		}
+	}
+
+	if err := db.DB.Table(consts.CategoryTable).Where("id = ?", category.ID).Update("archived_at", nil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to unarchive category: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "category unarchived successfully",
+	})
+}
+
+// DeleteCategory only deletes categories no bill ever used, archive the others
+func DeleteCategory(c *gin.Context) {
+	category := findCategory(c)
+	if c.IsAborted() {
+		return
+	}
+
+	var bills, children int64
+	if err := db.DB.Table(consts.BillTable).Unscoped().Where("category_id = ?", category.ID).Count(&bills).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if err := db.DB.Table(consts.CategoryTable).Where("parent_id = ? AND deleted_at IS NULL", category.ID).Count(&children).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if bills > 0 || children > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40004,
+			"message": "category is used by bills or has children, archive it instead",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := db.DB.Table(consts.CategoryTable).Where("id = ?", category.ID).Delete(&models.Category{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete category: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "category deleted successfully",
+	})
+}
@@ -0,0 +1,543 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/filter"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errCounterpartyNotFound  = errors.New("counterparty not found")
+	errCounterpartyNameTaken = errors.New("name or alias is already used by another counterparty")
+	errCounterpartyMerge     = errors.New("source_ids must be other counterparties of the family")
+)
+
+// counterpartyErrorResponse writes the response of the errors above, anything else is a 500
+func counterpartyErrorResponse(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errCounterpartyNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": err.Error(),
+		})
+	case errors.Is(err, errCounterpartyNameTaken), errors.Is(err, errCounterpartyMerge):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save counterparty: " + err.Error(),
+		})
+	}
+	c.Abort()
+}
+
+// resolveBillCounterparty finds the counterparty of a bill by id, or by name or alias for clients that
+// still send object. An unknown name creates a new counterparty so those clients keep working.
+func resolveBillCounterparty(tx *gorm.DB, familyID uint, counterpartyID uint, name string) (*models.Counterparty, error) {
+	if counterpartyID == 0 {
+		if db.NormalizeCounterpartyName(name) == "" {
+			return nil, errCounterpartyNotFound
+		}
+		return db.ResolveCounterparty(tx, familyID, name)
+	}
+
+	counterparty := models.NewCounterparty()
+	if err := tx.Table(consts.CounterpartyTable).Where("id = ? AND family_id = ?", counterpartyID, familyID).First(counterparty).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errCounterpartyNotFound
+		}
+		return nil, err
+	}
+	return counterparty, nil
+}
+
+// normalizeAliases normalizes the aliases, drops empty ones, duplicates and the name itself
+func normalizeAliases(name string, aliases []string) []string {
+	seen := map[string]bool{strings.ToLower(name): true}
+	result := []string{}
+	for _, alias := range aliases {
+		alias = db.NormalizeCounterpartyName(alias)
+		if alias == "" || seen[strings.ToLower(alias)] {
+			continue
+		}
+		seen[strings.ToLower(alias)] = true
+		result = append(result, alias)
+	}
+	return result
+}
+
+// checkCounterpartyNames keeps every name and alias pointing to one counterparty of the family
+func checkCounterpartyNames(tx *gorm.DB, counterparty *models.Counterparty, aliases []string) error {
+	names := make([]string, 0, len(aliases)+1)
+	for _, name := range append([]string{counterparty.Name}, aliases...) {
+		names = append(names, strings.ToLower(name))
+	}
+
+	var count int64
+	if err := tx.Table(consts.CounterpartyTable).
+		Where("family_id = ? AND id <> ? AND (LOWER(name) IN ? OR id IN (SELECT counterparty_id FROM "+consts.CounterpartyAliasTable+
+			" WHERE family_id = ? AND LOWER(alias) IN ?))", counterparty.FamilyID, counterparty.ID, names, counterparty.FamilyID, names).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errCounterpartyNameTaken
+	}
+	return nil
+}
+
+// setCounterpartyAliases replaces the aliases of a counterparty
+func setCounterpartyAliases(tx *gorm.DB, counterparty *models.Counterparty, aliases []string) error {
+	if err := tx.Table(consts.CounterpartyAliasTable).Where("counterparty_id = ?", counterparty.ID).Delete(&models.CounterpartyAlias{}).Error; err != nil {
+		return err
+	}
+	counterparty.Aliases = aliases
+	if len(aliases) == 0 {
+		return nil
+	}
+
+	rows := make([]models.CounterpartyAlias, 0, len(aliases))
+	for _, alias := range aliases {
+		rows = append(rows, models.CounterpartyAlias{CounterpartyID: counterparty.ID, FamilyID: counterparty.FamilyID, Alias: alias})
+	}
+	return tx.Table(consts.CounterpartyAliasTable).Create(&rows).Error
+}
+
+// loadCounterpartyAliases fills Aliases of the counterparties
+func loadCounterpartyAliases(tx *gorm.DB, counterparties []models.Counterparty) error {
+	if len(counterparties) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, 0, len(counterparties))
+	for _, counterparty := range counterparties {
+		ids = append(ids, counterparty.ID)
+	}
+	var rows []models.CounterpartyAlias
+	if err := tx.Table(consts.CounterpartyAliasTable).Where("counterparty_id IN ?", ids).Order("id").Find(&rows).Error; err != nil {
+		return err
+	}
+
+	aliases := map[uint][]string{}
+	for _, row := range rows {
+		aliases[row.CounterpartyID] = append(aliases[row.CounterpartyID], row.Alias)
+	}
+	for i := range counterparties {
+		counterparties[i].Aliases = aliases[counterparties[i].ID]
+		if counterparties[i].Aliases == nil {
+			counterparties[i].Aliases = []string{}
+		}
+	}
+	return nil
+}
+
+// counterpartyTables are the tables whose rows point to a counterparty with counterparty_id and keep its name in object
+var counterpartyTables = []string{consts.BillTable, consts.RecurringBillTable, consts.LoanTable}
+
+// renameCounterpartyObjects keeps the object text of bills, recurring bills and loans in sync with the name
+func renameCounterpartyObjects(tx *gorm.DB, counterparty *models.Counterparty) error {
+	for _, table := range counterpartyTables {
+		if err := tx.Table(table).Unscoped().Where("counterparty_id = ?", counterparty.ID).Update("object", counterparty.Name).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListCounterparties lists the counterparties of the family by name, ?q= searches names and aliases, ?kind= filters
+func ListCounterparties(c *gin.Context) {
+	familyID := c.GetUint("family_id")
+	query := db.DB.Table(consts.CounterpartyTable).Where("family_id = ?", familyID)
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		like := "%" + filter.EscapeLike(q) + "%"
+		query = query.Where("name ILIKE ? OR id IN (SELECT counterparty_id FROM "+consts.CounterpartyAliasTable+
+			" WHERE family_id = ? AND alias ILIKE ?)", like, familyID, like)
+	}
+
+	counterparties := []models.Counterparty{}
+	err := query.Order("name, id").Find(&counterparties).Error
+	if err == nil {
+		err = loadCounterpartyAliases(db.DB, counterparties)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list counterparties: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Counterparties Successfully",
+		"data":    counterparties,
+	})
+}
+
+type createCounterpartyRequest struct {
+	Name    string   `json:"name" binding:"required,max=100"`
+	Kind    string   `json:"kind" binding:"omitempty,oneof=person merchant employer other"` // default other
+	Phone   string   `json:"phone" binding:"max=50"`
+	Email   string   `json:"email" binding:"omitempty,email,max=100"`
+	Address string   `json:"address" binding:"max=255"`
+	Note    string   `json:"note" binding:"max=255"`
+	Aliases []string `json:"aliases" binding:"max=50,dive,max=100"`
+}
+
+func CreateCounterparty(c *gin.Context) {
+	var req createCounterpartyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateCounterparty Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	counterparty := models.NewCounterparty()
+	counterparty.FamilyID = c.GetUint("family_id")
+	counterparty.Name = db.NormalizeCounterpartyName(req.Name)
+	counterparty.Kind = req.Kind
+	if counterparty.Kind == "" {
+		counterparty.Kind = consts.CounterpartyOther
+	}
+	counterparty.Phone = req.Phone
+	counterparty.Email = req.Email
+	counterparty.Address = req.Address
+	counterparty.Note = req.Note
+	if counterparty.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "name cannot be blank",
+		})
+		c.Abort()
+		return
+	}
+	aliases := normalizeAliases(counterparty.Name, req.Aliases)
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkCounterpartyNames(tx, counterparty, aliases); err != nil {
+			return err
+		}
+		if err := tx.Table(consts.CounterpartyTable).Create(counterparty).Error; err != nil {
+			return err
+		}
+		return setCounterpartyAliases(tx, counterparty, aliases)
+	})
+	if err != nil {
+		counterpartyErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Create Counterparty Successfully",
+		"data":    counterparty,
+	})
+}
+
+// findCounterparty loads the counterparty of :counterparty_id in the family with its aliases, aborts if not found
+func findCounterparty(c *gin.Context) *models.Counterparty {
+	counterpartyID, err := strconv.ParseUint(c.Param("counterparty_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid counterparty_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	counterparties := []models.Counterparty{}
+	err = db.DB.Table(consts.CounterpartyTable).Where("id = ? AND family_id = ?", uint(counterpartyID), c.GetUint("family_id")).Find(&counterparties).Error
+	if err == nil && len(counterparties) == 0 {
+		err = errCounterpartyNotFound
+	}
+	if err == nil {
+		err = loadCounterpartyAliases(db.DB, counterparties)
+	}
+	if err != nil {
+		counterpartyErrorResponse(c, err)
+		return nil
+	}
+	return &counterparties[0]
+}
+
+type updateCounterpartyRequest struct {
+	Name    *string   `json:"name" binding:"omitnil,min=1,max=100"`
+	Kind    *string   `json:"kind" binding:"omitnil,oneof=person merchant employer other"`
+	Phone   *string   `json:"phone" binding:"omitnil,max=50"`
+	Email   *string   `json:"email" binding:"omitnil,max=100,email|len=0"` // "" removes the email
+	Address *string   `json:"address" binding:"omitnil,max=255"`
+	Note    *string   `json:"note" binding:"omitnil,max=255"`
+	Aliases *[]string `json:"aliases" binding:"omitnil,max=50,dive,max=100"` // replaces all aliases
+}
+
+// UpdateCounterparty also renames the object text of its bills
+func UpdateCounterparty(c *gin.Context) {
+	var req updateCounterpartyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateCounterparty Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	counterparty := findCounterparty(c)
+	if c.IsAborted() {
+		return
+	}
+
+	oldName := counterparty.Name
+	if req.Name != nil {
+		counterparty.Name = db.NormalizeCounterpartyName(*req.Name)
+		if counterparty.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "name cannot be blank",
+			})
+			c.Abort()
+			return
+		}
+	}
+	if req.Kind != nil {
+		counterparty.Kind = *req.Kind
+	}
+	if req.Phone != nil {
+		counterparty.Phone = *req.Phone
+	}
+	if req.Email != nil {
+		counterparty.Email = *req.Email
+	}
+	if req.Address != nil {
+		counterparty.Address = *req.Address
+	}
+	if req.Note != nil {
+		counterparty.Note = *req.Note
+	}
+	aliases := counterparty.Aliases
+	if req.Aliases != nil {
+		aliases = *req.Aliases
+	}
+	aliases = normalizeAliases(counterparty.Name, aliases)
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkCounterpartyNames(tx, counterparty, aliases); err != nil {
+			return err
+		}
+		if err := tx.Table(consts.CounterpartyTable).Save(counterparty).Error; err != nil {
+			return err
+		}
+		if err := setCounterpartyAliases(tx, counterparty, aliases); err != nil {
+			return err
+		}
+		if counterparty.Name == oldName {
+			return nil
+		}
+		return renameCounterpartyObjects(tx, counterparty)
+	})
+	if err != nil {
+		counterpartyErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Update Counterparty Successfully",
+		"data":    counterparty,
+	})
+}
+
+type mergeCounterpartiesRequest struct {
+	SourceIDs []uint `json:"source_ids" binding:"required,min=1,max=100"`
+}
+
+// MergeCounterparties moves the bills, recurring bills and loans of the source counterparties to :counterparty_id and deletes them.
+// Their names and aliases become aliases of the target, so old clients sending them still find it.
+func MergeCounterparties(c *gin.Context) {
+	var req mergeCounterpartiesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind MergeCounterparties Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	target := findCounterparty(c)
+	if c.IsAborted() {
+		return
+	}
+
+	sourceIDs := uniqueIDs(req.SourceIDs)
+	merged := 0
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var sources []models.Counterparty
+		if err := tx.Table(consts.CounterpartyTable).Where("id IN ? AND family_id = ? AND id <> ?", sourceIDs, target.FamilyID, target.ID).
+			Find(&sources).Error; err != nil {
+			return err
+		}
+		if len(sources) != len(sourceIDs) {
+			return errCounterpartyMerge
+		}
+		if err := loadCounterpartyAliases(tx, sources); err != nil {
+			return err
+		}
+
+		aliases := target.Aliases
+		for _, source := range sources {
+			aliases = append(append(aliases, source.Name), source.Aliases...)
+		}
+		aliases = normalizeAliases(target.Name, aliases)
+
+		if err := tx.Table(consts.CounterpartyAliasTable).Where("counterparty_id IN ?", sourceIDs).Delete(&models.CounterpartyAlias{}).Error; err != nil {
+			return err
+		}
+		if err := setCounterpartyAliases(tx, target, aliases); err != nil {
+			return err
+		}
+		result := tx.Table(consts.BillTable).Unscoped().Where("counterparty_id IN ?", sourceIDs).
+			Updates(map[string]interface{}{"counterparty_id": target.ID, "object": target.Name})
+		if result.Error != nil {
+			return result.Error
+		}
+		merged = int(result.RowsAffected)
+		for _, table := range []string{consts.RecurringBillTable, consts.LoanTable} {
+			if err := tx.Table(table).Unscoped().Where("counterparty_id IN ?", sourceIDs).
+				Updates(map[string]interface{}{"counterparty_id": target.ID, "object": target.Name}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Table(consts.CounterpartyTable).Unscoped().Where("id IN ?", sourceIDs).Delete(&models.Counterparty{}).Error
+	})
+	if err != nil {
+		counterpartyErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Merge Counterparties Successfully",
+		"data":    target,
+		"bills":   merged,
+	})
+}
+
+// DeleteCounterparty only deletes counterparties no bill, recurring bill or loan ever used, merge the others
+func DeleteCounterparty(c *gin.Context) {
+	counterparty := findCounterparty(c)
+	if c.IsAborted() {
+		return
+	}
+
+	for _, table := range counterpartyTables {
+		var used int64
+		if err := db.DB.Table(table).Unscoped().Where("counterparty_id = ?", counterparty.ID).Count(&used).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to query database: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		if used > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40004,
+				"message": "counterparty is used by bills or loans, merge it into another one instead",
+			})
+			c.Abort()
+			return
+		}
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.CounterpartyAliasTable).Where("counterparty_id = ?", counterparty.ID).Delete(&models.CounterpartyAlias{}).Error; err != nil {
+			return err
+		}
+		return tx.Table(consts.CounterpartyTable).Unscoped().Where("id = ?", counterparty.ID).Delete(&models.Counterparty{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete counterparty: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "counterparty deleted successfully",
+	})
+}
+
+// CounterpartyTotal is what the bills of one counterparty add up to, in 分 of the base currency
+type CounterpartyTotal struct {
+	CounterpartyID uint      `json:"counterparty_id"`
+	Name           string    `json:"name"`
+	Kind           string    `json:"kind"`
+	Count          int64     `json:"count"`
+	Income         int64     `json:"income"`
+	Expense        int64     `json:"expense"`
+	Net            int64     `json:"net"`
+	Unconverted    int64     `json:"unconverted"` // bills left out of the sums, their currency has no exchange rate
+	LastDate       time.Time `json:"last_date"`
+}
+
+// CounterpartyTotals sums the bills per counterparty, largest first, with the filters of SelectBills
+func CounterpartyTotals(c *gin.Context) {
+	query, err := applyBillFilters(c, billQuery(c.GetUint("family_id")))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "invalid CounterpartyTotals filter: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	totals := []CounterpartyTotal{}
+	if err := query.
+		Joins("LEFT JOIN " + consts.CounterpartyTable + " ON counterparty.id = bill.counterparty_id").
+		Select("bill.counterparty_id, COALESCE(MAX(counterparty.name), MAX(bill.object)) AS name, " +
+			"COALESCE(MAX(counterparty.kind), '') AS kind, MAX(bill.date) AS last_date, " + billSumsSQL).
+		Group("bill.counterparty_id").
+		Order("COALESCE(SUM(bill.base_amount), 0) DESC, COUNT(*) DESC, bill.counterparty_id").
+		Scan(&totals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to sum bills: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	for i := range totals {
+		totals[i].Net = totals[i].Income - totals[i].Expense
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":         20000,
+		"message":       "Counterparty Totals Successfully",
+		"data":          totals,
+		"base_currency": baseCurrency(c),
+	})
+}
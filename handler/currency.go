@@ -0,0 +1,313 @@
+package handler
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errRateOfBaseCurrency = errors.New("currency and base_currency must differ")
+
+// ListExchangeRates lists the rates to the base currency, newest first,
+// ?currency= for one currency, ?base_currency= for rates to another base
+func ListExchangeRates(c *gin.Context) {
+	query := db.DB.Table(consts.ExchangeRateTable).
+		Where("family_id = ? AND base_currency = ?", c.GetUint("family_id"), c.DefaultQuery("base_currency", baseCurrency(c)))
+	if currency := c.Query("currency"); currency != "" {
+		query = query.Where("currency = ?", strings.ToUpper(currency))
+	}
+
+	rates := []models.ExchangeRate{}
+	if err := query.Order("currency, date DESC").Find(&rates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list exchange rates: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Exchange Rates Successfully",
+		"data":    rates,
+	})
+}
+
+// setExchangeRateRequest is also used for the rows of ImportExchangeRates
+type setExchangeRateRequest struct {
+	Currency     string  `json:"currency" binding:"required,iso4217"`
+	BaseCurrency string  `json:"base_currency" binding:"omitempty,iso4217"` // defaults to the base currency
+	Date         string  `json:"date" binding:"required"`                   // the time of day is dropped
+	Rate         float64 `json:"rate" binding:"required,gt=0"`              // 1 currency = rate base_currency
+}
+
+// exchangeRate turns a checked request into a rate
+func (req *setExchangeRateRequest) exchangeRate(familyID uint, base string, userID uint) (*models.ExchangeRate, error) {
+	if req.BaseCurrency != "" {
+		base = req.BaseCurrency
+	}
+	if req.Currency == base {
+		return nil, errRateOfBaseCurrency
+	}
+
+	date, err := parseFilterDate(req.Date)
+	if err != nil {
+		return nil, errors.New("failed to parse date: " + err.Error())
+	}
+
+	rate := models.NewExchangeRate()
+	rate.FamilyID = familyID
+	rate.Currency = req.Currency
+	rate.BaseCurrency = base
+	rate.Date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	rate.Rate = req.Rate
+	rate.CreatedBy = userID
+	return rate, nil
+}
+
+// saveExchangeRates replaces the rates of the same day and converts the bills of the changed currencies again
+func saveExchangeRates(tx *gorm.DB, familyID uint, rates []models.ExchangeRate) error {
+	if len(rates) == 0 {
+		return nil
+	}
+
+	if err := tx.Table(consts.ExchangeRateTable).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "family_id"}, {Name: "currency"}, {Name: "base_currency"}, {Name: "date"}},
+		DoUpdates: clause.AssignmentColumns([]string{"rate", "created_by", "updated_at"}),
+	}).CreateInBatches(&rates, 500).Error; err != nil {
+		return err
+	}
+
+	currencies := map[string]bool{}
+	for _, rate := range rates {
+		currencies[rate.Currency] = true
+	}
+	for currency := range currencies {
+		if err := db.ConvertBills(tx, familyID, currency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetExchangeRate adds the rate of a day or replaces it
+func SetExchangeRate(c *gin.Context) {
+	var req setExchangeRateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind SetExchangeRate Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	familyID := c.GetUint("family_id")
+	rate, err := req.exchangeRate(familyID, baseCurrency(c), c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	rates := []models.ExchangeRate{*rate}
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		return saveExchangeRates(tx, familyID, rates)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save exchange rate: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Set Exchange Rate Successfully",
+		"data":    rates[0],
+	})
+}
+
+// ImportExchangeRates reads a CSV file in the multipart field "file" with the columns
+// date,currency,rate and an optional base_currency, a header row is skipped.
+// Nothing is saved when a row is invalid, every invalid row is reported.
+func ImportExchangeRates(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, consts.MaxExchangeRateImportSize+consts.MB)
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to read file, it must be in field \"file\" and at most 1MB: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50001,
+			"message": "failed to open file: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	defer file.Close()
+
+	familyID := c.GetUint("family_id")
+	base := baseCurrency(c)
+	userID := c.GetUint("user_id")
+
+	reader := csv.NewReader(io.LimitReader(file, consts.MaxExchangeRateImportSize))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	// a later row of the same day wins, as it would when set one by one
+	rates := map[string]models.ExchangeRate{}
+	var rowErrors []string
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, err.Error())
+			break
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "date") {
+			continue
+		}
+		if line > consts.MaxExchangeRateImportRows {
+			rowErrors = append(rowErrors, "more than "+strconv.Itoa(consts.MaxExchangeRateImportRows)+" rows")
+			break
+		}
+
+		rate, err := parseExchangeRateRecord(record, familyID, base, userID)
+		if err != nil {
+			rowErrors = append(rowErrors, fmt.Sprintf("line %d: %s", line, err))
+			continue
+		}
+		rates[rate.Currency+"/"+rate.BaseCurrency+"/"+rate.Date.Format(time.DateOnly)] = *rate
+	}
+	if len(rowErrors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid rows, nothing imported",
+			"errors":  rowErrors,
+		})
+		c.Abort()
+		return
+	}
+
+	keys := make([]string, 0, len(rates))
+	for key := range rates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := make([]models.ExchangeRate, 0, len(rates))
+	for _, key := range keys {
+		list = append(list, rates[key])
+	}
+
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		return saveExchangeRates(tx, familyID, list)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save exchange rates: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":    20000,
+		"message":  "Import Exchange Rates Successfully",
+		"imported": len(list),
+	})
+}
+
+func parseExchangeRateRecord(record []string, familyID uint, base string, userID uint) (*models.ExchangeRate, error) {
+	if len(record) < 3 || len(record) > 4 {
+		return nil, errors.New("expected date,currency,rate[,base_currency]")
+	}
+
+	req := setExchangeRateRequest{
+		Date:     strings.TrimSpace(record[0]),
+		Currency: strings.ToUpper(strings.TrimSpace(record[1])),
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+	if err != nil {
+		return nil, errors.New("invalid rate: " + err.Error())
+	}
+	req.Rate = rate
+	if len(record) == 4 {
+		req.BaseCurrency = strings.ToUpper(strings.TrimSpace(record[3]))
+	}
+
+	if err := binding.Validator.ValidateStruct(&req); err != nil {
+		return nil, err
+	}
+	return req.exchangeRate(familyID, base, userID)
+}
+
+// DeleteExchangeRate converts the bills of the currency again without the rate
+func DeleteExchangeRate(c *gin.Context) {
+	rateID, err := strconv.ParseUint(c.Param("rate_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid rate_id: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	familyID := c.GetUint("family_id")
+	rate := models.NewExchangeRate()
+	if err := db.DB.Table(consts.ExchangeRateTable).Where("id = ? AND family_id = ?", uint(rateID), familyID).First(rate).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "exchange rate not found: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.ExchangeRateTable).Where("id = ?", rate.ID).Delete(&models.ExchangeRate{}).Error; err != nil {
+			return err
+		}
+		return db.ConvertBills(tx, familyID, rate.Currency)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete exchange rate: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "exchange rate deleted successfully",
+	})
+}
@@ -7,14 +7,24 @@ import (
 	"github.com/hewo233/hdu-dx2/models"
 	"github.com/hewo233/hdu-dx2/shared/consts"
 	"github.com/hewo233/hdu-dx2/utils/jwt"
+	"github.com/hewo233/hdu-dx2/utils/password"
 	"gorm.io/gorm"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type createFamilyRequest struct {
 	Name     string `json:"name" binding:"required"`
-	Password string `json:"password" binding:"required"`
+	Password string `json:"password"` // optional, members can always join by invitation code
+	Role     string `json:"role"`     // creator's role in family, e.g. father
+
+	BaseCurrency string `json:"base_currency" binding:"omitempty,iso4217"` // defaults to CNY
+}
+
+// currentFamilyUser returns the membership set by middleware.FamilyAuth
+func currentFamilyUser(c *gin.Context) *models.FamilyUser {
+	return c.MustGet("family_user").(*models.FamilyUser)
 }
 
 func CreateFamily(c *gin.Context) {
@@ -28,7 +38,7 @@ func CreateFamily(c *gin.Context) {
 		return
 	}
 
-	_, _, err := jwt.GetPhoneFromJWT(c)
+	_, user, err := jwt.GetPhoneFromJWT(c)
 	if err != nil {
 		if err.Error() == "user not found" {
 			c.JSON(http.StatusUnauthorized, gin.H{
@@ -47,9 +57,38 @@ func CreateFamily(c *gin.Context) {
 
 	family := models.NewFamily()
 	family.Name = req.Name
-	family.Password = req.Password
+	family.BaseCurrency = consts.DefaultCurrency
+	if req.BaseCurrency != "" {
+		family.BaseCurrency = req.BaseCurrency
+	}
+	if req.Password != "" {
+		family.Password, err = password.HashPassword(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50001,
+				"message": "failed to hash password: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+	}
 
-	if err := db.DB.Table(consts.FamilyTable).Create(family).Error; err != nil {
+	// creator is the owner of the family
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.FamilyTable).Create(family).Error; err != nil {
+			return err
+		}
+		if err := tx.Table(consts.FamilyUserTable).Create(map[string]interface{}{
+			"user_id":    user.ID,
+			"family_id":  family.ID,
+			"role":       req.Role,
+			"permission": consts.FamilyOwner,
+		}).Error; err != nil {
+			return err
+		}
+		return db.SeedCategories(tx, family.ID)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"errno":   50000,
 			"message": "failed to create family: " + err.Error(),
@@ -67,7 +106,6 @@ func CreateFamily(c *gin.Context) {
 
 type addUserToFamilyRequest struct {
 	FamilyID uint   `json:"family_id" binding:"required"`
-	UserID   uint   `json:"user_id" binding:"required"`
 	Role     string `json:"role" binding:"required"`
 	Password string `json:"password" binding:"required"`
 }
@@ -83,7 +121,7 @@ func AddUserToFamily(c *gin.Context) {
 		return
 	}
 
-	_, _, err := jwt.GetPhoneFromJWT(c)
+	_, user, err := jwt.GetPhoneFromJWT(c)
 	if err != nil {
 		if err.Error() == "user not found" {
 			c.JSON(http.StatusUnauthorized, gin.H{
@@ -120,46 +158,35 @@ func AddUserToFamily(c *gin.Context) {
 		return
 	}
 
-	if findFamily.Password != req.Password {
+	if findFamily.ArchivedAt != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"errno":   40007,
-			"message": "family password is incorrect",
+			"errno":   40009,
+			"message": "this family is archived",
 		})
 		c.Abort()
 		return
 	}
 
-	findUser := models.NewUser()
-
-	// check user exists
-	if err := db.DB.Table(consts.UserTable).Where("id = ?", req.UserID).First(findUser).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"errno":   40005,
-				"message": "this user does not exist",
-			})
-			c.Abort()
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errno":   50000,
-			"message": "failed to query database: " + err.Error(),
+	if findFamily.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40009,
+			"message": "this family can only be joined by invitation code",
 		})
 		c.Abort()
 		return
 	}
 
-	if findUser.ID != req.UserID {
+	if err := password.CheckHashed(req.Password, findFamily.Password); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"errno":   40010,
-			"message": "user cannot modify other user's family",
+			"errno":   40007,
+			"message": "family password is incorrect",
 		})
 		c.Abort()
 		return
 	}
 
 	// check if user already in family
-	result := db.DB.Table(consts.FamilyUserTable).Where("user_id = ? AND family_id = ?", req.UserID, req.FamilyID).Limit(1).Find(&models.FamilyUser{})
+	result := db.DB.Table(consts.FamilyUserTable).Where("user_id = ? AND family_id = ?", user.ID, req.FamilyID).Limit(1).Find(&models.FamilyUser{})
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"errno":   50000,
@@ -177,12 +204,18 @@ func AddUserToFamily(c *gin.Context) {
 		return
 	}
 
+	if findFamily.RequireApproval {
+		createJoinRequest(c, findFamily.ID, user.ID, req.Role)
+		return
+	}
+
 	// add user to family
 
 	familyUser := map[string]interface{}{
-		"user_id":   req.UserID,
-		"family_id": req.FamilyID,
-		"role":      req.Role,
+		"user_id":    user.ID,
+		"family_id":  req.FamilyID,
+		"role":       req.Role,
+		"permission": consts.FamilyMember,
 	}
 
 	if err := db.DB.Table(consts.FamilyUserTable).Create(familyUser).Error; err != nil {
@@ -201,18 +234,38 @@ func AddUserToFamily(c *gin.Context) {
 }
 
 func ListFamilyMember(c *gin.Context) {
-	familyIDStr := c.Param("family_id")
-	familyID, err := strconv.ParseUint(familyIDStr, 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errno":   40000,
-			"message": "invalid family_id: " + err.Error(),
+	familyID := c.GetUint("family_id")
+
+	type FamilyMember struct {
+		UserID     uint   `json:"user_id"`
+		Username   string `json:"username"`
+		Role       string `json:"role"`
+		Permission string `json:"permission"`
+	}
+
+	var members []FamilyMember
+
+	if err := db.DB.Table(consts.FamilyUserTable).Where("family_id = ? AND family_user.deleted_at IS NULL", familyID).
+		Select("family_user.user_id, \"user\".username, family_user.role, family_user.permission").
+		Joins("LEFT JOIN \"user\" ON family_user.user_id = \"user\".id").
+		Scan(&members).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + err.Error(),
 		})
 		c.Abort()
 		return
 	}
 
-	// only family member can list family members
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "success",
+		"members": members,
+	})
+}
+
+// ListMyFamilies lists the families the current user is a member of, admins list all of them under /admin/families
+func ListMyFamilies(c *gin.Context) {
 	_, user, err := jwt.GetPhoneFromJWT(c)
 	if err != nil {
 		if err.Error() == "user not found" {
@@ -230,60 +283,163 @@ func ListFamilyMember(c *gin.Context) {
 		return
 	}
 
-	// check if user is in family
-	result := db.DB.Table(consts.FamilyUserTable).Where("user_id = ? AND family_id = ?", user.ID, familyID).Limit(1).Find(&models.FamilyUser{})
-	if result.Error != nil {
+	families := []models.Family{}
+	if err := db.DB.Table(consts.FamilyTable).
+		Where("id IN (SELECT family_id FROM "+consts.FamilyUserTable+" WHERE user_id = ? AND deleted_at IS NULL)", user.ID).
+		Order("id").Find(&families).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"errno":   50000,
-			"message": "failed to query database: " + result.Error.Error(),
+			"message": "failed to query database: " + err.Error(),
 		})
 		c.Abort()
 		return
 	}
-	if result.RowsAffected == 0 {
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":    20000,
+		"message":  "success",
+		"families": families,
+	})
+
+}
+
+type updateFamilyMemberRequest struct {
+	UserID     uint   `json:"user_id" binding:"required"`
+	Role       string `json:"role"`
+	Permission string `json:"permission" binding:"omitempty,oneof=manager member viewer"`
+}
+
+// UpdateFamilyMember changes the role label or the permission of a member.
+// Everyone can relabel themselves; managing others needs a higher permission than
+// both the target's current and new permission, the owner can manage everyone.
+// Ownership itself is not granted here.
+func UpdateFamilyMember(c *gin.Context) {
+	var req updateFamilyMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"errno":   40008,
-			"message": "user is not in the family",
+			"errno":   40000,
+			"message": "failed to bind UpdateFamilyMember Request: " + err.Error(),
 		})
 		c.Abort()
 		return
 	}
 
-	findFamily := models.NewFamily()
+	familyID := c.GetUint("family_id")
+	self := currentFamilyUser(c)
 
-	// check family exists
-	if err := db.DB.Table(consts.FamilyTable).Where("id = ?", uint(familyID)).First(findFamily).Error; err != nil {
+	target := &models.FamilyUser{}
+	if err := db.DB.Table(consts.FamilyUserTable).Where("user_id = ? AND family_id = ?", req.UserID, familyID).First(target).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			c.JSON(http.StatusBadRequest, gin.H{
-				"errno":   40004,
-				"message": "this family does not exist",
+				"errno":   40008,
+				"message": "user is not in the family",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to query database: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	selfLevel := models.PermissionLevel(self.Permission)
+	isSelf := target.UserID == self.UserID
+	isOwner := self.Permission == consts.FamilyOwner
+
+	if req.Role != "" && !isSelf && !isOwner && selfLevel <= models.PermissionLevel(target.Permission) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, cannot modify this member",
+		})
+		c.Abort()
+		return
+	}
+
+	if req.Permission != "" {
+		if isSelf {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40011,
+				"message": "cannot change your own permission",
+			})
+			c.Abort()
+			return
+		}
+		if !isOwner && (selfLevel <= models.PermissionLevel(target.Permission) || selfLevel <= models.PermissionLevel(req.Permission)) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"errno":   40301,
+				"message": "permission denied, cannot grant this permission",
 			})
 			c.Abort()
 			return
 		}
+	}
+
+	updates := map[string]interface{}{}
+	if req.Role != "" {
+		updates["role"] = req.Role
+	}
+	if req.Permission != "" {
+		updates["permission"] = req.Permission
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40012,
+			"message": "nothing to update",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := db.DB.Table(consts.FamilyUserTable).Where("user_id = ? AND family_id = ?", target.UserID, familyID).Updates(updates).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"errno":   50000,
-			"message": "failed to query database: " + err.Error(),
+			"message": "failed to update family member: " + err.Error(),
 		})
 		c.Abort()
 		return
 	}
 
-	type FamilyMember struct {
-		UserID   uint   `json:"user_id"`
-		Username string `json:"username"`
-		Role     string `json:"role"`
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "family member updated successfully",
+	})
+}
+
+type setFamilyPasswordRequest struct {
+	Password string `json:"password"` // empty disables joining by password
+}
+
+func SetFamilyPassword(c *gin.Context) {
+	var req setFamilyPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind SetFamilyPassword Request: " + err.Error(),
+		})
+		c.Abort()
+		return
 	}
 
-	var members []FamilyMember
+	hashedPassword := ""
+	if req.Password != "" {
+		var err error
+		hashedPassword, err = password.HashPassword(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50001,
+				"message": "failed to hash password: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+	}
 
-	if err := db.DB.Table(consts.FamilyUserTable).Where("family_id = ?", uint(familyID)).
-		Select("family_user.user_id, \"user\".username, family_user.role").
-		Joins("LEFT JOIN \"user\" ON family_user.user_id = \"user\".id").
-		Scan(&members).Error; err != nil {
+	if err := db.DB.Table(consts.FamilyTable).Where("id = ?", c.GetUint("family_id")).Update("password", hashedPassword).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"errno":   50000,
-			"message": "failed to query database: " + err.Error(),
+			"message": "failed to update family password: " + err.Error(),
 		})
 		c.Abort()
 		return
@@ -291,43 +447,321 @@ func ListFamilyMember(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"errno":   20000,
-		"message": "success",
-		"members": members,
+		"message": "family password updated successfully",
 	})
 }
 
-func ListAllFamilies(c *gin.Context) {
-	_, _, err := jwt.GetPhoneFromJWT(c)
+// removeMembership hard deletes the membership so the user can join again later.
+// Bills the member created stay in the family ledger, created_by still points to them.
+func removeMembership(tx *gorm.DB, familyID uint, userID uint) error {
+	return tx.Table(consts.FamilyUserTable).Unscoped().
+		Where("user_id = ? AND family_id = ?", userID, familyID).
+		Delete(&models.FamilyUser{}).Error
+}
+
+func LeaveFamily(c *gin.Context) {
+	self := currentFamilyUser(c)
+
+	// there is exactly one owner, the family would be left without one
+	if self.Permission == consts.FamilyOwner {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40013,
+			"message": "owner must transfer ownership before leaving the family",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := removeMembership(db.DB, self.FamilyID, self.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to leave family: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "left family successfully",
+	})
+}
+
+func RemoveFamilyMember(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
 	if err != nil {
-		if err.Error() == "user not found" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"errno":   40101,
-				"message": "Unauthorized, user in jwt not found",
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid user_id: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	self := currentFamilyUser(c)
+
+	if uint(userID) == self.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40011,
+			"message": "use leave to quit the family yourself",
+		})
+		c.Abort()
+		return
+	}
+
+	target := &models.FamilyUser{}
+	if err := db.DB.Table(consts.FamilyUserTable).Where("user_id = ? AND family_id = ?", uint(userID), self.FamilyID).First(target).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40008,
+				"message": "user is not in the family",
 			})
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"errno":   50007,
-				"message": "failed to get user info: " + err.Error(),
+				"errno":   50000,
+				"message": "failed to query database: " + err.Error(),
 			})
 		}
 		c.Abort()
 		return
 	}
 
-	var families []models.Family
-	if err := db.DB.Table(consts.FamilyTable).Find(&families).Error; err != nil {
+	if models.PermissionLevel(self.Permission) <= models.PermissionLevel(target.Permission) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, cannot remove this member",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := removeMembership(db.DB, self.FamilyID, target.UserID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"errno":   50000,
-			"message": "failed to query database: " + err.Error(),
+			"message": "failed to remove family member: " + err.Error(),
 		})
 		c.Abort()
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"errno":    20000,
-		"message":  "success",
-		"families": families,
+		"errno":   20000,
+		"message": "family member removed successfully",
+	})
+}
+
+type transferOwnershipRequest struct {
+	UserID uint `json:"user_id" binding:"required"`
+}
+
+// TransferFamilyOwnership makes another member the owner, the old owner becomes a manager
+func TransferFamilyOwnership(c *gin.Context) {
+	var req transferOwnershipRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind TransferFamilyOwnership Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	self := currentFamilyUser(c)
+
+	if req.UserID == self.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40011,
+			"message": "you are already the owner",
+		})
+		c.Abort()
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Table(consts.FamilyUserTable).
+			Where("user_id = ? AND family_id = ?", req.UserID, self.FamilyID).
+			Update("permission", consts.FamilyOwner)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return tx.Table(consts.FamilyUserTable).
+			Where("user_id = ? AND family_id = ?", self.UserID, self.FamilyID).
+			Update("permission", consts.FamilyManager).Error
 	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40008,
+				"message": "user is not in the family",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to transfer ownership: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "ownership transferred successfully",
+	})
+}
 
+// ArchiveFamily makes the family read-only, members can still read bills
+func ArchiveFamily(c *gin.Context) {
+	family := c.MustGet("family").(*models.Family)
+	if family.ArchivedAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40014,
+			"message": "family is already archived",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := db.DB.Table(consts.FamilyTable).Where("id = ?", family.ID).Update("archived_at", time.Now()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to archive family: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "family archived successfully",
+	})
+}
+
+// RestoreFamily unarchives the family, or brings it back if it is deleted but not purged yet
+func RestoreFamily(c *gin.Context) {
+	family := c.MustGet("family").(*models.Family)
+	if family.ArchivedAt == nil && !family.DeletedAt.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40014,
+			"message": "family is neither archived nor deleted",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := db.DB.Table(consts.FamilyTable).Unscoped().Where("id = ?", family.ID).Updates(map[string]interface{}{
+		"archived_at": nil,
+		"deleted_at":  nil,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to restore family: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "family restored successfully",
+	})
+}
+
+// DeleteFamily hides the family at once, task purges it with all its data after consts.FamilyPurgeDelay
+func DeleteFamily(c *gin.Context) {
+	familyID := c.GetUint("family_id")
+
+	if err := db.DB.Table(consts.FamilyTable).Where("id = ?", familyID).Delete(&models.Family{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete family: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "family deleted, it can be restored before purge_at",
+		"purgeAt": time.Now().Add(consts.FamilyPurgeDelay),
+	})
+}
+
+type updateFamilySettingsRequest struct {
+	RequireApproval    *bool `json:"require_approval"`
+	TrashRetentionDays *int  `json:"trash_retention_days" binding:"omitnil,min=1,max=365"`
+
+	// bills are converted again with the rates to the new currency, settlements, budgets
+	// and savings goals are converted from the old one at the rate of today
+	BaseCurrency *string `json:"base_currency" binding:"omitnil,iso4217"`
+}
+
+func UpdateFamilySettings(c *gin.Context) {
+	var req updateFamilySettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateFamilySettings Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if req.RequireApproval != nil {
+		updates["require_approval"] = *req.RequireApproval
+	}
+	if req.TrashRetentionDays != nil {
+		updates["trash_retention_days"] = *req.TrashRetentionDays
+	}
+	if req.BaseCurrency != nil {
+		updates["base_currency"] = *req.BaseCurrency
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40012,
+			"message": "nothing to update",
+		})
+		c.Abort()
+		return
+	}
+
+	familyID := c.GetUint("family_id")
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.FamilyTable).Where("id = ?", familyID).Updates(updates).Error; err != nil {
+			return err
+		}
+		if req.BaseCurrency != nil {
+			if err := db.RebaseAmounts(tx, familyID, baseCurrency(c), *req.BaseCurrency, db.BillNow()); err != nil {
+				return err
+			}
+			return db.ConvertBills(tx, familyID, "")
+		}
+		return nil
+	})
+	if errors.Is(err, db.ErrNoBaseRate) {
+		c.JSON(http.StatusConflict, gin.H{
+			"errno":   40015,
+			"message": err.Error() + ", add the rate of " + *req.BaseCurrency + " in " + baseCurrency(c) + " first",
+		})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to update family settings: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "family settings updated successfully",
+	})
 }
@@ -1,56 +1,42 @@
 package handler
 
 import (
-	"fmt"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/hewo233/hdu-dx2/db"
 	"github.com/hewo233/hdu-dx2/models"
 	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 )
 
-func checkUserInFamily(c *gin.Context, familyID uint) {
-	phone := c.GetString("phone")
-	if phone == "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errno":   40000,
-			"message": "phone is required",
-		})
-		c.Abort()
-		return
-	}
-
-	var user models.User
-	if err := db.DB.Table("user").Where("phone = ?", phone).First(&user).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errno":   40001,
-			"message": "user not found: " + err.Error(),
-		})
-		c.Abort()
-		return
-	}
-
-	var familyUser models.FamilyUser
-	if err := db.DB.Table("family_user").Where("user_id = ? AND family_id = ?", user.ID, familyID).First(&familyUser).Error; err != nil {
-		c.JSON(http.StatusForbidden, gin.H{
-			"errno":   40300,
-			"message": "user not in family: " + err.Error(),
-		})
-		c.Abort()
-		return
+// canModifyBill: managers can modify every bill, members only the bills they created
+func canModifyBill(c *gin.Context, bill *models.Bill) bool {
+	familyUser := currentFamilyUser(c)
+	if familyUser.Can(consts.FamilyManager) {
+		return true
 	}
+	return familyUser.Can(consts.FamilyMember) && bill.CreatedBy != 0 && bill.CreatedBy == familyUser.UserID
 }
 
 type createBillRequest struct {
-	Date        string `json:"date" binding:"required"`
-	Type        string `json:"type" binding:"required,oneof=income expense"`
-	Amount      int    `json:"amount" binding:"required,gt=0"`
-	Category    string `json:"category" binding:"required"`
-	Description string `json:"description"`
-	Object      string `json:"object" binding:"required"`
-	Username    string `json:"username" binding:"required"`
+	Date           string `json:"date" binding:"required"`
+	Type           string `json:"type" binding:"required,oneof=income expense"`
+	Amount         int    `json:"amount" binding:"required,gt=0"`
+	Currency       string `json:"currency" binding:"omitempty,iso4217"` // defaults to the currency of the account, then the base currency
+	CategoryID     uint   `json:"category_id" binding:"required_without=Category"`
+	Category       string `json:"category" binding:"required_without=CategoryID"` // name, for clients without category_id
+	Description    string `json:"description"`
+	CounterpartyID uint   `json:"counterparty_id" binding:"required_without=Object"`
+	Object         string `json:"object" binding:"required_without=CounterpartyID"` // name or alias, for clients without counterparty_id
+	Username       string `json:"username" binding:"required"`
+	TagIDs         []uint `json:"tag_ids"`
+	AccountID      uint   `json:"account_id"`
+
+	Split *billSplitRequest `json:"split"`
 }
 
 func CreateBill(c *gin.Context) {
@@ -64,21 +50,7 @@ func CreateBill(c *gin.Context) {
 		return
 	}
 
-	familyIDStr := c.Param("family_id")
-	familyID, err := strconv.ParseUint(familyIDStr, 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errno":   40002,
-			"message": "invalid family_id: " + err.Error(),
-		})
-		c.Abort()
-		return
-	}
-
-	checkUserInFamily(c, uint(familyID))
-	if c.IsAborted() {
-		return
-	}
+	familyID := c.GetUint("family_id")
 
 	timeDate, err := time.Parse(consts.TimeFormat, req.Date)
 	if err != nil {
@@ -94,175 +66,368 @@ func CreateBill(c *gin.Context) {
 		Date:        timeDate,
 		Type:        req.Type,
 		Amount:      req.Amount,
-		Category:    req.Category,
+		Currency:    req.Currency,
 		Description: req.Description,
-		Object:      req.Object,
 		Username:    req.Username,
-		FamilyID:    uint(familyID),
+		AccountID:   req.AccountID,
+		FamilyID:    familyID,
+		CreatedBy:   c.GetUint("user_id"),
 	}
 
-	if err := db.DB.Table(consts.BillTable).Create(bill).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errno":   50000,
-			"message": "failed to create bill: " + err.Error(),
-		})
-		c.Abort()
-		return
-	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		category, err := resolveBillCategory(tx, familyID, bill.Type, req.CategoryID, req.Category)
+		if err != nil {
+			return err
+		}
+		bill.CategoryID = category.ID
+		bill.Category = category.Name
 
-	c.JSON(http.StatusOK, gin.H{
-		"errno":   20000,
-		"message": "Create Bill Successfully",
-		"data":    bill,
-	})
-}
+		counterparty, err := resolveBillCounterparty(tx, familyID, req.CounterpartyID, req.Object)
+		if err != nil {
+			return err
+		}
+		bill.CounterpartyID = counterparty.ID
+		bill.Object = counterparty.Name
 
-func ListBills(c *gin.Context) {
+		tagIDs, err := checkTagIDs(tx, familyID, req.TagIDs)
+		if err != nil {
+			return err
+		}
+		if bill.Currency == "" {
+			bill.Currency = baseCurrency(c)
+			if bill.AccountID != 0 {
+				account, err := usableAccount(tx, familyID, bill.AccountID)
+				if err != nil {
+					return err
+				}
+				bill.Currency = account.Currency
+			}
+		}
+		if err := checkBillAccount(tx, bill); err != nil {
+			return err
+		}
 
-	familyIDStr := c.Param("family_id")
-	familyID, err := strconv.ParseUint(familyIDStr, 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errno":   40000,
-			"message": "invalid family_id: " + err.Error(),
-		})
-		c.Abort()
-		return
-	}
+		splits := []models.BillSplit{}
+		if req.Split != nil {
+			splits, err = applyBillSplit(tx, bill, req.Split, bill.CreatedBy)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Table(consts.BillTable).Create(bill).Error; err != nil {
+			return err
+		}
+		if err := db.ConvertBill(tx, bill); err != nil {
+			return err
+		}
+		if err := setBillTags(tx, bill.ID, tagIDs); err != nil {
+			return err
+		}
+		if err := setBillSplits(tx, bill, splits); err != nil {
+			return err
+		}
 
-	checkUserInFamily(c, uint(familyID))
-	if c.IsAborted() {
+		changes := models.DiffBill(&models.Bill{}, bill)
+		if len(tagIDs) > 0 {
+			changes = append(changes, models.BillFieldChange{Field: "tag_ids", Old: []uint{}, New: tagIDs})
+		}
+		if len(splits) > 0 {
+			changes = append(changes, models.BillFieldChange{Field: "splits", Old: []splitShare{}, New: splitShares(splits)})
+		}
+		if err := db.RecordBillRevision(tx, bill, consts.BillActionCreate, bill.CreatedBy, changes); err != nil {
+			return err
+		}
+
+		bills := []models.Bill{*bill}
+		if err := loadBillTags(tx, bills); err != nil {
+			return err
+		}
+		if err := loadBillSplits(tx, bills); err != nil {
+			return err
+		}
+		bill.Tags, bill.Splits = bills[0].Tags, bills[0].Splits
+		return nil
+	})
+	if err != nil {
+		billSaveErrorResponse(c, err, "failed to create bill: ")
 		return
 	}
 
-	var bills []models.Bill
-	if err := db.DB.Table(consts.BillTable).Where("family_id=?", uint(familyID)).Find(&bills).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errno":   50000,
-			"message": "failed to list bills: " + err.Error(),
-		})
-		c.Abort()
-		return
+	// the bill is saved already, a failure here only loses the warnings
+	warnings, err := budgetWarnings(db.DB, bill)
+	if err != nil {
+		log.Println("failed to check budgets of bill", bill.ID, err)
+		warnings = []BudgetStatus{}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"errno":   20000,
-		"message": "List Bills Successfully",
-		"data":    bills,
+		"errno":           20000,
+		"message":         "Create Bill Successfully",
+		"data":            bill,
+		"budget_warnings": warnings,
 	})
 }
 
-type SelectBillsRequest struct {
-	Type      string `json:"type" binding:"omitempty,oneof=income expense"`
-	Category  string `json:"category" binding:"omitempty"`
-	Object    string `json:"object" binding:"omitempty"`
-	Username  string `json:"username" binding:"omitempty"`
-	StartDate string `json:"start_date" binding:"omitempty"`
-	EndDate   string `json:"end_date" binding:"omitempty"`
+var errNothingToUpdate = errors.New("nothing to update")
+
+// updateBillRequest has the same rules as createBillRequest, nil fields are kept
+type updateBillRequest struct {
+	Date           *string `json:"date" binding:"omitnil,min=1"`
+	Type           *string `json:"type" binding:"omitnil,oneof=income expense"`
+	Amount         *int    `json:"amount" binding:"omitnil,gt=0"`
+	Currency       *string `json:"currency" binding:"omitnil,iso4217"`
+	CategoryID     *uint   `json:"category_id" binding:"omitnil,gt=0"`
+	Category       *string `json:"category" binding:"omitnil,min=1"`
+	Description    *string `json:"description"`
+	CounterpartyID *uint   `json:"counterparty_id" binding:"omitnil,gt=0"`
+	Object         *string `json:"object" binding:"omitnil,min=1"`
+	Username       *string `json:"username" binding:"omitnil,min=1"`
+	TagIDs         *[]uint `json:"tag_ids"`    // replaces all tags, [] removes them
+	AccountID      *uint   `json:"account_id"` // 0 unlinks the account
+
+	// replaces the split, a split kept while amount changes is recomputed
+	Split *billSplitRequest `json:"split"`
 }
 
-func SelectBills(c *gin.Context) {
-	var req SelectBillsRequest
+func UpdateBill(c *gin.Context) {
+	var req updateBillRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"errno":   40000,
-			"message": "failed to bind SelectBills Request: " + err.Error(),
+			"message": "failed to bind UpdateBill Request: " + err.Error(),
 		})
 		c.Abort()
 		return
 	}
 
-	fmt.Printf("Query conditions: %+v\n", req)
-	fmt.Println(req)
+	familyID := c.GetUint("family_id")
 
-	familyIDStr := c.Param("family_id")
-	familyID, err := strconv.ParseUint(familyIDStr, 10, 32)
+	billID, err := strconv.ParseUint(c.Param("bill_id"), 10, 32)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"errno":   40001,
-			"message": "invalid family_id: " + err.Error(),
+			"message": "invalid bill_id: " + err.Error(),
 		})
 		c.Abort()
 		return
 	}
 
-	checkUserInFamily(c, uint(familyID))
-	if c.IsAborted() {
+	var old models.Bill
+	if err := db.DB.Table(consts.BillTable).Where("id = ? AND family_id = ?", uint(billID), familyID).First(&old).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "bill not found: " + err.Error(),
+		})
+		c.Abort()
 		return
 	}
 
-	query := db.DB.Table(consts.BillTable)
-
-	query = query.Where("family_id = ?", uint(familyID))
-
-	if req.Type != "" {
-		query = query.Where("type = ?", req.Type)
-	}
-	if req.Category != "" {
-		query = query.Where("category = ?", req.Category)
-	}
-	if req.Object != "" {
-		query = query.Where("object = ?", req.Object)
-	}
-	if req.Username != "" {
-		query = query.Where("username = ?", req.Username)
+	if !canModifyBill(c, &old) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can modify bills created by others",
+		})
+		c.Abort()
+		return
 	}
-	if req.StartDate != "" {
-		startDate, err := time.Parse(consts.TimeFormat, req.StartDate)
-		fmt.Println("Parsed start date:", startDate)
+
+	bill := old
+	if req.Date != nil {
+		bill.Date, err = time.Parse(consts.TimeFormat, *req.Date)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
-				"errno":   40001,
-				"message": "failed to parse start_date: " + err.Error(),
+				"errno":   40003,
+				"message": "failed to parse date: " + err.Error(),
 			})
 			c.Abort()
 			return
 		}
-		query = query.Where("date >= ?", startDate)
 	}
-	if req.EndDate != "" {
-		endDate, err := time.Parse(consts.TimeFormat, req.EndDate)
+	if req.Type != nil {
+		bill.Type = *req.Type
+	}
+	if req.Amount != nil {
+		bill.Amount = *req.Amount
+	}
+	if req.Currency != nil {
+		bill.Currency = *req.Currency
+	}
+	if req.Description != nil {
+		bill.Description = *req.Description
+	}
+	if req.Username != nil {
+		bill.Username = *req.Username
+	}
+	if req.AccountID != nil {
+		bill.AccountID = *req.AccountID
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// a new type must be checked against the category too
+		if req.CategoryID != nil || req.Category != nil || bill.Type != old.Type {
+			categoryID, name := bill.CategoryID, bill.Category
+			if req.CategoryID != nil {
+				categoryID, name = *req.CategoryID, ""
+			} else if req.Category != nil {
+				categoryID, name = 0, *req.Category
+			}
+			category, err := resolveBillCategory(tx, familyID, bill.Type, categoryID, name)
+			if err != nil {
+				return err
+			}
+			bill.CategoryID = category.ID
+			bill.Category = category.Name
+		}
+
+		if req.CounterpartyID != nil || req.Object != nil {
+			var counterpartyID uint
+			var name string
+			if req.CounterpartyID != nil {
+				counterpartyID = *req.CounterpartyID
+			} else {
+				name = *req.Object
+			}
+			counterparty, err := resolveBillCounterparty(tx, familyID, counterpartyID, name)
+			if err != nil {
+				return err
+			}
+			bill.CounterpartyID = counterparty.ID
+			bill.Object = counterparty.Name
+		}
+
+		if bill.AccountID != old.AccountID || bill.Currency != old.Currency {
+			if err := checkBillAccount(tx, &bill); err != nil {
+				return err
+			}
+		}
+
+		oldSplits, err := billSplits(tx, bill.ID)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"errno":   40002,
-				"message": "failed to parse end_date: " + err.Error(),
-			})
-			c.Abort()
-			return
+			return err
+		}
+		splits := oldSplits
+		if req.Split != nil {
+			splits, err = applyBillSplit(tx, &bill, req.Split, c.GetUint("user_id"))
+		} else if bill.SplitMode != "" && (bill.Amount != old.Amount || bill.Type != old.Type) {
+			splits, err = resplitBill(&bill, oldSplits)
+		}
+		if err != nil {
+			return err
 		}
-		fmt.Println("Parsed end date:", endDate)
-		query = query.Where("date <= ?", endDate)
-	}
 
-	var bills []models.Bill
-	if err := query.Find(&bills).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errno":   50000,
-			"message": "failed to select bills: " + err.Error(),
+		changes := models.DiffBill(&old, &bill)
+
+		if !equalSplits(oldSplits, splits) {
+			if err := setBillSplits(tx, &bill, splits); err != nil {
+				return err
+			}
+			changes = append(changes, models.BillFieldChange{Field: "splits", Old: splitShares(oldSplits), New: splitShares(splits)})
+		}
+
+		if req.TagIDs != nil {
+			oldTagIDs, err := billTagIDs(tx, bill.ID)
+			if err != nil {
+				return err
+			}
+			tagIDs, err := checkTagIDs(tx, familyID, *req.TagIDs)
+			if err != nil {
+				return err
+			}
+			if !equalIDs(oldTagIDs, tagIDs) {
+				if err := setBillTags(tx, bill.ID, tagIDs); err != nil {
+					return err
+				}
+				changes = append(changes, models.BillFieldChange{Field: "tag_ids", Old: oldTagIDs, New: tagIDs})
+			}
+		}
+
+		if len(changes) == 0 {
+			return errNothingToUpdate
+		}
+
+		if err := tx.Table(consts.BillTable).Save(&bill).Error; err != nil {
+			return err
+		}
+		if err := db.ConvertBill(tx, &bill); err != nil {
+			return err
+		}
+		if err := db.RecordBillRevision(tx, &bill, consts.BillActionUpdate, c.GetUint("user_id"), changes); err != nil {
+			return err
+		}
+
+		bills := []models.Bill{bill}
+		if err := loadBillTags(tx, bills); err != nil {
+			return err
+		}
+		if err := loadBillSplits(tx, bills); err != nil {
+			return err
+		}
+		bill.Tags, bill.Splits = bills[0].Tags, bills[0].Splits
+		return nil
+	})
+	if errors.Is(err, errNothingToUpdate) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40004,
+			"message": errNothingToUpdate.Error(),
 		})
 		c.Abort()
 		return
 	}
+	if err != nil {
+		billSaveErrorResponse(c, err, "failed to update bill: ")
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"errno":   20000,
-		"message": "Select Bills Successfully",
-		"data":    bills,
+		"message": "Update Bill Successfully",
+		"data":    bill,
 	})
 }
 
-func DeleteBill(c *gin.Context) {
-	familyIDStr := c.Param("family_id")
-	familyID, err := strconv.ParseUint(familyIDStr, 10, 32)
+// billSaveErrorResponse reports category, tag, account and split errors as 400, prefix is for other errors
+func billSaveErrorResponse(c *gin.Context, err error, prefix string) {
+	switch {
+	case errors.Is(err, errCategoryNotFound), errors.Is(err, errCategoryArchived), errors.Is(err, errCategoryTypeMismatch),
+		errors.Is(err, errTagNotFound), errors.Is(err, errCounterpartyNotFound), errors.Is(err, errAccountNotFound), errors.Is(err, errAccountArchived), errors.Is(err, errAccountCurrency),
+		errors.Is(err, errSplitInvalid), errors.Is(err, errSplitNotExpense), errors.Is(err, errSplitMember), errors.Is(err, errSplitAmountChanged):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40005,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": prefix + err.Error(),
+		})
+	}
+	c.Abort()
+}
+
+// ListBills pages through the bills of a family, see respondBillPage for the query parameters
+func ListBills(c *gin.Context) {
+	respondBillPage(c, billQuery(c.GetUint("family_id")), "List Bills Successfully")
+}
+
+// SelectBills is ListBills with the filters of applyBillFilters
+func SelectBills(c *gin.Context) {
+	query, err := applyBillFilters(c, billQuery(c.GetUint("family_id")))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"errno":   40000,
-			"message": "invalid family_id: " + err.Error(),
+			"message": "invalid SelectBills filter: " + err.Error(),
 		})
 		c.Abort()
 		return
 	}
 
+	respondBillPage(c, query, "Select Bills Successfully")
+}
+
+func DeleteBill(c *gin.Context) {
+	familyID := c.GetUint("family_id")
+
 	billIDStr := c.Param("bill_id")
 	billID, err := strconv.ParseUint(billIDStr, 10, 32)
 	if err != nil {
@@ -274,13 +439,8 @@ func DeleteBill(c *gin.Context) {
 		return
 	}
 
-	checkUserInFamily(c, uint(familyID))
-	if c.IsAborted() {
-		return
-	}
-
 	var bill models.Bill
-	if err := db.DB.Table("bill").Where("id = ? AND family_id = ?", uint(billID), uint(familyID)).First(&bill).Error; err != nil {
+	if err := db.DB.Table("bill").Where("id = ? AND family_id = ?", uint(billID), familyID).First(&bill).Error; err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"errno":   40002,
 			"message": "bill not found: " + err.Error(),
@@ -289,7 +449,22 @@ func DeleteBill(c *gin.Context) {
 		return
 	}
 
-	if err := db.DB.Table("bill").Where("id = ?", uint(billID)).Delete(&models.Bill{}).Error; err != nil {
+	if !canModifyBill(c, &bill) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can modify bills created by others",
+		})
+		c.Abort()
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table("bill").Where("id = ?", uint(billID)).Delete(&models.Bill{}).Error; err != nil {
+			return err
+		}
+		return db.RecordBillRevision(tx, &bill, consts.BillActionDelete, c.GetUint("user_id"), models.BillChanges{})
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"errno":   50000,
 			"message": "failed to delete bill: " + err.Error(),
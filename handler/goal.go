@@ -0,0 +1,621 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errGoalArchived        = errors.New("goal is archived")
+	errContributionSource  = errors.New("a contribution comes from a bill or a transfer, not both")
+	errContributionLinked  = errors.New("the bill or transfer is already a contribution to this goal")
+	errContributionAmount  = errors.New("amount is required, the bill or transfer has no exchange rate to the base currency")
+	errContributionMissing = errors.New("bill or transfer not found")
+)
+
+// GoalProgress is a goal with the amounts computed from its contributions, in 分 of the base currency
+type GoalProgress struct {
+	models.SavingsGoal
+	Saved           int64   `json:"saved"`
+	Remaining       int64   `json:"remaining"`
+	Percent         float64 `json:"percent"`
+	MonthsLeft      int     `json:"months_left"`      // until the target date, 0 without one or after it
+	RequiredMonthly int64   `json:"required_monthly"` // to save every month to reach the target in time
+	Status          string  `json:"status"`
+}
+
+// goalSaved sums the contributions of the goals, contributions of deleted bills or transfers are left out
+func goalSaved(tx *gorm.DB, goalIDs []uint) (map[uint]int64, error) {
+	saved := map[uint]int64{}
+	if len(goalIDs) == 0 {
+		return saved, nil
+	}
+
+	var rows []struct {
+		GoalID uint
+		Saved  int64
+	}
+	if err := tx.Table(consts.GoalContributionTable).
+		Select("goal_contribution.goal_id, SUM(goal_contribution.amount) AS saved").
+		Joins("LEFT JOIN bill ON bill.id = goal_contribution.bill_id").
+		Joins("LEFT JOIN transfer ON transfer.id = goal_contribution.transfer_id").
+		Where("goal_contribution.goal_id IN ?", goalIDs).
+		Where("(goal_contribution.bill_id = 0 OR bill.deleted_at IS NULL) AND (goal_contribution.transfer_id = 0 OR transfer.deleted_at IS NULL)").
+		Group("goal_contribution.goal_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		saved[row.GoalID] = row.Saved
+	}
+	return saved, nil
+}
+
+// goalProgress works out how far a goal is at now. A goal is on track when it saved at least
+// the part of the target that the time passed since its creation stands for.
+func goalProgress(goal models.SavingsGoal, saved int64, now time.Time) GoalProgress {
+	progress := GoalProgress{SavingsGoal: goal, Saved: saved}
+	target := int64(goal.TargetAmount)
+	progress.Remaining = max(0, target-saved)
+	progress.Percent = math.Round(float64(saved)*1000/float64(target)) / 10
+
+	if goal.TargetDate != nil && now.Before(*goal.TargetDate) {
+		days := goal.TargetDate.Sub(now).Hours() / 24
+		progress.MonthsLeft = max(1, int(math.Ceil(days/30.4375)))
+		progress.RequiredMonthly = (progress.Remaining + int64(progress.MonthsLeft) - 1) / int64(progress.MonthsLeft)
+	}
+
+	switch {
+	case saved >= target:
+		progress.Status = consts.GoalAchieved
+	case goal.TargetDate == nil:
+		progress.Status = consts.GoalNoDeadline
+	case !now.Before(*goal.TargetDate):
+		progress.Status = consts.GoalOverdue
+	default:
+		created := goal.CreatedAt.UTC()
+		total := goal.TargetDate.Sub(created)
+		expected := float64(target)
+		if total > 0 {
+			expected = float64(target) * float64(now.Sub(created)) / float64(total)
+		}
+		if float64(saved) >= expected {
+			progress.Status = consts.GoalOnTrack
+		} else {
+			progress.Status = consts.GoalBehind
+		}
+	}
+	return progress
+}
+
+// familyGoals returns the progress of the goals of a family
+func familyGoals(tx *gorm.DB, familyID uint, includeArchived bool) ([]GoalProgress, error) {
+	query := tx.Table(consts.SavingsGoalTable).Where("family_id = ?", familyID)
+	if !includeArchived {
+		query = query.Where("archived_at IS NULL")
+	}
+
+	var goals []models.SavingsGoal
+	if err := query.Order("target_date IS NULL, target_date, id").Find(&goals).Error; err != nil {
+		return nil, err
+	}
+
+	goalIDs := make([]uint, 0, len(goals))
+	for _, goal := range goals {
+		goalIDs = append(goalIDs, goal.ID)
+	}
+	saved, err := goalSaved(tx, goalIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	now := db.BillNow()
+	result := make([]GoalProgress, 0, len(goals))
+	for _, goal := range goals {
+		result = append(result, goalProgress(goal, saved[goal.ID], now))
+	}
+	return result, nil
+}
+
+// ListGoals returns the goals with their progress, ?include_archived=true for the archived ones too
+func ListGoals(c *gin.Context) {
+	goals, err := familyGoals(db.DB, c.GetUint("family_id"), c.Query("include_archived") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list goals: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":         20000,
+		"message":       "List Goals Successfully",
+		"data":          goals,
+		"base_currency": baseCurrency(c),
+	})
+}
+
+type FamilyGoalStatus struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	TargetDate *time.Time `json:"target_date"`
+	Percent    float64    `json:"percent"`
+	Status     string     `json:"status"`
+}
+
+// FamilyGoalStatuses is the short form of ListGoals every member of the family can see
+func FamilyGoalStatuses(c *gin.Context) {
+	goals, err := familyGoals(db.DB, c.GetUint("family_id"), false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list goals: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	statuses := make([]FamilyGoalStatus, 0, len(goals))
+	for _, goal := range goals {
+		statuses = append(statuses, FamilyGoalStatus{
+			ID:         goal.ID,
+			Name:       goal.Name,
+			TargetDate: goal.TargetDate,
+			Percent:    goal.Percent,
+			Status:     goal.Status,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Family Goal Statuses Successfully",
+		"data":    statuses,
+	})
+}
+
+type createGoalRequest struct {
+	Name         string `json:"name" binding:"required,max=100"`
+	TargetAmount int    `json:"target_amount" binding:"required,gt=0"`
+	TargetDate   string `json:"target_date"`
+	Note         string `json:"note" binding:"max=255"`
+}
+
+func CreateGoal(c *gin.Context) {
+	var req createGoalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateGoal Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	goal := models.NewSavingsGoal()
+	goal.FamilyID = c.GetUint("family_id")
+	goal.Name = strings.TrimSpace(req.Name)
+	goal.TargetAmount = req.TargetAmount
+	goal.Note = req.Note
+	goal.CreatedBy = c.GetUint("user_id")
+	if req.TargetDate != "" {
+		date, err := parseFilterDate(req.TargetDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse target_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		goal.TargetDate = &date
+	}
+
+	if err := db.DB.Table(consts.SavingsGoalTable).Create(goal).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save goal: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Create Goal Successfully",
+		"data":    goalProgress(*goal, 0, db.BillNow()),
+	})
+}
+
+// findGoal loads the goal of :goal_id in the family, aborts if not found
+func findGoal(c *gin.Context) *models.SavingsGoal {
+	goalID, err := strconv.ParseUint(c.Param("goal_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid goal_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	goal := models.NewSavingsGoal()
+	if err := db.DB.Table(consts.SavingsGoalTable).Where("id = ? AND family_id = ?", uint(goalID), c.GetUint("family_id")).First(goal).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "goal not found: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+	return goal
+}
+
+type updateGoalRequest struct {
+	Name         *string `json:"name" binding:"omitnil,min=1,max=100"`
+	TargetAmount *int    `json:"target_amount" binding:"omitnil,gt=0"`
+	TargetDate   *string `json:"target_date"` // "" removes the deadline
+	Note         *string `json:"note" binding:"omitnil,max=255"`
+}
+
+func UpdateGoal(c *gin.Context) {
+	var req updateGoalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateGoal Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	goal := findGoal(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if req.Name != nil {
+		goal.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.TargetAmount != nil {
+		goal.TargetAmount = *req.TargetAmount
+	}
+	if req.TargetDate != nil {
+		goal.TargetDate = nil
+		if *req.TargetDate != "" {
+			date, err := parseFilterDate(*req.TargetDate)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"errno":   40001,
+					"message": "failed to parse target_date: " + err.Error(),
+				})
+				c.Abort()
+				return
+			}
+			goal.TargetDate = &date
+		}
+	}
+	if req.Note != nil {
+		goal.Note = *req.Note
+	}
+
+	if err := db.DB.Table(consts.SavingsGoalTable).Save(goal).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save goal: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	saved, err := goalSaved(db.DB, []uint{goal.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to sum contributions: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Update Goal Successfully",
+		"data":    goalProgress(*goal, saved[goal.ID], db.BillNow()),
+	})
+}
+
+// ArchiveGoal keeps a finished or given up goal out of the lists
+func ArchiveGoal(c *gin.Context) {
+	setGoalArchived(c, true)
+}
+
+func UnarchiveGoal(c *gin.Context) {
+	setGoalArchived(c, false)
+}
+
+func setGoalArchived(c *gin.Context, archived bool) {
+	goal := findGoal(c)
+	if c.IsAborted() {
+		return
+	}
+
+	var archivedAt interface{}
+	message := "goal unarchived successfully"
+	if archived {
+		archivedAt, message = time.Now(), "goal archived successfully"
+	}
+	if err := db.DB.Table(consts.SavingsGoalTable).Where("id = ?", goal.ID).Update("archived_at", archivedAt).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to update goal: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": message,
+	})
+}
+
+// DeleteGoal deletes the goal and its contributions, the bills and transfers stay
+func DeleteGoal(c *gin.Context) {
+	goal := findGoal(c)
+	if c.IsAborted() {
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.GoalContributionTable).Where("goal_id = ?", goal.ID).Delete(&models.GoalContribution{}).Error; err != nil {
+			return err
+		}
+		return tx.Table(consts.SavingsGoalTable).Unscoped().Where("id = ?", goal.ID).Delete(&models.SavingsGoal{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete goal: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "goal deleted successfully",
+	})
+}
+
+func ListContributions(c *gin.Context) {
+	goal := findGoal(c)
+	if c.IsAborted() {
+		return
+	}
+
+	contributions := []models.GoalContribution{}
+	if err := db.DB.Table(consts.GoalContributionTable).Where("goal_id = ?", goal.ID).Order("date DESC, id DESC").Find(&contributions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list contributions: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Contributions Successfully",
+		"data":    contributions,
+	})
+}
+
+type addContributionRequest struct {
+	Amount     int    `json:"amount"` // negative to take money out, defaults to the amount of the bill or transfer
+	Date       string `json:"date"`   // defaults to the date of the bill or transfer, then to now
+	BillID     uint   `json:"bill_id"`
+	TransferID uint   `json:"transfer_id"`
+	Note       string `json:"note" binding:"max=255"`
+}
+
+// linkContribution takes the date and the default amount from the bill or transfer of a contribution
+func linkContribution(tx *gorm.DB, contribution *models.GoalContribution, base string) (date time.Time, amount *int64, err error) {
+	var count int64
+	if err := tx.Table(consts.GoalContributionTable).
+		Where("goal_id = ? AND ((bill_id <> 0 AND bill_id = ?) OR (transfer_id <> 0 AND transfer_id = ?))",
+			contribution.GoalID, contribution.BillID, contribution.TransferID).
+		Count(&count).Error; err != nil {
+		return date, nil, err
+	}
+	if count > 0 {
+		return date, nil, errContributionLinked
+	}
+
+	if contribution.BillID != 0 {
+		bill := models.NewBill()
+		if err := tx.Table(consts.BillTable).Where("id = ? AND family_id = ?", contribution.BillID, contribution.FamilyID).First(bill).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return date, nil, errContributionMissing
+			}
+			return date, nil, err
+		}
+		if bill.BaseAmount != nil {
+			value := int64(*bill.BaseAmount)
+			amount = &value
+		}
+		return bill.Date, amount, nil
+	}
+
+	transfer := models.NewTransfer()
+	if err := tx.Table(consts.TransferTable).Where("id = ? AND family_id = ?", contribution.TransferID, contribution.FamilyID).First(transfer).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return date, nil, errContributionMissing
+		}
+		return date, nil, err
+	}
+	account := models.NewAccount()
+	if err := tx.Table(consts.AccountTable).Where("id = ?", transfer.ToAccountID).First(account).Error; err != nil {
+		return date, nil, err
+	}
+	rate, ok, err := db.ExchangeRateAt(tx, contribution.FamilyID, account.Currency, base, transfer.Date)
+	if err != nil {
+		return date, nil, err
+	}
+	if ok {
+		value := db.ConvertAmount(int64(transfer.ToAmount), rate)
+		amount = &value
+	}
+	return transfer.Date, amount, nil
+}
+
+// AddContribution puts money into a goal, by hand or from a bill or transfer
+func AddContribution(c *gin.Context) {
+	var req addContributionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind AddContribution Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	goal := findGoal(c)
+	if c.IsAborted() {
+		return
+	}
+
+	contribution := models.NewGoalContribution()
+	contribution.GoalID = goal.ID
+	contribution.FamilyID = goal.FamilyID
+	contribution.Amount = req.Amount
+	contribution.BillID = req.BillID
+	contribution.TransferID = req.TransferID
+	contribution.Note = req.Note
+	contribution.CreatedBy = c.GetUint("user_id")
+	contribution.Date = db.BillNow()
+	if req.Date != "" {
+		date, err := time.Parse(consts.TimeFormat, req.Date)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		contribution.Date = date
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		switch {
+		case goal.ArchivedAt != nil:
+			return errGoalArchived
+		case req.BillID != 0 && req.TransferID != 0:
+			return errContributionSource
+		case req.BillID != 0 || req.TransferID != 0:
+			date, amount, err := linkContribution(tx, contribution, baseCurrency(c))
+			if err != nil {
+				return err
+			}
+			if req.Date == "" {
+				contribution.Date = date
+			}
+			if req.Amount == 0 {
+				if amount == nil {
+					return errContributionAmount
+				}
+				contribution.Amount = int(*amount)
+			}
+		case req.Amount == 0:
+			return errContributionAmount
+		}
+		return tx.Table(consts.GoalContributionTable).Create(contribution).Error
+	})
+	if errors.Is(err, errGoalArchived) || errors.Is(err, errContributionSource) || errors.Is(err, errContributionLinked) ||
+		errors.Is(err, errContributionAmount) || errors.Is(err, errContributionMissing) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save contribution: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Add Contribution Successfully",
+		"data":    contribution,
+	})
+}
+
+// DeleteContribution can be done by managers and by whoever added the contribution
+func DeleteContribution(c *gin.Context) {
+	goal := findGoal(c)
+	if c.IsAborted() {
+		return
+	}
+
+	contributionID, err := strconv.ParseUint(c.Param("contribution_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid contribution_id: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	contribution := models.NewGoalContribution()
+	if err := db.DB.Table(consts.GoalContributionTable).Where("id = ? AND goal_id = ?", uint(contributionID), goal.ID).First(contribution).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "contribution not found: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	familyUser := currentFamilyUser(c)
+	if !familyUser.Can(consts.FamilyManager) && contribution.CreatedBy != familyUser.UserID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can delete contributions added by others",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := db.DB.Table(consts.GoalContributionTable).Where("id = ?", contribution.ID).Delete(&models.GoalContribution{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete contribution: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "contribution deleted successfully",
+	})
+}
@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/jwt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// no 0/O, 1/I/L, easy to read out and type
+const invitationAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+func generateInvitationCode() (string, error) {
+	code := make([]byte, 8)
+	max := big.NewInt(int64(len(invitationAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = invitationAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+type InvitationResponse struct {
+	models.FamilyInvitation
+	JoinURL string `json:"join_url"`
+}
+
+func newInvitationResponse(invitation models.FamilyInvitation) InvitationResponse {
+	return InvitationResponse{
+		FamilyInvitation: invitation,
+		JoinURL:          consts.InvitationJoinURL + invitation.Code,
+	}
+}
+
+type createInvitationRequest struct {
+	ExpiresInHours int    `json:"expires_in_hours" binding:"omitempty,gt=0"` // default 7 days
+	MaxUses        *int   `json:"max_uses" binding:"omitempty,gte=0"`        // default 1, 0 means unlimited
+	Permission     string `json:"permission" binding:"omitempty,oneof=manager member viewer"`
+}
+
+func CreateInvitation(c *gin.Context) {
+	var req createInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateInvitation Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	self := currentFamilyUser(c)
+
+	if req.Permission == "" {
+		req.Permission = consts.FamilyMember
+	}
+	// same rule as UpdateFamilyMember, only owner can hand out manager
+	if self.Permission != consts.FamilyOwner && models.PermissionLevel(req.Permission) >= models.PermissionLevel(self.Permission) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, cannot grant this permission",
+		})
+		c.Abort()
+		return
+	}
+
+	expire := consts.InvitationExpire
+	if req.ExpiresInHours > 0 {
+		expire = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+	if expire > consts.MaxInvitationExpire {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invitation can be valid for at most 30 days",
+		})
+		c.Abort()
+		return
+	}
+
+	maxUses := 1
+	if req.MaxUses != nil {
+		maxUses = *req.MaxUses
+	}
+
+	code, err := generateInvitationCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50001,
+			"message": "failed to generate invitation code: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	invitation := models.NewFamilyInvitation()
+	invitation.FamilyID = c.GetUint("family_id")
+	invitation.Code = code
+	invitation.CreatedBy = self.UserID
+	invitation.Permission = req.Permission
+	invitation.ExpiresAt = time.Now().Add(expire)
+	invitation.MaxUses = maxUses
+
+	if err := db.DB.Table(consts.FamilyInvitationTable).Create(invitation).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to create invitation: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "invitation created successfully",
+		"data":    newInvitationResponse(*invitation),
+	})
+}
+
+// ListInvitations lists invitations that can still be used
+func ListInvitations(c *gin.Context) {
+	var invitations []models.FamilyInvitation
+	if err := db.DB.Table(consts.FamilyInvitationTable).
+		Where("family_id = ? AND revoked_at IS NULL AND expires_at > ?", c.GetUint("family_id"), time.Now()).
+		Where("max_uses = 0 OR uses < max_uses").
+		Order("id DESC").Find(&invitations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list invitations: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	rep := make([]InvitationResponse, 0, len(invitations))
+	for _, invitation := range invitations {
+		rep = append(rep, newInvitationResponse(invitation))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Invitations Successfully",
+		"data":    rep,
+	})
+}
+
+func RevokeInvitation(c *gin.Context) {
+	invitationID, err := strconv.ParseUint(c.Param("invitation_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid invitation_id: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	result := db.DB.Table(consts.FamilyInvitationTable).
+		Where("id = ? AND family_id = ? AND revoked_at IS NULL", uint(invitationID), c.GetUint("family_id")).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to revoke invitation: " + result.Error.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "invitation not found or already revoked",
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "invitation revoked successfully",
+	})
+}
+
+type joinByInvitationRequest struct {
+	Code string `json:"code" binding:"required"`
+	Role string `json:"role"` // father, mother...
+}
+
+var (
+	errInvitationUnusable = errors.New("invitation is expired, revoked or used up")
+	errAlreadyInFamily    = errors.New("this user is already in the family")
+)
+
+// JoinFamilyByInvitation does not go through join approval, the invitation already is one
+func JoinFamilyByInvitation(c *gin.Context) {
+	var req joinByInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind JoinFamilyByInvitation Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	_, user, err := jwt.GetPhoneFromJWT(c)
+	if err != nil {
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"errno":   40101,
+				"message": "Unauthorized, user in jwt not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50007,
+				"message": "failed to get user info: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	invitation := models.NewFamilyInvitation()
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// lock the row so concurrent joins cannot exceed max_uses
+		if err := tx.Table(consts.FamilyInvitationTable).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code = ?", strings.ToUpper(strings.TrimSpace(req.Code))).First(invitation).Error; err != nil {
+			return err
+		}
+		if !invitation.Usable(time.Now()) {
+			return errInvitationUnusable
+		}
+
+		// deleted families are not found here, archived ones cannot take new members
+		family := models.NewFamily()
+		if err := tx.Table(consts.FamilyTable).Where("id = ? AND archived_at IS NULL", invitation.FamilyID).First(family).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errInvitationUnusable
+			}
+			return err
+		}
+
+		result := tx.Table(consts.FamilyUserTable).Where("user_id = ? AND family_id = ?", user.ID, invitation.FamilyID).Limit(1).Find(&models.FamilyUser{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			return errAlreadyInFamily
+		}
+
+		if err := tx.Table(consts.FamilyUserTable).Create(map[string]interface{}{
+			"user_id":    user.ID,
+			"family_id":  invitation.FamilyID,
+			"role":       req.Role,
+			"permission": invitation.Permission,
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Table(consts.FamilyInvitationTable).Where("id = ?", invitation.ID).
+			Update("uses", gorm.Expr("uses + 1")).Error
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40002,
+				"message": "invitation code does not exist",
+			})
+		case errors.Is(err, errInvitationUnusable):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40003,
+				"message": errInvitationUnusable.Error(),
+			})
+		case errors.Is(err, errAlreadyInFamily):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40006,
+				"message": errAlreadyInFamily.Error(),
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to join family: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":    20000,
+		"message":  "user added to family successfully",
+		"familyId": invitation.FamilyID,
+	})
+}
@@ -0,0 +1,333 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/jwt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// createJoinRequest is used by AddUserToFamily when the family requires approval
+func createJoinRequest(c *gin.Context, familyID uint, userID uint, role string) {
+	result := db.DB.Table(consts.FamilyJoinRequestTable).
+		Where("family_id = ? AND user_id = ? AND status = ?", familyID, userID, consts.JoinRequestPending).
+		Limit(1).Find(models.NewFamilyJoinRequest())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to query database: " + result.Error.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if result.RowsAffected > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40011,
+			"message": "join request is already pending",
+		})
+		c.Abort()
+		return
+	}
+
+	joinRequest := models.NewFamilyJoinRequest()
+	joinRequest.FamilyID = familyID
+	joinRequest.UserID = userID
+	joinRequest.Role = role
+	joinRequest.Status = consts.JoinRequestPending
+
+	if err := db.DB.Table(consts.FamilyJoinRequestTable).Create(joinRequest).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to create join request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":     20000,
+		"message":   "join request submitted, waiting for approval",
+		"pending":   true,
+		"requestId": joinRequest.ID,
+	})
+}
+
+type JoinRequestResponse struct {
+	models.FamilyJoinRequest
+	Username   string `json:"username"`
+	FamilyName string `json:"family_name"`
+}
+
+// ListJoinRequests lists pending requests of the family for managers
+func ListJoinRequests(c *gin.Context) {
+	var requests []JoinRequestResponse
+	if err := db.DB.Table(consts.FamilyJoinRequestTable).
+		Select("family_join_request.*, \"user\".username, family.name AS family_name").
+		Joins("LEFT JOIN \"user\" ON family_join_request.user_id = \"user\".id").
+		Joins("LEFT JOIN family ON family_join_request.family_id = family.id").
+		Where("family_join_request.family_id = ? AND family_join_request.status = ? AND family_join_request.deleted_at IS NULL",
+			c.GetUint("family_id"), consts.JoinRequestPending).
+		Order("family_join_request.id").
+		Scan(&requests).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list join requests: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Join Requests Successfully",
+		"data":    requests,
+	})
+}
+
+// ListMyJoinRequests lists every join request of the current user
+func ListMyJoinRequests(c *gin.Context) {
+	_, user, err := jwt.GetPhoneFromJWT(c)
+	if err != nil {
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"errno":   40101,
+				"message": "Unauthorized, user in jwt not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50007,
+				"message": "failed to get user info: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	var requests []JoinRequestResponse
+	if err := db.DB.Table(consts.FamilyJoinRequestTable).
+		Select("family_join_request.*, \"user\".username, family.name AS family_name").
+		Joins("LEFT JOIN \"user\" ON family_join_request.user_id = \"user\".id").
+		Joins("LEFT JOIN family ON family_join_request.family_id = family.id").
+		Where("family_join_request.user_id = ? AND family_join_request.deleted_at IS NULL", user.ID).
+		Order("family_join_request.id DESC").
+		Scan(&requests).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list join requests: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Join Requests Successfully",
+		"data":    requests,
+	})
+}
+
+func parseRequestID(c *gin.Context) (uint, bool) {
+	requestID, err := strconv.ParseUint(c.Param("request_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid request_id: " + err.Error(),
+		})
+		c.Abort()
+		return 0, false
+	}
+	return uint(requestID), true
+}
+
+var errJoinRequestNotPending = errors.New("join request is not pending")
+
+// reviewJoinRequest locks the pending request and runs fn inside the same transaction
+func reviewJoinRequest(c *gin.Context, fn func(tx *gorm.DB, joinRequest *models.FamilyJoinRequest) error) {
+	requestID, ok := parseRequestID(c)
+	if !ok {
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		joinRequest := models.NewFamilyJoinRequest()
+		if err := tx.Table(consts.FamilyJoinRequestTable).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND family_id = ?", requestID, c.GetUint("family_id")).First(joinRequest).Error; err != nil {
+			return err
+		}
+		if joinRequest.Status != consts.JoinRequestPending {
+			return errJoinRequestNotPending
+		}
+		return fn(tx, joinRequest)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40002,
+				"message": "join request not found",
+			})
+		case errors.Is(err, errJoinRequestNotPending):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40003,
+				"message": errJoinRequestNotPending.Error(),
+			})
+		case errors.Is(err, errAlreadyInFamily):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40006,
+				"message": errAlreadyInFamily.Error(),
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to review join request: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "join request reviewed successfully",
+	})
+}
+
+type approveJoinRequestRequest struct {
+	Permission string `json:"permission" binding:"omitempty,oneof=manager member viewer"`
+}
+
+func ApproveJoinRequest(c *gin.Context) {
+	var req approveJoinRequestRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind ApproveJoinRequest Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	self := currentFamilyUser(c)
+
+	if req.Permission == "" {
+		req.Permission = consts.FamilyMember
+	}
+	if self.Permission != consts.FamilyOwner && models.PermissionLevel(req.Permission) >= models.PermissionLevel(self.Permission) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, cannot grant this permission",
+		})
+		c.Abort()
+		return
+	}
+
+	reviewJoinRequest(c, func(tx *gorm.DB, joinRequest *models.FamilyJoinRequest) error {
+		result := tx.Table(consts.FamilyUserTable).Where("user_id = ? AND family_id = ?", joinRequest.UserID, joinRequest.FamilyID).Limit(1).Find(&models.FamilyUser{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			return errAlreadyInFamily
+		}
+
+		if err := tx.Table(consts.FamilyUserTable).Create(map[string]interface{}{
+			"user_id":    joinRequest.UserID,
+			"family_id":  joinRequest.FamilyID,
+			"role":       joinRequest.Role,
+			"permission": req.Permission,
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Table(consts.FamilyJoinRequestTable).Where("id = ?", joinRequest.ID).Updates(map[string]interface{}{
+			"status":      consts.JoinRequestApproved,
+			"reviewed_by": self.UserID,
+			"reviewed_at": time.Now(),
+		}).Error
+	})
+}
+
+type rejectJoinRequestRequest struct {
+	Reason string `json:"reason" binding:"max=255"`
+}
+
+func RejectJoinRequest(c *gin.Context) {
+	var req rejectJoinRequestRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind RejectJoinRequest Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	self := currentFamilyUser(c)
+
+	reviewJoinRequest(c, func(tx *gorm.DB, joinRequest *models.FamilyJoinRequest) error {
+		return tx.Table(consts.FamilyJoinRequestTable).Where("id = ?", joinRequest.ID).Updates(map[string]interface{}{
+			"status":      consts.JoinRequestRejected,
+			"reason":      req.Reason,
+			"reviewed_by": self.UserID,
+			"reviewed_at": time.Now(),
+		}).Error
+	})
+}
+
+// CancelJoinRequest lets the requester withdraw a pending request
+func CancelJoinRequest(c *gin.Context) {
+	requestID, ok := parseRequestID(c)
+	if !ok {
+		return
+	}
+
+	_, user, err := jwt.GetPhoneFromJWT(c)
+	if err != nil {
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"errno":   40101,
+				"message": "Unauthorized, user in jwt not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50007,
+				"message": "failed to get user info: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	result := db.DB.Table(consts.FamilyJoinRequestTable).
+		Where("id = ? AND user_id = ? AND status = ?", requestID, user.ID, consts.JoinRequestPending).
+		Update("status", consts.JoinRequestCancelled)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to cancel join request: " + result.Error.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "pending join request not found",
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "join request cancelled successfully",
+	})
+}
@@ -0,0 +1,834 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	errLoanClosed       = errors.New("loan is closed")
+	errLoanDueDate      = errors.New("due_date cannot be before start_date")
+	errRepaymentBill    = errors.New("bill not found")
+	errRepaymentType    = errors.New("a repayment of money lent is an income bill, of money borrowed an expense bill")
+	errRepaymentLinked  = errors.New("the bill is already a repayment")
+	errRepaymentAmount  = errors.New("amount is required when the bill is not in the currency of the loan")
+	errRepaymentMissing = errors.New("amount or bill_id is required")
+)
+
+// LoanStatus is a loan with what was repaid and what is still owed, in 分 of the currency of the loan
+type LoanStatus struct {
+	models.Loan
+	Interest    int64  `json:"interest"`
+	Repaid      int64  `json:"repaid"`
+	Outstanding int64  `json:"outstanding"`
+	Status      string `json:"status"`       // open, overdue, repaid, closed
+	OverdueDays int    `json:"overdue_days"` // days since the due date while overdue
+}
+
+// loanInterest is the simple interest of the principal over the term of the loan. It runs until the
+// due date, or until now for a loan without one.
+func loanInterest(loan *models.Loan, now time.Time) int64 {
+	if loan.InterestRate <= 0 {
+		return 0
+	}
+	end := now
+	if loan.DueDate != nil && loan.DueDate.Before(end) {
+		end = *loan.DueDate
+	}
+	days := end.Sub(loan.StartDate).Hours() / 24
+	if days <= 0 {
+		return 0
+	}
+	return int64(math.Round(float64(loan.Principal) * loan.InterestRate / 100 * days / 365))
+}
+
+// loanRepaid sums the repayments of the loans, repayments of deleted bills are left out
+func loanRepaid(tx *gorm.DB, loanIDs []uint) (map[uint]int64, error) {
+	repaid := map[uint]int64{}
+	if len(loanIDs) == 0 {
+		return repaid, nil
+	}
+
+	var rows []struct {
+		LoanID uint
+		Repaid int64
+	}
+	if err := tx.Table(consts.LoanRepaymentTable).
+		Select("loan_repayment.loan_id, SUM(loan_repayment.amount) AS repaid").
+		Joins("LEFT JOIN bill ON bill.id = loan_repayment.bill_id").
+		Where("loan_repayment.loan_id IN ?", loanIDs).
+		Where("loan_repayment.bill_id = 0 OR bill.deleted_at IS NULL").
+		Group("loan_repayment.loan_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		repaid[row.LoanID] = row.Repaid
+	}
+	return repaid, nil
+}
+
+// loanStatuses computes the status of the loans at now
+func loanStatuses(tx *gorm.DB, loans []models.Loan, now time.Time) ([]LoanStatus, error) {
+	loanIDs := make([]uint, 0, len(loans))
+	for _, loan := range loans {
+		loanIDs = append(loanIDs, loan.ID)
+	}
+	repaid, err := loanRepaid(tx, loanIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]LoanStatus, 0, len(loans))
+	for _, loan := range loans {
+		status := LoanStatus{
+			Loan:     loan,
+			Interest: loanInterest(&loan, now),
+			Repaid:   repaid[loan.ID],
+		}
+		status.Outstanding = max(0, int64(loan.Principal)+status.Interest-status.Repaid)
+		switch {
+		case status.Outstanding == 0:
+			status.Status = consts.LoanRepaid
+		case loan.ClosedAt != nil:
+			status.Status = consts.LoanClosed
+			status.Outstanding = 0
+		case loan.DueDate != nil && now.After(*loan.DueDate):
+			status.Status = consts.LoanOverdue
+			status.OverdueDays = int(now.Sub(*loan.DueDate).Hours() / 24)
+		default:
+			status.Status = consts.LoanOpen
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// familyLoans loads the loans of a family with their status, the query can filter them further
+func familyLoans(tx *gorm.DB, familyID uint, filter func(*gorm.DB) *gorm.DB) ([]LoanStatus, error) {
+	query := tx.Table(consts.LoanTable).Where("family_id = ?", familyID)
+	if filter != nil {
+		query = filter(query)
+	}
+
+	var loans []models.Loan
+	if err := query.Order("due_date IS NULL, due_date, id").Find(&loans).Error; err != nil {
+		return nil, err
+	}
+	return loanStatuses(tx, loans, db.BillNow())
+}
+
+// ListLoans lists the loans of the family, ?direction=, ?counterparty_id=, ?object= and ?status= to filter them
+func ListLoans(c *gin.Context) {
+	direction := c.Query("direction")
+	counterpartyID := c.Query("counterparty_id")
+	object := c.Query("object")
+	loans, err := familyLoans(db.DB, c.GetUint("family_id"), func(query *gorm.DB) *gorm.DB {
+		if direction != "" {
+			query = query.Where("direction = ?", direction)
+		}
+		if counterpartyID != "" {
+			query = query.Where("counterparty_id = ?", counterpartyID)
+		}
+		if object != "" {
+			query = query.Where("object = ?", object)
+		}
+		return query
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list loans: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	if status := c.Query("status"); status != "" {
+		filtered := make([]LoanStatus, 0, len(loans))
+		for _, loan := range loans {
+			if loan.Status == status {
+				filtered = append(filtered, loan)
+			}
+		}
+		loans = filtered
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Loans Successfully",
+		"data":    loans,
+	})
+}
+
+// CounterpartyBalance is what is still owed between the family and one counterparty, in 分 of the base currency
+type CounterpartyBalance struct {
+	CounterpartyID uint   `json:"counterparty_id"`
+	Object         string `json:"object"`
+	Lent           int64  `json:"lent"`     // owed to the family
+	Borrowed       int64  `json:"borrowed"` // owed by the family
+	Net            int64  `json:"net"`      // lent - borrowed
+	OpenLoans      int    `json:"open_loans"`
+	OverdueLoans   int    `json:"overdue_loans"`
+	Unconverted    int    `json:"unconverted"` // loans left out of the sums, their currency has no exchange rate
+}
+
+// outstandingInBase converts what is owed on a loan to the base currency at the rate of today
+func outstandingInBase(tx *gorm.DB, loan *LoanStatus, base string, now time.Time) (int64, bool, error) {
+	rate, ok, err := db.ExchangeRateAt(tx, loan.FamilyID, loan.Currency, base, now)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	return db.ConvertAmount(loan.Outstanding, rate), true, nil
+}
+
+// LoanCounterparties sums the loans still owed per counterparty, most owed to the family first
+func LoanCounterparties(c *gin.Context) {
+	loans, err := familyLoans(db.DB, c.GetUint("family_id"), func(query *gorm.DB) *gorm.DB {
+		return query.Where("closed_at IS NULL")
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list loans: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	base := baseCurrency(c)
+	now := db.BillNow()
+	balances := map[uint]*CounterpartyBalance{}
+	for i := range loans {
+		loan := &loans[i]
+		if loan.Outstanding == 0 {
+			continue
+		}
+		balance, ok := balances[loan.CounterpartyID]
+		if !ok {
+			balance = &CounterpartyBalance{CounterpartyID: loan.CounterpartyID, Object: loan.Object}
+			balances[loan.CounterpartyID] = balance
+		}
+		balance.OpenLoans++
+		if loan.Status == consts.LoanOverdue {
+			balance.OverdueLoans++
+		}
+
+		amount, ok, err := outstandingInBase(db.DB, loan, base, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to convert loan: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		switch {
+		case !ok:
+			balance.Unconverted++
+		case loan.Direction == consts.LoanLent:
+			balance.Lent += amount
+		default:
+			balance.Borrowed += amount
+		}
+	}
+
+	result := make([]CounterpartyBalance, 0, len(balances))
+	for _, balance := range balances {
+		balance.Net = balance.Lent - balance.Borrowed
+		result = append(result, *balance)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Net != result[j].Net {
+			return result[i].Net > result[j].Net
+		}
+		return result[i].Object < result[j].Object
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":         20000,
+		"message":       "Loan Counterparties Successfully",
+		"data":          result,
+		"base_currency": base,
+	})
+}
+
+// OverdueLoans lists the loans past their due date and not repaid, longest overdue first
+func OverdueLoans(c *gin.Context) {
+	now := db.BillNow()
+	loans, err := familyLoans(db.DB, c.GetUint("family_id"), func(query *gorm.DB) *gorm.DB {
+		return query.Where("closed_at IS NULL AND due_date < ?", now)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list loans: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	base := baseCurrency(c)
+	overdue := make([]LoanStatus, 0, len(loans))
+	var lent, borrowed int64
+	unconverted := 0
+	for i := range loans {
+		loan := &loans[i]
+		if loan.Status != consts.LoanOverdue {
+			continue
+		}
+		overdue = append(overdue, *loan)
+
+		amount, ok, err := outstandingInBase(db.DB, loan, base, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to convert loan: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		switch {
+		case !ok:
+			unconverted++
+		case loan.Direction == consts.LoanLent:
+			lent += amount
+		default:
+			borrowed += amount
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Overdue Loans Successfully",
+		"data":    overdue,
+		"totals": gin.H{
+			"base_currency": base,
+			"lent":          lent,
+			"borrowed":      borrowed,
+			"unconverted":   unconverted,
+		},
+	})
+}
+
+type createLoanRequest struct {
+	Direction      string  `json:"direction" binding:"required,oneof=lent borrowed"`
+	CounterpartyID uint    `json:"counterparty_id" binding:"required_without=Object"`
+	Object         string  `json:"object" binding:"required_without=CounterpartyID,max=100"` // name or alias, for clients without counterparty_id
+	Principal      int     `json:"principal" binding:"required,gt=0"`
+	Currency       string  `json:"currency" binding:"omitempty,iso4217"` // defaults to the base currency
+	InterestRate   float64 `json:"interest_rate" binding:"gte=0,lte=1000"`
+	StartDate      string  `json:"start_date"` // defaults to now
+	DueDate        string  `json:"due_date"`
+	Note           string  `json:"note" binding:"max=255"`
+}
+
+// saveLoanErrorResponse writes the response of a failed save of a loan
+func saveLoanErrorResponse(c *gin.Context, err error) {
+	if errors.Is(err, errCounterpartyNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": err.Error(),
+		})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save loan: " + err.Error(),
+		})
+	}
+	c.Abort()
+}
+
+func CreateLoan(c *gin.Context) {
+	var req createLoanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateLoan Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	loan := models.NewLoan()
+	loan.FamilyID = c.GetUint("family_id")
+	loan.Direction = req.Direction
+	loan.Principal = req.Principal
+	loan.Currency = req.Currency
+	if loan.Currency == "" {
+		loan.Currency = baseCurrency(c)
+	}
+	loan.InterestRate = req.InterestRate
+	loan.StartDate = db.BillNow()
+	loan.Note = req.Note
+	loan.CreatedBy = c.GetUint("user_id")
+	if req.StartDate != "" {
+		date, err := parseFilterDate(req.StartDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse start_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		loan.StartDate = date
+	}
+	if req.DueDate != "" {
+		date, err := parseFilterDate(req.DueDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse due_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		loan.DueDate = &date
+	}
+	if loan.DueDate != nil && loan.DueDate.Before(loan.StartDate) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": errLoanDueDate.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		counterparty, err := resolveBillCounterparty(tx, loan.FamilyID, req.CounterpartyID, req.Object)
+		if err != nil {
+			return err
+		}
+		loan.CounterpartyID = counterparty.ID
+		loan.Object = counterparty.Name
+		return tx.Table(consts.LoanTable).Create(loan).Error
+	})
+	if err != nil {
+		saveLoanErrorResponse(c, err)
+		return
+	}
+
+	respondLoan(c, loan, "Create Loan Successfully")
+}
+
+// findLoan loads the loan of :loan_id in the family, aborts if not found. With modify the
+// current user must be a manager or the member who created the loan.
+func findLoan(c *gin.Context, modify bool) *models.Loan {
+	loanID, err := strconv.ParseUint(c.Param("loan_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid loan_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	loan := models.NewLoan()
+	if err := db.DB.Table(consts.LoanTable).Where("id = ? AND family_id = ?", uint(loanID), c.GetUint("family_id")).First(loan).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "loan not found: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	familyUser := currentFamilyUser(c)
+	if modify && !familyUser.Can(consts.FamilyManager) && loan.CreatedBy != familyUser.UserID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can modify loans created by others",
+		})
+		c.Abort()
+		return nil
+	}
+	return loan
+}
+
+// respondLoan writes the loan with its status
+func respondLoan(c *gin.Context, loan *models.Loan, message string) {
+	statuses, err := loanStatuses(db.DB, []models.Loan{*loan}, db.BillNow())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to sum repayments: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": message,
+		"data":    statuses[0],
+	})
+}
+
+type updateLoanRequest struct {
+	Direction      *string  `json:"direction" binding:"omitnil,oneof=lent borrowed"`
+	CounterpartyID *uint    `json:"counterparty_id" binding:"omitnil,gt=0"`
+	Object         *string  `json:"object" binding:"omitnil,min=1,max=100"`
+	Principal      *int     `json:"principal" binding:"omitnil,gt=0"`
+	Currency       *string  `json:"currency" binding:"omitnil,iso4217"`
+	InterestRate   *float64 `json:"interest_rate" binding:"omitnil,gte=0,lte=1000"`
+	StartDate      *string  `json:"start_date" binding:"omitnil,min=1"`
+	DueDate        *string  `json:"due_date"` // "" removes the due date
+	Note           *string  `json:"note" binding:"omitnil,max=255"`
+}
+
+func UpdateLoan(c *gin.Context) {
+	var req updateLoanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateLoan Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	loan := findLoan(c, true)
+	if c.IsAborted() {
+		return
+	}
+
+	if req.Direction != nil {
+		loan.Direction = *req.Direction
+	}
+	if req.Principal != nil {
+		loan.Principal = *req.Principal
+	}
+	if req.Currency != nil {
+		loan.Currency = *req.Currency
+	}
+	if req.InterestRate != nil {
+		loan.InterestRate = *req.InterestRate
+	}
+	if req.StartDate != nil {
+		date, err := parseFilterDate(*req.StartDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse start_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		loan.StartDate = date
+	}
+	if req.DueDate != nil {
+		loan.DueDate = nil
+		if *req.DueDate != "" {
+			date, err := parseFilterDate(*req.DueDate)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"errno":   40001,
+					"message": "failed to parse due_date: " + err.Error(),
+				})
+				c.Abort()
+				return
+			}
+			loan.DueDate = &date
+		}
+	}
+	if req.Note != nil {
+		loan.Note = *req.Note
+	}
+	if loan.DueDate != nil && loan.DueDate.Before(loan.StartDate) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": errLoanDueDate.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if req.CounterpartyID != nil || req.Object != nil {
+			var counterpartyID uint
+			var name string
+			if req.CounterpartyID != nil {
+				counterpartyID = *req.CounterpartyID
+			} else {
+				name = *req.Object
+			}
+			counterparty, err := resolveBillCounterparty(tx, loan.FamilyID, counterpartyID, name)
+			if err != nil {
+				return err
+			}
+			loan.CounterpartyID = counterparty.ID
+			loan.Object = counterparty.Name
+		}
+		return tx.Table(consts.LoanTable).Save(loan).Error
+	})
+	if err != nil {
+		saveLoanErrorResponse(c, err)
+		return
+	}
+
+	respondLoan(c, loan, "Update Loan Successfully")
+}
+
+// CloseLoan marks a loan as no longer owed though not repaid, e.g. forgiven
+func CloseLoan(c *gin.Context) {
+	setLoanClosed(c, true)
+}
+
+func ReopenLoan(c *gin.Context) {
+	setLoanClosed(c, false)
+}
+
+func setLoanClosed(c *gin.Context, closed bool) {
+	loan := findLoan(c, true)
+	if c.IsAborted() {
+		return
+	}
+
+	loan.ClosedAt = nil
+	message := "Reopen Loan Successfully"
+	if closed {
+		now := time.Now()
+		loan.ClosedAt, message = &now, "Close Loan Successfully"
+	}
+	if err := db.DB.Table(consts.LoanTable).Where("id = ?", loan.ID).Update("closed_at", loan.ClosedAt).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to update loan: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	respondLoan(c, loan, message)
+}
+
+// DeleteLoan deletes the loan and its repayments, the bills stay
+func DeleteLoan(c *gin.Context) {
+	loan := findLoan(c, true)
+	if c.IsAborted() {
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.LoanRepaymentTable).Where("loan_id = ?", loan.ID).Delete(&models.LoanRepayment{}).Error; err != nil {
+			return err
+		}
+		return tx.Table(consts.LoanTable).Unscoped().Where("id = ?", loan.ID).Delete(&models.Loan{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete loan: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "loan deleted successfully",
+	})
+}
+
+func ListRepayments(c *gin.Context) {
+	loan := findLoan(c, false)
+	if c.IsAborted() {
+		return
+	}
+
+	repayments := []models.LoanRepayment{}
+	if err := db.DB.Table(consts.LoanRepaymentTable).Where("loan_id = ?", loan.ID).Order("date DESC, id DESC").Find(&repayments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list repayments: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Repayments Successfully",
+		"data":    repayments,
+	})
+}
+
+type addRepaymentRequest struct {
+	Amount int    `json:"amount" binding:"gte=0"` // defaults to the amount of the bill
+	Date   string `json:"date"`                   // defaults to the date of the bill, then to now
+	BillID uint   `json:"bill_id"`
+	Note   string `json:"note" binding:"max=255"`
+}
+
+// linkRepayment checks the bill of a repayment and takes the date and the default amount from it.
+// Money lent comes back as income, money borrowed is paid back as expense.
+func linkRepayment(tx *gorm.DB, loan *models.Loan, repayment *models.LoanRepayment) (*models.Bill, error) {
+	var count int64
+	if err := tx.Table(consts.LoanRepaymentTable).Where("bill_id = ?", repayment.BillID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, errRepaymentLinked
+	}
+
+	bill := models.NewBill()
+	if err := tx.Table(consts.BillTable).Where("id = ? AND family_id = ?", repayment.BillID, loan.FamilyID).First(bill).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errRepaymentBill
+		}
+		return nil, err
+	}
+	if (loan.Direction == consts.LoanLent) != (bill.Type == consts.BillTypeIncome) {
+		return nil, errRepaymentType
+	}
+	return bill, nil
+}
+
+// AddRepayment pays back part of a loan, by hand or from a bill
+func AddRepayment(c *gin.Context) {
+	var req addRepaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind AddRepayment Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	loan := findLoan(c, false)
+	if c.IsAborted() {
+		return
+	}
+
+	repayment := models.NewLoanRepayment()
+	repayment.LoanID = loan.ID
+	repayment.FamilyID = loan.FamilyID
+	repayment.Amount = req.Amount
+	repayment.BillID = req.BillID
+	repayment.Note = req.Note
+	repayment.CreatedBy = c.GetUint("user_id")
+	repayment.Date = db.BillNow()
+	if req.Date != "" {
+		date, err := time.Parse(consts.TimeFormat, req.Date)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		repayment.Date = date
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		switch {
+		case loan.ClosedAt != nil:
+			return errLoanClosed
+		case req.BillID != 0:
+			bill, err := linkRepayment(tx, loan, repayment)
+			if err != nil {
+				return err
+			}
+			if req.Date == "" {
+				repayment.Date = bill.Date
+			}
+			if req.Amount == 0 {
+				if bill.Currency != loan.Currency {
+					return errRepaymentAmount
+				}
+				repayment.Amount = bill.Amount
+			}
+		case req.Amount == 0:
+			return errRepaymentMissing
+		}
+		return tx.Table(consts.LoanRepaymentTable).Create(repayment).Error
+	})
+	if errors.Is(err, errLoanClosed) || errors.Is(err, errRepaymentBill) || errors.Is(err, errRepaymentType) ||
+		errors.Is(err, errRepaymentLinked) || errors.Is(err, errRepaymentAmount) || errors.Is(err, errRepaymentMissing) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save repayment: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Add Repayment Successfully",
+		"data":    repayment,
+	})
+}
+
+// DeleteRepayment can be done by managers and by whoever added the repayment
+func DeleteRepayment(c *gin.Context) {
+	loan := findLoan(c, false)
+	if c.IsAborted() {
+		return
+	}
+
+	repaymentID, err := strconv.ParseUint(c.Param("repayment_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid repayment_id: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	repayment := models.NewLoanRepayment()
+	if err := db.DB.Table(consts.LoanRepaymentTable).Where("id = ? AND loan_id = ?", uint(repaymentID), loan.ID).First(repayment).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "repayment not found: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	familyUser := currentFamilyUser(c)
+	if !familyUser.Can(consts.FamilyManager) && repayment.CreatedBy != familyUser.UserID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can delete repayments added by others",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := db.DB.Table(consts.LoanRepaymentTable).Where("id = ?", repayment.ID).Delete(&models.LoanRepayment{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete repayment: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "repayment deleted successfully",
+	})
+}
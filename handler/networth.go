@@ -0,0 +1,361 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListAssets returns the assets and liabilities, ?include_archived=true for the archived ones too
+func ListAssets(c *gin.Context) {
+	query := db.DB.Table(consts.AssetTable).Where("family_id = ?", c.GetUint("family_id"))
+	if c.Query("include_archived") != "true" {
+		query = query.Where("archived_at IS NULL")
+	}
+
+	var assets []models.Asset
+	if err := query.Order("kind, id").Find(&assets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list assets: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Assets Successfully",
+		"data":    assets,
+	})
+}
+
+type createAssetRequest struct {
+	Name     string `json:"name" binding:"required,max=100"`
+	Kind     string `json:"kind" binding:"required,oneof=asset liability"`
+	Category string `json:"category" binding:"max=50"`
+	Value    int    `json:"value" binding:"gte=0"`                // positive for liabilities too
+	Currency string `json:"currency" binding:"omitempty,iso4217"` // defaults to the base currency
+	Note     string `json:"note" binding:"max=255"`
+}
+
+func CreateAsset(c *gin.Context) {
+	var req createAssetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateAsset Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	asset := models.NewAsset()
+	asset.FamilyID = c.GetUint("family_id")
+	asset.Name = strings.TrimSpace(req.Name)
+	asset.Kind = req.Kind
+	asset.Category = strings.TrimSpace(req.Category)
+	asset.Value = req.Value
+	asset.Currency = baseCurrency(c)
+	if req.Currency != "" {
+		asset.Currency = req.Currency
+	}
+	asset.Note = req.Note
+
+	if err := db.DB.Table(consts.AssetTable).Create(asset).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save asset: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Create Asset Successfully",
+		"data":    asset,
+	})
+}
+
+// findAsset loads the asset of :asset_id in the family, aborts if not found
+func findAsset(c *gin.Context) *models.Asset {
+	assetID, err := strconv.ParseUint(c.Param("asset_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid asset_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	asset := models.NewAsset()
+	if err := db.DB.Table(consts.AssetTable).Where("id = ? AND family_id = ?", uint(assetID), c.GetUint("family_id")).First(asset).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "asset not found: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+	return asset
+}
+
+// updateAssetRequest updates the value of an asset as it changes, the kind and the currency stay
+type updateAssetRequest struct {
+	Name     *string `json:"name" binding:"omitnil,min=1,max=100"`
+	Category *string `json:"category" binding:"omitnil,max=50"`
+	Value    *int    `json:"value" binding:"omitnil,gte=0"`
+	Note     *string `json:"note" binding:"omitnil,max=255"`
+}
+
+func UpdateAsset(c *gin.Context) {
+	var req updateAssetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateAsset Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	asset := findAsset(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if req.Name != nil {
+		asset.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Category != nil {
+		asset.Category = strings.TrimSpace(*req.Category)
+	}
+	if req.Value != nil {
+		asset.Value = *req.Value
+	}
+	if req.Note != nil {
+		asset.Note = *req.Note
+	}
+
+	if err := db.DB.Table(consts.AssetTable).Save(asset).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save asset: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Update Asset Successfully",
+		"data":    asset,
+	})
+}
+
+// ArchiveAsset keeps a sold asset or a paid off liability out of the net worth
+func ArchiveAsset(c *gin.Context) {
+	setAssetArchived(c, true)
+}
+
+func UnarchiveAsset(c *gin.Context) {
+	setAssetArchived(c, false)
+}
+
+func setAssetArchived(c *gin.Context, archived bool) {
+	asset := findAsset(c)
+	if c.IsAborted() {
+		return
+	}
+
+	var archivedAt interface{}
+	message := "asset unarchived successfully"
+	if archived {
+		archivedAt, message = time.Now(), "asset archived successfully"
+	}
+	if err := db.DB.Table(consts.AssetTable).Where("id = ?", asset.ID).Update("archived_at", archivedAt).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to update asset: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": message,
+	})
+}
+
+// DeleteAsset deletes the asset, the snapshots that counted it keep their copy of it
+func DeleteAsset(c *gin.Context) {
+	asset := findAsset(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if err := db.DB.Table(consts.AssetTable).Unscoped().Where("id = ?", asset.ID).Delete(&models.Asset{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete asset: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "asset deleted successfully",
+	})
+}
+
+// CurrentNetWorth computes the net worth now without saving it
+func CurrentNetWorth(c *gin.Context) {
+	netWorth, err := db.NetWorth(db.DB, c.GetUint("family_id"), baseCurrency(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to compute net worth: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Current Net Worth Successfully",
+		"data":    netWorth,
+	})
+}
+
+// CreateNetWorthSnapshot saves the net worth now into the history, besides the monthly automatic snapshot
+func CreateNetWorthSnapshot(c *gin.Context) {
+	snapshot, err := db.TakeNetWorthSnapshot(db.DB, c.GetUint("family_id"), consts.SnapshotManual, c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to take net worth snapshot: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Create Net Worth Snapshot Successfully",
+		"data":    snapshot,
+	})
+}
+
+// NetWorthHistory returns the snapshots oldest first with what each was made of,
+// filtered by ?start_date=, ?end_date= and ?source=auto|manual. Snapshots taken in another base currency
+// than the current one are left out unless ?base_currency= asks for them.
+func NetWorthHistory(c *gin.Context) {
+	query := db.DB.Table(consts.NetWorthSnapshotTable).Where("family_id = ?", c.GetUint("family_id"))
+
+	base := baseCurrency(c)
+	if value := c.Query("base_currency"); value != "" {
+		base = strings.ToUpper(value)
+	}
+	query = query.Where("base_currency = ?", base)
+
+	if value := c.Query("start_date"); value != "" {
+		date, err := parseFilterDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse start_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		query = query.Where("date >= ?", date)
+	}
+	if value := c.Query("end_date"); value != "" {
+		date, err := parseBalanceDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse end_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		query = query.Where("date < ?", date)
+	}
+	switch source := c.Query("source"); source {
+	case "":
+	case consts.SnapshotAuto, consts.SnapshotManual:
+		query = query.Where("source = ?", source)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid source, use auto or manual",
+		})
+		c.Abort()
+		return
+	}
+
+	var snapshots []models.NetWorthSnapshot
+	if err := query.Order("date, id").Find(&snapshots).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list net worth snapshots: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":         20000,
+		"message":       "Net Worth History Successfully",
+		"data":          snapshots,
+		"base_currency": base,
+	})
+}
+
+// DeleteNetWorthSnapshot removes a snapshot from the history, like one taken by mistake
+func DeleteNetWorthSnapshot(c *gin.Context) {
+	snapshotID, err := strconv.ParseUint(c.Param("snapshot_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid snapshot_id: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	result := db.DB.Table(consts.NetWorthSnapshotTable).
+		Where("id = ? AND family_id = ?", uint(snapshotID), c.GetUint("family_id")).
+		Delete(&models.NetWorthSnapshot{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete net worth snapshot: " + result.Error.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "net worth snapshot not found",
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "net worth snapshot deleted successfully",
+	})
+}
@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultBillPageSize = 50
+	maxBillPageSize     = 200
+)
+
+// sort field in query -> column, every one has an index together with family_id
+var billSortColumns = map[string]string{
+	"date":       "bill.date",
+	"amount":     "bill.amount",
+	"created_at": "bill.created_at",
+}
+
+// billCursor is the position after the last bill of a page, sent to the client as base64 json
+type billCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+type billPage struct {
+	Limit  int
+	Sort   string
+	Desc   bool
+	Cursor *billCursor
+}
+
+// billTotals sums base_amount, bills without an exchange rate are only counted in Unconverted
+type billTotals struct {
+	BaseCurrency string           `json:"base_currency"`
+	Count        int64            `json:"count"`
+	Income       int64            `json:"income"`
+	Expense      int64            `json:"expense"`
+	Unconverted  int64            `json:"unconverted"`
+	Currencies   []CurrencyTotals `json:"currencies" gorm:"-"` // original amounts
+}
+
+type CurrencyTotals struct {
+	Currency string `json:"currency"`
+	Count    int64  `json:"count"`
+	Income   int64  `json:"income"`
+	Expense  int64  `json:"expense"`
+}
+
+// billSumsSQL selects count, income, expense and unconverted of the bills in the base currency
+const billSumsSQL = "COUNT(*) AS count, " +
+	"COALESCE(SUM(CASE WHEN bill.type = 'income' THEN bill.base_amount ELSE 0 END), 0) AS income, " +
+	"COALESCE(SUM(CASE WHEN bill.type = 'expense' THEN bill.base_amount ELSE 0 END), 0) AS expense, " +
+	"COUNT(*) - COUNT(bill.base_amount) AS unconverted"
+
+// currencySumsSQL selects count, income and expense of the bills in their own currency, to be grouped by bill.currency
+const currencySumsSQL = "bill.currency, COUNT(*) AS count, " +
+	"COALESCE(SUM(CASE WHEN bill.type = 'income' THEN bill.amount ELSE 0 END), 0) AS income, " +
+	"COALESCE(SUM(CASE WHEN bill.type = 'expense' THEN bill.amount ELSE 0 END), 0) AS expense"
+
+// baseCurrency is the base currency of the family set by middleware.FamilyAuth
+func baseCurrency(c *gin.Context) string {
+	return c.MustGet("family").(*models.Family).BaseCurrency
+}
+
+// billQuery is the base query of the bills of a family, soft deleted bills excluded
+func billQuery(familyID uint) *gorm.DB {
+	return db.DB.Table(consts.BillTable).Model(&models.Bill{}).Where("bill.family_id = ?", familyID)
+}
+
+// parseBillPage reads limit, cursor, sort and order from query
+func parseBillPage(c *gin.Context) (*billPage, error) {
+	page := &billPage{
+		Limit: defaultBillPageSize,
+		Sort:  c.DefaultQuery("sort", "date"),
+		Desc:  true,
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxBillPageSize {
+			return nil, errors.New("limit must be between 1 and " + strconv.Itoa(maxBillPageSize))
+		}
+		page.Limit = n
+	}
+
+	if _, ok := billSortColumns[page.Sort]; !ok {
+		return nil, errors.New("sort must be one of date, amount, created_at")
+	}
+
+	switch c.DefaultQuery("order", "desc") {
+	case "desc":
+	case "asc":
+		page.Desc = false
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		page.Cursor = &billCursor{}
+		if err := json.Unmarshal(raw, page.Cursor); err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		if page.Cursor.Sort != page.Sort {
+			return nil, errors.New("cursor does not match sort")
+		}
+	}
+
+	return page, nil
+}
+
+func (p *billPage) cursorValue() (interface{}, error) {
+	if p.Sort == "amount" {
+		return strconv.Atoi(p.Cursor.Value)
+	}
+	return time.Parse(time.RFC3339Nano, p.Cursor.Value)
+}
+
+func (p *billPage) nextCursor(bill *models.Bill) string {
+	cursor := billCursor{Sort: p.Sort, ID: bill.ID}
+	switch p.Sort {
+	case "amount":
+		cursor.Value = strconv.Itoa(bill.Amount)
+	case "created_at":
+		cursor.Value = bill.CreatedAt.Format(time.RFC3339Nano)
+	default:
+		cursor.Value = bill.Date.Format(time.RFC3339Nano)
+	}
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// sumBills counts the bills of query and sums their amount by type, in the base currency and in every currency
+func sumBills(query *gorm.DB, base string) (*billTotals, error) {
+	totals := &billTotals{BaseCurrency: base}
+	if err := query.Session(&gorm.Session{}).Select(billSumsSQL).Scan(totals).Error; err != nil {
+		return nil, err
+	}
+	totals.Currencies = []CurrencyTotals{}
+	err := query.Session(&gorm.Session{}).Select(currencySumsSQL).Group("bill.currency").Order("bill.currency").Scan(&totals.Currencies).Error
+	return totals, err
+}
+
+// respondBillPage runs query with keyset pagination, totals of every matched bill go to the X-Total-* headers
+// in the base currency and to "totals" with the original amounts by currency
+func respondBillPage(c *gin.Context, query *gorm.DB, message string) {
+	page, err := parseBillPage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40010,
+			"message": err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	query = query.Session(&gorm.Session{})
+
+	totals, err := sumBills(query, baseCurrency(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to count bills: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	column := billSortColumns[page.Sort]
+	direction, compare := " DESC", "<"
+	if !page.Desc {
+		direction, compare = " ASC", ">"
+	}
+
+	pageQuery := query
+	if page.Cursor != nil {
+		value, err := page.cursorValue()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40010,
+				"message": "invalid cursor",
+			})
+			c.Abort()
+			return
+		}
+		pageQuery = pageQuery.Where("("+column+", bill.id) "+compare+" (?, ?)", value, page.Cursor.ID)
+	}
+
+	var bills []models.Bill
+	if err := pageQuery.Order(column + direction).Order("bill.id" + direction).
+		Limit(page.Limit + 1).Find(&bills).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list bills: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	nextCursor := ""
+	if len(bills) > page.Limit {
+		bills = bills[:page.Limit]
+		nextCursor = page.nextCursor(&bills[len(bills)-1])
+	}
+
+	if err := loadBillTags(db.DB, bills); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to load tags: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if err := loadBillSplits(db.DB, bills); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to load splits: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.FormatInt(totals.Count, 10))
+	c.Header("X-Total-Income", strconv.FormatInt(totals.Income, 10))
+	c.Header("X-Total-Expense", strconv.FormatInt(totals.Expense, 10))
+	c.Header("X-Total-Unconverted", strconv.FormatInt(totals.Unconverted, 10))
+	c.Header("X-Base-Currency", totals.BaseCurrency)
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":       20000,
+		"message":     message,
+		"data":        bills,
+		"next_cursor": nextCursor,
+		"totals":      totals,
+	})
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pivotDimensions are the group-by dimensions of StatsPivot, only these expressions reach the SQL
+var pivotDimensions = map[string]string{
+	"type":     "bill.type",
+	"category": "bill.category",
+	"object":   "bill.object",
+	"username": "bill.username",
+	"year":     "EXTRACT(YEAR FROM bill.date AT TIME ZONE 'UTC')::int",
+	"month":    "EXTRACT(MONTH FROM bill.date AT TIME ZONE 'UTC')::int",  // 1 to 12, group by year too to keep years apart
+	"weekday":  "EXTRACT(ISODOW FROM bill.date AT TIME ZONE 'UTC')::int", // 1 Monday to 7 Sunday
+}
+
+// pivotMeasures are the measures of StatsPivot over the amount in the base currency,
+// bills without an exchange rate only count in count
+var pivotMeasures = map[string]string{
+	"sum":   "COALESCE(SUM(bill.base_amount), 0)::bigint",
+	"count": "COUNT(*)::bigint",
+	"avg":   "ROUND(AVG(bill.base_amount))::bigint",
+	"min":   "MIN(bill.base_amount)::bigint",
+	"max":   "MAX(bill.base_amount)::bigint",
+}
+
+// pivotValues maps the requested measures to their value in a cell, nil for no bills
+type pivotValues map[string]interface{}
+
+type PivotRow struct {
+	Keys  []interface{} `json:"keys"`  // values of the row dimensions
+	Cells []pivotValues `json:"cells"` // one per column key, nil where no bill matched
+	Total pivotValues   `json:"total"` // over every column
+}
+
+// parsePivotFields splits the comma separated names of a parameter and checks them against allowed
+func parsePivotFields(values []string, allowed map[string]string, name string, maxCount int) ([]string, error) {
+	fields := splitValues(values)
+	if len(fields) > maxCount {
+		return nil, errors.New(name + " takes at most " + strconv.Itoa(maxCount) + " values")
+	}
+	seen := map[string]bool{}
+	for _, field := range fields {
+		if _, ok := allowed[field]; !ok {
+			names := make([]string, 0, len(allowed))
+			for name := range allowed {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, errors.New("unknown " + name + " " + strconv.Quote(field) + ", use " + strings.Join(names, ", "))
+		}
+		if seen[field] {
+			return nil, errors.New(name + " " + strconv.Quote(field) + " is repeated")
+		}
+		seen[field] = true
+	}
+	return fields, nil
+}
+
+// pivotInt reads a GROUPING() flag, the driver returns it as some integer type
+func pivotInt(value interface{}) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int:
+		return int64(v)
+	}
+	return 0
+}
+
+func pivotKey(keys []interface{}) string {
+	raw, _ := json.Marshal(keys)
+	return string(raw)
+}
+
+// StatsPivot groups the bills matching the filters of SelectBills by ?rows= and ?columns=, comma separated
+// dimensions of pivotDimensions, and computes ?measures= of pivotMeasures (default sum) in every cell:
+// ?rows=category&columns=year,type&measures=sum,count&start_date=2024-01-01
+// The totals of every row, of every column and of everything are computed by the same query.
+func StatsPivot(c *gin.Context) {
+	rowDims, err := parsePivotFields(c.QueryArray("rows"), pivotDimensions, "rows", 3)
+	if err == nil && len(rowDims) == 0 {
+		err = errors.New("rows is required")
+	}
+	var columnDims, measures []string
+	if err == nil {
+		columnDims, err = parsePivotFields(c.QueryArray("columns"), pivotDimensions, "columns", 2)
+	}
+	if err == nil {
+		measures, err = parsePivotFields(c.QueryArray("measures"), pivotMeasures, "measures", len(pivotMeasures))
+	}
+	if err == nil {
+		for _, dim := range columnDims {
+			for _, rowDim := range rowDims {
+				if dim == rowDim {
+					err = errors.New("dimension " + strconv.Quote(dim) + " is in both rows and columns")
+				}
+			}
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if len(measures) == 0 {
+		measures = []string{"sum"}
+	}
+
+	query := statsBills(c)
+	if c.IsAborted() {
+		return
+	}
+
+	// d0.. are the row dimensions then the column dimensions, gr and gc tell which of them a row sums over
+	var selects, rowExprs, columnExprs []string
+	for i, dim := range append(append([]string{}, rowDims...), columnDims...) {
+		selects = append(selects, pivotDimensions[dim]+" AS d"+strconv.Itoa(i))
+		if i < len(rowDims) {
+			rowExprs = append(rowExprs, pivotDimensions[dim])
+		} else {
+			columnExprs = append(columnExprs, pivotDimensions[dim])
+		}
+	}
+	for _, measure := range measures {
+		selects = append(selects, pivotMeasures[measure]+" AS m_"+measure)
+	}
+	selects = append(selects, "GROUPING("+rowExprs[0]+") AS gr")
+	sets := "(" + strings.Join(rowExprs, ", ") + "), ()"
+	if len(columnExprs) > 0 {
+		selects = append(selects, "GROUPING("+columnExprs[0]+") AS gc")
+		sets = "(" + strings.Join(append(append([]string{}, rowExprs...), columnExprs...), ", ") + "), " +
+			"(" + strings.Join(rowExprs, ", ") + "), (" + strings.Join(columnExprs, ", ") + "), ()"
+	}
+	var orders []string
+	for i := range len(rowDims) + len(columnDims) {
+		orders = append(orders, "d"+strconv.Itoa(i)+" NULLS LAST")
+	}
+
+	var results []map[string]interface{}
+	if err := query.Select(strings.Join(selects, ", ")).
+		Group("GROUPING SETS (" + sets + ")").
+		Order(strings.Join(orders, ", ")).
+		Limit(consts.MaxPivotCells + 1).
+		Find(&results).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to group bills: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if len(results) > consts.MaxPivotCells {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": "the pivot table has more than " + strconv.Itoa(consts.MaxPivotCells) + " cells, use fewer dimensions or filters",
+		})
+		c.Abort()
+		return
+	}
+
+	values := func(result map[string]interface{}) pivotValues {
+		cell := pivotValues{}
+		for _, measure := range measures {
+			cell[measure] = result["m_"+measure]
+		}
+		return cell
+	}
+	keys := func(result map[string]interface{}, from int, count int) []interface{} {
+		keys := make([]interface{}, 0, count)
+		for i := from; i < from+count; i++ {
+			keys = append(keys, result["d"+strconv.Itoa(i)])
+		}
+		return keys
+	}
+
+	// NULLS LAST puts the totals of every column after the rows, in the order of the column dimensions
+	rows := []*PivotRow{}
+	rowIndex := map[string]*PivotRow{}
+	columnKeys := [][]interface{}{}
+	columnIndex := map[string]int{}
+	totals := []pivotValues{}
+	grandTotal := pivotValues{}
+	for _, result := range results {
+		rowTotal := pivotInt(result["gr"]) == 1
+		columnTotal := len(columnDims) == 0 || pivotInt(result["gc"]) == 1
+		switch {
+		case rowTotal && columnTotal:
+			grandTotal = values(result)
+		case rowTotal:
+			columnKey := keys(result, len(rowDims), len(columnDims))
+			columnIndex[pivotKey(columnKey)] = len(columnKeys)
+			columnKeys = append(columnKeys, columnKey)
+			totals = append(totals, values(result))
+		case columnTotal:
+			rowKey := keys(result, 0, len(rowDims))
+			row := &PivotRow{Keys: rowKey, Total: values(result)}
+			rows = append(rows, row)
+			rowIndex[pivotKey(rowKey)] = row
+		}
+	}
+	for _, row := range rows {
+		row.Cells = make([]pivotValues, len(columnKeys))
+	}
+	for _, result := range results {
+		if pivotInt(result["gr"]) == 1 || len(columnDims) == 0 || pivotInt(result["gc"]) == 1 {
+			continue
+		}
+		row := rowIndex[pivotKey(keys(result, 0, len(rowDims)))]
+		row.Cells[columnIndex[pivotKey(keys(result, len(rowDims), len(columnDims)))]] = values(result)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Stats Pivot Successfully",
+		"data": gin.H{
+			"rows":          rowDims,
+			"columns":       columnDims,
+			"measures":      measures,
+			"column_keys":   columnKeys,
+			"table":         rows,
+			"column_totals": totals,
+			"grand_total":   grandTotal,
+		},
+		"base_currency": baseCurrency(c),
+	})
+}
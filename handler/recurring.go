@@ -0,0 +1,625 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// canModifyRecurring has the same rule as canModifyBill
+func canModifyRecurring(c *gin.Context, rule *models.RecurringBill) bool {
+	familyUser := currentFamilyUser(c)
+	if familyUser.Can(consts.FamilyManager) {
+		return true
+	}
+	return familyUser.Can(consts.FamilyMember) && rule.CreatedBy == familyUser.UserID
+}
+
+type createRecurringBillRequest struct {
+	Type           string `json:"type" binding:"required,oneof=income expense"`
+	Amount         int    `json:"amount" binding:"required,gt=0"`
+	Currency       string `json:"currency" binding:"omitempty,iso4217"` // defaults to the base currency
+	CategoryID     uint   `json:"category_id" binding:"required_without=Category"`
+	Category       string `json:"category" binding:"required_without=CategoryID"`
+	Description    string `json:"description" binding:"max=255"`
+	CounterpartyID uint   `json:"counterparty_id" binding:"required_without=Object"`
+	Object         string `json:"object" binding:"required_without=CounterpartyID"`
+	Username       string `json:"username" binding:"required"`
+
+	Frequency      string `json:"frequency" binding:"required,oneof=daily weekly monthly yearly"`
+	Interval       int    `json:"interval" binding:"omitempty,min=1,max=366"` // default 1
+	StartDate      string `json:"start_date" binding:"required"`
+	EndDate        string `json:"end_date"`
+	Count          int    `json:"count" binding:"gte=0"`
+	LastDayOfMonth bool   `json:"last_day_of_month"`
+}
+
+// CreateRecurringBill also generates the occurrences already due when start_date is in the past
+func CreateRecurringBill(c *gin.Context) {
+	var req createRecurringBillRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateRecurringBill Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	familyID := c.GetUint("family_id")
+
+	rule := models.NewRecurringBill()
+	rule.FamilyID = familyID
+	rule.CreatedBy = c.GetUint("user_id")
+	rule.Type = req.Type
+	rule.Amount = req.Amount
+	rule.Currency = baseCurrency(c)
+	if req.Currency != "" {
+		rule.Currency = req.Currency
+	}
+	rule.Description = req.Description
+	rule.Username = req.Username
+	rule.Frequency = req.Frequency
+	rule.Interval = req.Interval
+	if rule.Interval == 0 {
+		rule.Interval = 1
+	}
+	rule.Count = req.Count
+	rule.LastDayOfMonth = req.LastDayOfMonth
+
+	if rule.LastDayOfMonth && rule.Frequency != consts.FrequencyMonthly && rule.Frequency != consts.FrequencyYearly {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "last_day_of_month only works with monthly and yearly rules",
+		})
+		c.Abort()
+		return
+	}
+
+	var err error
+	rule.StartDate, err = time.Parse(consts.TimeFormat, req.StartDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "failed to parse start_date: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if rule.LastDayOfMonth {
+		rule.StartDate = rule.Occurrence(0)
+	}
+	if req.EndDate != "" {
+		endDate, err := time.Parse(consts.TimeFormat, req.EndDate)
+		if err != nil || endDate.Before(rule.StartDate) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "end_date must be like 2006-01-02 15:04:05 and not before start_date",
+			})
+			c.Abort()
+			return
+		}
+		rule.EndDate = &endDate
+	}
+	rule.NextDate = db.NextRecurringDate(rule)
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		category, err := resolveBillCategory(tx, familyID, rule.Type, req.CategoryID, req.Category)
+		if err != nil {
+			return err
+		}
+		rule.CategoryID = category.ID
+		rule.Category = category.Name
+
+		counterparty, err := resolveBillCounterparty(tx, familyID, req.CounterpartyID, req.Object)
+		if err != nil {
+			return err
+		}
+		rule.CounterpartyID = counterparty.ID
+		rule.Object = counterparty.Name
+
+		return tx.Table(consts.RecurringBillTable).Create(rule).Error
+	})
+	if err != nil {
+		billSaveErrorResponse(c, err, "failed to create recurring bill: ")
+		return
+	}
+
+	generated, err := db.GenerateRecurringBills(rule.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "recurring bill created but failed to generate due bills: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":     20000,
+		"message":   "Create Recurring Bill Successfully",
+		"data":      rule,
+		"generated": generated,
+	})
+}
+
+// ListRecurringBills lists the rules of the family, ended ones only with ?include_ended=true
+func ListRecurringBills(c *gin.Context) {
+	query := db.DB.Table(consts.RecurringBillTable).Where("family_id = ?", c.GetUint("family_id"))
+	if c.Query("include_ended") != "true" {
+		query = query.Where("next_date IS NOT NULL")
+	}
+
+	rules := []models.RecurringBill{}
+	if err := query.Order("id").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list recurring bills: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Recurring Bills Successfully",
+		"data":    rules,
+	})
+}
+
+// findRecurringBill loads the rule of :rule_id in the family, aborts if not found
+func findRecurringBill(c *gin.Context) *models.RecurringBill {
+	ruleID, err := strconv.ParseUint(c.Param("rule_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid rule_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	rule := models.NewRecurringBill()
+	if err := db.DB.Table(consts.RecurringBillTable).Where("id = ? AND family_id = ?", uint(ruleID), c.GetUint("family_id")).First(rule).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "recurring bill not found: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+	return rule
+}
+
+// findModifiableRecurringBill is findRecurringBill plus the permission check
+func findModifiableRecurringBill(c *gin.Context) *models.RecurringBill {
+	rule := findRecurringBill(c)
+	if c.IsAborted() {
+		return nil
+	}
+	if !canModifyRecurring(c, rule) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can modify recurring bills created by others",
+		})
+		c.Abort()
+		return nil
+	}
+	return rule
+}
+
+type UpcomingOccurrence struct {
+	Seq    int                         `json:"seq"`
+	Date   time.Time                   `json:"date"`
+	Status string                      `json:"status"` // scheduled, pending or skipped
+	Edit   *models.RecurringOccurrence `json:"edit,omitempty"`
+}
+
+// ListRecurringOccurrences returns the occurrences already handled and the next ?count (default 12) ones
+func ListRecurringOccurrences(c *gin.Context) {
+	rule := findRecurringBill(c)
+	if c.IsAborted() {
+		return
+	}
+
+	count := 12
+	if value := c.Query("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > consts.MaxRecurringPreviewCount {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "count must be between 1 and " + strconv.Itoa(consts.MaxRecurringPreviewCount),
+			})
+			c.Abort()
+			return
+		}
+		count = n
+	}
+
+	var occurrences []models.RecurringOccurrence
+	if err := db.DB.Table(consts.RecurringOccurrenceTable).Where("rule_id = ?", rule.ID).Order("seq").Find(&occurrences).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list occurrences: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	history := []models.RecurringOccurrence{}
+	edits := map[int]*models.RecurringOccurrence{}
+	for i := range occurrences {
+		if occurrences[i].Seq < rule.Generated {
+			history = append(history, occurrences[i])
+		} else {
+			edits[occurrences[i].Seq] = &occurrences[i]
+		}
+	}
+
+	upcoming := []UpcomingOccurrence{}
+	for seq := rule.Generated; len(upcoming) < count && !rule.Ended(seq); seq++ {
+		item := UpcomingOccurrence{Seq: seq, Date: rule.Occurrence(seq), Status: "scheduled"}
+		if edit, ok := edits[seq]; ok {
+			item.Status = edit.Status
+			item.Edit = edit
+		}
+		upcoming = append(upcoming, item)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":    20000,
+		"message":  "List Recurring Occurrences Successfully",
+		"history":  history,
+		"upcoming": upcoming,
+	})
+}
+
+// the schedule itself cannot change, create a new rule for that
+type updateRecurringBillRequest struct {
+	Amount         *int    `json:"amount" binding:"omitnil,gt=0"`
+	Currency       *string `json:"currency" binding:"omitnil,iso4217"`
+	CategoryID     *uint   `json:"category_id" binding:"omitnil,gt=0"`
+	Category       *string `json:"category" binding:"omitnil,min=1"`
+	Description    *string `json:"description" binding:"omitnil,max=255"`
+	CounterpartyID *uint   `json:"counterparty_id" binding:"omitnil,gt=0"`
+	Object         *string `json:"object" binding:"omitnil,min=1"`
+	Username       *string `json:"username" binding:"omitnil,min=1"`
+	EndDate        *string `json:"end_date"` // "" removes the end date
+	Count          *int    `json:"count" binding:"omitnil,gte=0"`
+}
+
+// UpdateRecurringBill changes the bills generated from now on, generated bills stay as they are
+func UpdateRecurringBill(c *gin.Context) {
+	var req updateRecurringBillRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateRecurringBill Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	rule := findModifiableRecurringBill(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if req.Amount != nil {
+		rule.Amount = *req.Amount
+	}
+	if req.Currency != nil {
+		rule.Currency = *req.Currency
+	}
+	if req.Description != nil {
+		rule.Description = *req.Description
+	}
+	if req.Username != nil {
+		rule.Username = *req.Username
+	}
+	if req.Count != nil {
+		rule.Count = *req.Count
+	}
+	if req.EndDate != nil {
+		rule.EndDate = nil
+		if *req.EndDate != "" {
+			endDate, err := time.Parse(consts.TimeFormat, *req.EndDate)
+			if err != nil || endDate.Before(rule.StartDate) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"errno":   40001,
+					"message": "end_date must be like 2006-01-02 15:04:05 and not before start_date",
+				})
+				c.Abort()
+				return
+			}
+			rule.EndDate = &endDate
+		}
+	}
+	rule.NextDate = db.NextRecurringDate(rule)
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if req.CategoryID != nil || req.Category != nil {
+			var categoryID uint
+			var name string
+			if req.CategoryID != nil {
+				categoryID = *req.CategoryID
+			} else {
+				name = *req.Category
+			}
+			category, err := resolveBillCategory(tx, rule.FamilyID, rule.Type, categoryID, name)
+			if err != nil {
+				return err
+			}
+			rule.CategoryID = category.ID
+			rule.Category = category.Name
+		}
+		if req.CounterpartyID != nil || req.Object != nil {
+			var counterpartyID uint
+			var name string
+			if req.CounterpartyID != nil {
+				counterpartyID = *req.CounterpartyID
+			} else {
+				name = *req.Object
+			}
+			counterparty, err := resolveBillCounterparty(tx, rule.FamilyID, counterpartyID, name)
+			if err != nil {
+				return err
+			}
+			rule.CounterpartyID = counterparty.ID
+			rule.Object = counterparty.Name
+		}
+		return tx.Table(consts.RecurringBillTable).Save(rule).Error
+	})
+	if err != nil {
+		billSaveErrorResponse(c, err, "failed to update recurring bill: ")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Update Recurring Bill Successfully",
+		"data":    rule,
+	})
+}
+
+func PauseRecurringBill(c *gin.Context) {
+	rule := findModifiableRecurringBill(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if err := db.DB.Table(consts.RecurringBillTable).Where("id = ? AND paused_at IS NULL", rule.ID).Update("paused_at", time.Now()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to pause recurring bill: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "recurring bill paused successfully",
+	})
+}
+
+// ResumeRecurringBill does not catch up the occurrences missed while paused, that is what pausing is for
+func ResumeRecurringBill(c *gin.Context) {
+	rule := findModifiableRecurringBill(c)
+	if c.IsAborted() {
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.RecurringBillTable).Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", rule.ID).First(rule).Error; err != nil {
+			return err
+		}
+		if rule.PausedAt == nil {
+			return nil
+		}
+
+		now := db.BillNow()
+		for !rule.Ended(rule.Generated) && !rule.Occurrence(rule.Generated).After(now) {
+			rule.Generated++
+		}
+
+		return tx.Table(consts.RecurringBillTable).Where("id = ?", rule.ID).Updates(map[string]interface{}{
+			"paused_at": nil,
+			"generated": rule.Generated,
+			"next_date": db.NextRecurringDate(rule),
+		}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to resume recurring bill: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "recurring bill resumed successfully",
+	})
+}
+
+// DeleteRecurringBill stops the rule, the bills it generated are kept
+func DeleteRecurringBill(c *gin.Context) {
+	rule := findModifiableRecurringBill(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if err := db.DB.Table(consts.RecurringBillTable).Where("id = ?", rule.ID).Delete(&models.RecurringBill{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete recurring bill: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "recurring bill deleted successfully",
+	})
+}
+
+var errOccurrenceNotUpcoming = errors.New("occurrence is already generated or after the end of the rule")
+
+type occurrenceRequest struct {
+	Seq int `json:"seq" binding:"gte=0"`
+}
+
+// changeOccurrence saves occurrence seq of the rule with fn applied, only before it is generated.
+// An empty status after fn removes the row.
+func changeOccurrence(c *gin.Context, seq int, fn func(occurrence *models.RecurringOccurrence)) {
+	rule := findModifiableRecurringBill(c)
+	if c.IsAborted() {
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		// lock against the scheduler generating it meanwhile
+		if err := tx.Table(consts.RecurringBillTable).Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", rule.ID).First(rule).Error; err != nil {
+			return err
+		}
+		if seq < rule.Generated || rule.Ended(seq) {
+			return errOccurrenceNotUpcoming
+		}
+
+		occurrence := &models.RecurringOccurrence{}
+		if err := tx.Table(consts.RecurringOccurrenceTable).Where("rule_id = ? AND seq = ?", rule.ID, seq).Limit(1).Find(occurrence).Error; err != nil {
+			return err
+		}
+		occurrence.RuleID = rule.ID
+		occurrence.Seq = seq
+		occurrence.Date = rule.Occurrence(seq)
+
+		fn(occurrence)
+		if occurrence.Status == "" {
+			if occurrence.ID == 0 {
+				return nil
+			}
+			return tx.Table(consts.RecurringOccurrenceTable).Where("id = ?", occurrence.ID).Delete(&models.RecurringOccurrence{}).Error
+		}
+		return tx.Table(consts.RecurringOccurrenceTable).Save(occurrence).Error
+	})
+	if err != nil {
+		if errors.Is(err, errOccurrenceNotUpcoming) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40003,
+				"message": err.Error(),
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to change occurrence: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "occurrence changed successfully",
+	})
+}
+
+// SkipOccurrence makes the scheduler pass over one occurrence
+func SkipOccurrence(c *gin.Context) {
+	var req occurrenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind SkipOccurrence Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	changeOccurrence(c, req.Seq, func(occurrence *models.RecurringOccurrence) {
+		occurrence.Status = consts.OccurrenceSkipped
+	})
+}
+
+type editOccurrenceRequest struct {
+	Seq         int     `json:"seq" binding:"gte=0"`
+	Amount      *int    `json:"amount" binding:"omitnil,gt=0"`
+	Description *string `json:"description" binding:"omitnil,max=255"`
+	Date        *string `json:"date"` // date of the bill, the occurrence is still generated on schedule
+}
+
+// EditOccurrence changes amount, description or date of the bill of one occurrence
+func EditOccurrence(c *gin.Context) {
+	var req editOccurrenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind EditOccurrence Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	if req.Amount == nil && req.Description == nil && req.Date == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40004,
+			"message": errNothingToUpdate.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	var billDate *time.Time
+	if req.Date != nil {
+		date, err := time.Parse(consts.TimeFormat, *req.Date)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		billDate = &date
+	}
+
+	changeOccurrence(c, req.Seq, func(occurrence *models.RecurringOccurrence) {
+		occurrence.Status = consts.OccurrencePending
+		if req.Amount != nil {
+			occurrence.Amount = req.Amount
+		}
+		if req.Description != nil {
+			occurrence.Description = req.Description
+		}
+		if billDate != nil {
+			occurrence.BillDate = billDate
+		}
+	})
+}
+
+// ResetOccurrence undoes SkipOccurrence and EditOccurrence
+func ResetOccurrence(c *gin.Context) {
+	var req occurrenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind ResetOccurrence Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	changeOccurrence(c, req.Seq, func(occurrence *models.RecurringOccurrence) {
+		occurrence.Status = ""
+	})
+}
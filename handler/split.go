@@ -0,0 +1,679 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	errSplitInvalid       = errors.New("invalid split")
+	errSplitNotExpense    = errors.New("only expense bills can be split")
+	errSplitMember        = errors.New("payer and split members must be members of the family")
+	errSplitAmountChanged = errors.New("amount of a bill split by exact amounts changed, send the split again")
+)
+
+type billSplitMember struct {
+	UserID uint `json:"user_id" binding:"required"`
+	Shares int  `json:"shares" binding:"gte=0"` // share mode
+	Amount int  `json:"amount" binding:"gte=0"` // exact mode, 分
+}
+
+// billSplitRequest splits an expense, mode none removes the split of a bill
+type billSplitRequest struct {
+	Mode    string            `json:"mode" binding:"required,oneof=equal share exact none"`
+	PayerID uint              `json:"payer_id"` // defaults to the payer so far, then to the current user
+	Members []billSplitMember `json:"members" binding:"omitempty,dive"`
+}
+
+// computeSplits divides amount between the members, in equal and share mode the
+// cents that cannot be divided go one by one to the largest remainders
+func computeSplits(amount int, mode string, members []billSplitMember) ([]models.BillSplit, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("%w: no members", errSplitInvalid)
+	}
+	if len(members) > consts.MaxSplitMembers {
+		return nil, fmt.Errorf("%w: at most %d members", errSplitInvalid, consts.MaxSplitMembers)
+	}
+
+	seen := map[uint]bool{}
+	for _, member := range members {
+		if seen[member.UserID] {
+			return nil, fmt.Errorf("%w: user %d appears twice", errSplitInvalid, member.UserID)
+		}
+		seen[member.UserID] = true
+	}
+
+	splits := make([]models.BillSplit, len(members))
+	for i, member := range members {
+		splits[i].UserID = member.UserID
+	}
+
+	switch mode {
+	case consts.SplitExact:
+		sum := 0
+		for i, member := range members {
+			if member.Amount <= 0 {
+				return nil, fmt.Errorf("%w: amount of user %d must be greater than 0", errSplitInvalid, member.UserID)
+			}
+			splits[i].Amount = member.Amount
+			sum += member.Amount
+		}
+		if sum != amount {
+			return nil, fmt.Errorf("%w: amounts add up to %d, the bill is %d", errSplitInvalid, sum, amount)
+		}
+		return splits, nil
+
+	case consts.SplitEqual, consts.SplitShare:
+		weights := make([]int64, len(members))
+		userIDs := make([]uint, len(members))
+		for i, member := range members {
+			shares := 1
+			if mode == consts.SplitShare {
+				if member.Shares <= 0 {
+					return nil, fmt.Errorf("%w: shares of user %d must be greater than 0", errSplitInvalid, member.UserID)
+				}
+				shares = member.Shares
+			}
+			splits[i].Shares = shares
+			weights[i], userIDs[i] = int64(shares), member.UserID
+		}
+
+		for i, part := range distributeByWeight(int64(amount), weights, userIDs) {
+			splits[i].Amount = int(part)
+		}
+		return splits, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown mode %q", errSplitInvalid, mode)
+}
+
+// distributeByWeight divides amount in proportion to weights, the cents that cannot be
+// divided go one by one to the largest remainders, ties to the lower user id
+func distributeByWeight(amount int64, weights []int64, userIDs []uint) []int64 {
+	parts := make([]int64, len(weights))
+	var total int64
+	for _, weight := range weights {
+		total += weight
+	}
+	if total == 0 {
+		return parts
+	}
+
+	remainders := make([]int64, len(weights))
+	left := amount
+	for i, weight := range weights {
+		part := amount * weight
+		parts[i] = part / total
+		remainders[i] = part % total
+		left -= parts[i]
+	}
+
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		if remainders[order[a]] != remainders[order[b]] {
+			return remainders[order[a]] > remainders[order[b]]
+		}
+		return userIDs[order[a]] < userIDs[order[b]]
+	})
+	for i := int64(0); i < left; i++ {
+		parts[order[i]]++
+	}
+	return parts
+}
+
+// checkFamilyMembers fails with errSplitMember unless every user is a member of the family
+func checkFamilyMembers(tx *gorm.DB, familyID uint, userIDs []uint) error {
+	unique := uniqueIDs(userIDs)
+	var count int64
+	if err := tx.Table(consts.FamilyUserTable).
+		Where("family_id = ? AND user_id IN ? AND deleted_at IS NULL", familyID, unique).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if int(count) != len(unique) {
+		return errSplitMember
+	}
+	return nil
+}
+
+// applyBillSplit checks req against the bill and sets PayerID and SplitMode,
+// the returned splits must be saved with setBillSplits after the bill
+func applyBillSplit(tx *gorm.DB, bill *models.Bill, req *billSplitRequest, userID uint) ([]models.BillSplit, error) {
+	if req.Mode == "none" {
+		bill.PayerID = 0
+		bill.SplitMode = ""
+		return []models.BillSplit{}, nil
+	}
+	if bill.Type != consts.BillTypeExpense {
+		return nil, errSplitNotExpense
+	}
+
+	splits, err := computeSplits(bill.Amount, req.Mode, req.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	payerID := req.PayerID
+	if payerID == 0 {
+		payerID = bill.PayerID
+	}
+	if payerID == 0 {
+		payerID = userID
+	}
+	userIDs := []uint{payerID}
+	for _, split := range splits {
+		userIDs = append(userIDs, split.UserID)
+	}
+	if err := checkFamilyMembers(tx, bill.FamilyID, userIDs); err != nil {
+		return nil, err
+	}
+
+	bill.PayerID = payerID
+	bill.SplitMode = req.Mode
+	return splits, nil
+}
+
+// resplitBill recomputes the stored split of a bill whose amount or type changed
+func resplitBill(bill *models.Bill, old []models.BillSplit) ([]models.BillSplit, error) {
+	if bill.Type != consts.BillTypeExpense {
+		return nil, errSplitNotExpense
+	}
+	if bill.SplitMode == consts.SplitExact {
+		return nil, errSplitAmountChanged
+	}
+
+	members := make([]billSplitMember, 0, len(old))
+	for _, split := range old {
+		members = append(members, billSplitMember{UserID: split.UserID, Shares: split.Shares})
+	}
+	return computeSplits(bill.Amount, bill.SplitMode, members)
+}
+
+func billSplits(tx *gorm.DB, billID uint) ([]models.BillSplit, error) {
+	splits := []models.BillSplit{}
+	err := tx.Table(consts.BillSplitTable).Where("bill_id = ?", billID).Order("user_id").Find(&splits).Error
+	return splits, err
+}
+
+// setBillSplits replaces the split of a bill
+func setBillSplits(tx *gorm.DB, bill *models.Bill, splits []models.BillSplit) error {
+	if err := tx.Table(consts.BillSplitTable).Where("bill_id = ?", bill.ID).Delete(&models.BillSplit{}).Error; err != nil {
+		return err
+	}
+	if len(splits) == 0 {
+		return nil
+	}
+
+	for i := range splits {
+		splits[i].ID = 0
+		splits[i].BillID = bill.ID
+		splits[i].FamilyID = bill.FamilyID
+	}
+	sort.Slice(splits, func(i, j int) bool { return splits[i].UserID < splits[j].UserID })
+	return tx.Table(consts.BillSplitTable).Create(&splits).Error
+}
+
+type splitShare struct {
+	UserID uint `json:"user_id"`
+	Amount int  `json:"amount"`
+	Shares int  `json:"shares"`
+}
+
+// splitShares is the form of a split kept in bill revisions
+func splitShares(splits []models.BillSplit) []splitShare {
+	shares := make([]splitShare, 0, len(splits))
+	for _, split := range splits {
+		shares = append(shares, splitShare{UserID: split.UserID, Amount: split.Amount, Shares: split.Shares})
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].UserID < shares[j].UserID })
+	return shares
+}
+
+func equalSplits(a []models.BillSplit, b []models.BillSplit) bool {
+	x, y := splitShares(a), splitShares(b)
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// loadBillSplits fills Bill.Splits
+func loadBillSplits(tx *gorm.DB, bills []models.Bill) error {
+	if len(bills) == 0 {
+		return nil
+	}
+
+	billIDs := make([]uint, 0, len(bills))
+	for _, bill := range bills {
+		billIDs = append(billIDs, bill.ID)
+	}
+
+	var rows []models.BillSplit
+	if err := tx.Table(consts.BillSplitTable).Where("bill_id IN ?", billIDs).Order("user_id").Find(&rows).Error; err != nil {
+		return err
+	}
+
+	splits := map[uint][]models.BillSplit{}
+	for _, row := range rows {
+		splits[row.BillID] = append(splits[row.BillID], row)
+	}
+	for i := range bills {
+		bills[i].Splits = splits[bills[i].ID]
+		if bills[i].Splits == nil {
+			bills[i].Splits = []models.BillSplit{}
+		}
+	}
+	return nil
+}
+
+// MemberBalance is in the base currency, positive when the others owe the member money
+type MemberBalance struct {
+	UserID     uint   `json:"user_id"`
+	Username   string `json:"username"`
+	Paid       int64  `json:"paid"`        // split bills the member paid
+	Owed       int64  `json:"owed"`        // shares of split bills the member has to bear
+	SettledOut int64  `json:"settled_out"` // settlements the member paid
+	SettledIn  int64  `json:"settled_in"`  // settlements the member received
+	Net        int64  `json:"net"`
+	Left       bool   `json:"left"` // no longer a member, can still settle until the balance is zero
+}
+
+type SettleUpTransfer struct {
+	FromUserID uint  `json:"from_user_id"`
+	ToUserID   uint  `json:"to_user_id"`
+	Amount     int64 `json:"amount"`
+}
+
+// splitBill is a split bill with the amount in the base currency its shares are divided in
+type splitBill struct {
+	ID         uint
+	PayerID    uint
+	BaseAmount *int64
+}
+
+// convertSplits divides the base amount of every bill between its shares like computeSplits divides the amount,
+// so what payers paid and what members owe add up to the same. Bills without an exchange rate are left out and counted.
+func convertSplits(bills []splitBill, splits []models.BillSplit) (paid map[uint]int64, owed map[uint]int64, unconverted int) {
+	paid, owed = map[uint]int64{}, map[uint]int64{}
+	billSplits := map[uint][]models.BillSplit{}
+	for _, split := range splits {
+		billSplits[split.BillID] = append(billSplits[split.BillID], split)
+	}
+
+	for _, bill := range bills {
+		shares := billSplits[bill.ID]
+		if len(shares) == 0 {
+			continue
+		}
+		if bill.BaseAmount == nil {
+			unconverted++
+			continue
+		}
+
+		weights := make([]int64, len(shares))
+		userIDs := make([]uint, len(shares))
+		for i, share := range shares {
+			weights[i], userIDs[i] = int64(share.Amount), share.UserID
+		}
+		paid[bill.PayerID] += *bill.BaseAmount
+		for i, part := range distributeByWeight(*bill.BaseAmount, weights, userIDs) {
+			owed[userIDs[i]] += part
+		}
+	}
+	return paid, owed, unconverted
+}
+
+// familyBalances sums split bills in the base currency and returns how many split bills were left out because
+// they have no exchange rate. Bills in trash are left out, members who left keep their balance.
+func familyBalances(tx *gorm.DB, familyID uint) ([]MemberBalance, int, error) {
+	type userSum struct {
+		UserID uint
+		Total  int64
+	}
+	balances := map[uint]*MemberBalance{}
+	balance := func(userID uint) *MemberBalance {
+		if balances[userID] == nil {
+			balances[userID] = &MemberBalance{UserID: userID}
+		}
+		return balances[userID]
+	}
+
+	var bills []splitBill
+	if err := tx.Table(consts.BillTable).
+		Select("id, payer_id, base_amount").
+		Where("family_id = ? AND split_mode <> '' AND deleted_at IS NULL", familyID).
+		Scan(&bills).Error; err != nil {
+		return nil, 0, err
+	}
+	var splits []models.BillSplit
+	if err := tx.Table(consts.BillSplitTable).
+		Joins("JOIN bill ON bill.id = bill_split.bill_id AND bill.deleted_at IS NULL").
+		Where("bill_split.family_id = ?", familyID).
+		Order("bill_split.bill_id, bill_split.user_id").
+		Select("bill_split.*").Find(&splits).Error; err != nil {
+		return nil, 0, err
+	}
+	var out, in []userSum
+	if err := tx.Table(consts.SettlementTable).
+		Select("from_user_id AS user_id, SUM(amount) AS total").
+		Where("family_id = ? AND deleted_at IS NULL", familyID).
+		Group("from_user_id").Scan(&out).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := tx.Table(consts.SettlementTable).
+		Select("to_user_id AS user_id, SUM(amount) AS total").
+		Where("family_id = ? AND deleted_at IS NULL", familyID).
+		Group("to_user_id").Scan(&in).Error; err != nil {
+		return nil, 0, err
+	}
+
+	paid, owed, unconverted := convertSplits(bills, splits)
+	for userID, total := range paid {
+		balance(userID).Paid += total
+	}
+	for userID, total := range owed {
+		balance(userID).Owed += total
+	}
+	for _, row := range out {
+		balance(row.UserID).SettledOut += row.Total
+	}
+	for _, row := range in {
+		balance(row.UserID).SettledIn += row.Total
+	}
+
+	// members without any split bill are listed too
+	var memberIDs []uint
+	if err := tx.Table(consts.FamilyUserTable).Where("family_id = ? AND deleted_at IS NULL", familyID).Pluck("user_id", &memberIDs).Error; err != nil {
+		return nil, 0, err
+	}
+	members := map[uint]bool{}
+	for _, userID := range memberIDs {
+		members[userID] = true
+		balance(userID)
+	}
+
+	userIDs := make([]uint, 0, len(balances))
+	for userID := range balances {
+		userIDs = append(userIDs, userID)
+	}
+	var users []models.User
+	if len(userIDs) > 0 {
+		if err := tx.Table(consts.UserTable).Unscoped().Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+			return nil, 0, err
+		}
+	}
+	for _, user := range users {
+		balances[user.ID].Username = user.Username
+	}
+
+	result := make([]MemberBalance, 0, len(balances))
+	for _, balance := range balances {
+		balance.Net = balance.Paid - balance.Owed + balance.SettledOut - balance.SettledIn
+		balance.Left = !members[balance.UserID]
+		result = append(result, *balance)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UserID < result[j].UserID })
+	return result, unconverted, nil
+}
+
+// checkSettlementParties fails with errSplitMember unless every user is a member of the family,
+// or left it with a balance still to settle
+func checkSettlementParties(balances []MemberBalance, userIDs []uint) error {
+	byUser := map[uint]MemberBalance{}
+	for _, balance := range balances {
+		byUser[balance.UserID] = balance
+	}
+	for _, userID := range userIDs {
+		balance, ok := byUser[userID]
+		if !ok || (balance.Left && balance.Net == 0) {
+			return errSplitMember
+		}
+	}
+	return nil
+}
+
+// settleUp pays the largest debt to the largest credit until all balances are zero,
+// it needs at most one transfer less than the members with a balance
+func settleUp(balances []MemberBalance) []SettleUpTransfer {
+	var debtors, creditors []MemberBalance
+	for _, balance := range balances {
+		switch {
+		case balance.Net < 0:
+			debtors = append(debtors, balance)
+		case balance.Net > 0:
+			creditors = append(creditors, balance)
+		}
+	}
+	sort.SliceStable(debtors, func(i, j int) bool { return debtors[i].Net < debtors[j].Net })
+	sort.SliceStable(creditors, func(i, j int) bool { return creditors[i].Net > creditors[j].Net })
+
+	transfers := []SettleUpTransfer{}
+	i, j := 0, 0
+	for i < len(debtors) && j < len(creditors) {
+		amount := min(-debtors[i].Net, creditors[j].Net)
+		transfers = append(transfers, SettleUpTransfer{
+			FromUserID: debtors[i].UserID,
+			ToUserID:   creditors[j].UserID,
+			Amount:     amount,
+		})
+		debtors[i].Net += amount
+		creditors[j].Net -= amount
+		if debtors[i].Net == 0 {
+			i++
+		}
+		if creditors[j].Net == 0 {
+			j++
+		}
+	}
+	return transfers
+}
+
+// SplitBalances returns the balance of every member and the transfers that settle them,
+// unconverted counts the split bills left out because they have no exchange rate
+func SplitBalances(c *gin.Context) {
+	balances, unconverted, err := familyBalances(db.DB, c.GetUint("family_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to compute balances: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Split Balances Successfully",
+		"data": gin.H{
+			"balances":    balances,
+			"transfers":   settleUp(balances),
+			"unconverted": unconverted,
+		},
+		"base_currency": baseCurrency(c),
+	})
+}
+
+type createSettlementRequest struct {
+	FromUserID uint   `json:"from_user_id" binding:"required"`
+	ToUserID   uint   `json:"to_user_id" binding:"required,nefield=FromUserID"`
+	Amount     int    `json:"amount" binding:"required,gt=0"`
+	Date       string `json:"date"` // defaults to now
+	Note       string `json:"note" binding:"max=255"`
+}
+
+// CreateSettlement records money paid back, members can only record the ones they take part in.
+// A member who left can still be paid or pay until their balance is settled.
+func CreateSettlement(c *gin.Context) {
+	var req createSettlementRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateSettlement Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	familyUser := currentFamilyUser(c)
+	if !familyUser.Can(consts.FamilyManager) && req.FromUserID != familyUser.UserID && req.ToUserID != familyUser.UserID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can record settlements between others",
+		})
+		c.Abort()
+		return
+	}
+
+	settlement := models.NewSettlement()
+	settlement.FamilyID = c.GetUint("family_id")
+	settlement.FromUserID = req.FromUserID
+	settlement.ToUserID = req.ToUserID
+	settlement.Amount = req.Amount
+	settlement.Note = req.Note
+	settlement.CreatedBy = familyUser.UserID
+	settlement.Date = db.BillNow()
+	if req.Date != "" {
+		date, err := time.Parse(consts.TimeFormat, req.Date)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		settlement.Date = date
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		balances, _, err := familyBalances(tx, settlement.FamilyID)
+		if err != nil {
+			return err
+		}
+		if err := checkSettlementParties(balances, []uint{req.FromUserID, req.ToUserID}); err != nil {
+			return err
+		}
+		return tx.Table(consts.SettlementTable).Create(settlement).Error
+	})
+	if errors.Is(err, errSplitMember) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": "both users must be members of the family, or have left it with a balance to settle",
+		})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save settlement: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Create Settlement Successfully",
+		"data":    settlement,
+	})
+}
+
+// ListSettlements lists the settlements of the family, ?user_id= for the ones a user takes part in
+func ListSettlements(c *gin.Context) {
+	query := db.DB.Table(consts.SettlementTable).Where("family_id = ? AND deleted_at IS NULL", c.GetUint("family_id"))
+	if value := c.Query("user_id"); value != "" {
+		userID, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "invalid user_id: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		query = query.Where("from_user_id = ? OR to_user_id = ?", uint(userID), uint(userID))
+	}
+
+	settlements := []models.Settlement{}
+	if err := query.Order("date DESC, id DESC").Find(&settlements).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list settlements: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Settlements Successfully",
+		"data":    settlements,
+	})
+}
+
+// DeleteSettlement can be done by managers and by whoever recorded the settlement
+func DeleteSettlement(c *gin.Context) {
+	settlementID, err := strconv.ParseUint(c.Param("settlement_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid settlement_id: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	settlement := models.NewSettlement()
+	if err := db.DB.Table(consts.SettlementTable).
+		Where("id = ? AND family_id = ? AND deleted_at IS NULL", uint(settlementID), c.GetUint("family_id")).
+		First(settlement).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "settlement not found: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	familyUser := currentFamilyUser(c)
+	if !familyUser.Can(consts.FamilyManager) && settlement.CreatedBy != familyUser.UserID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can delete settlements recorded by others",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := db.DB.Table(consts.SettlementTable).Where("id = ?", settlement.ID).Delete(&models.Settlement{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete settlement: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "settlement deleted successfully",
+	})
+}
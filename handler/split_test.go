@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"errors"
+	"github.com/hewo233/hdu-dx2/models"
+	"testing"
+)
+
+func memberBalance(userID uint, paid, owed, settledOut, settledIn int64, left bool) MemberBalance {
+	return MemberBalance{
+		UserID:     userID,
+		Paid:       paid,
+		Owed:       owed,
+		SettledOut: settledOut,
+		SettledIn:  settledIn,
+		Net:        paid - owed + settledOut - settledIn,
+		Left:       left,
+	}
+}
+
+// user 1 paid a bill of 900 split equally with 2 and 3, then 3 was removed from the family
+func TestSettleRemovedMember(t *testing.T) {
+	balances := []MemberBalance{
+		memberBalance(1, 900, 300, 0, 0, false),
+		memberBalance(2, 0, 300, 0, 0, false),
+		memberBalance(3, 0, 300, 0, 0, true),
+	}
+
+	transfers := settleUp(balances)
+	found := false
+	for _, transfer := range transfers {
+		if transfer.FromUserID == 3 && transfer.ToUserID == 1 && transfer.Amount == 300 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("settleUp(%v) = %v, want a transfer of 300 from 3 to 1", balances, transfers)
+	}
+
+	if err := checkSettlementParties(balances, []uint{3, 1}); err != nil {
+		t.Fatalf("settling the debt of a removed member failed: %v", err)
+	}
+	if err := checkSettlementParties(balances, []uint{4, 1}); !errors.Is(err, errSplitMember) {
+		t.Fatalf("settling with a user who never was a member: error = %v, want errSplitMember", err)
+	}
+
+	// after 3 paid back 300 to 1
+	balances = []MemberBalance{
+		memberBalance(1, 900, 300, 0, 300, false),
+		memberBalance(2, 0, 300, 0, 0, false),
+		memberBalance(3, 0, 300, 300, 0, true),
+	}
+	if err := checkSettlementParties(balances, []uint{3, 1}); !errors.Is(err, errSplitMember) {
+		t.Fatalf("settling again with a removed member without balance: error = %v, want errSplitMember", err)
+	}
+	if err := checkSettlementParties(balances, []uint{2, 1}); err != nil {
+		t.Fatalf("settling between members failed: %v", err)
+	}
+
+	transfers = settleUp(balances)
+	if len(transfers) != 1 || transfers[0] != (SettleUpTransfer{FromUserID: 2, ToUserID: 1, Amount: 300}) {
+		t.Fatalf("settleUp(%v) = %v, want only 300 from 2 to 1", balances, transfers)
+	}
+}
+
+func TestComputeSplitsEqual(t *testing.T) {
+	splits, err := computeSplits(100, "equal", []billSplitMember{{UserID: 3}, {UserID: 1}, {UserID: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint]int{1: 34, 2: 33, 3: 33}
+	for _, split := range splits {
+		if split.Amount != want[split.UserID] {
+			t.Errorf("user %d gets %d, want %d", split.UserID, split.Amount, want[split.UserID])
+		}
+	}
+}
+
+// balances of bills in a foreign currency net to zero, bills without an exchange rate are left out
+func TestConvertSplits(t *testing.T) {
+	base := func(amount int64) *int64 { return &amount }
+	bills := []splitBill{
+		{ID: 1, PayerID: 1, BaseAmount: base(7001)}, // 10.00 USD at 7.001
+		{ID: 2, PayerID: 2, BaseAmount: base(1)},
+		{ID: 3, PayerID: 3, BaseAmount: nil},
+	}
+	splits := []models.BillSplit{
+		{BillID: 1, UserID: 1, Amount: 334},
+		{BillID: 1, UserID: 2, Amount: 333},
+		{BillID: 1, UserID: 3, Amount: 333},
+		{BillID: 2, UserID: 1, Amount: 1},
+		{BillID: 2, UserID: 3, Amount: 1},
+		{BillID: 3, UserID: 1, Amount: 500},
+		{BillID: 3, UserID: 2, Amount: 500},
+	}
+
+	paid, owed, unconverted := convertSplits(bills, splits)
+	if unconverted != 1 {
+		t.Errorf("unconverted = %d, want 1", unconverted)
+	}
+	var balances []MemberBalance
+	var sum int64
+	for _, userID := range []uint{1, 2, 3} {
+		balance := memberBalance(userID, paid[userID], owed[userID], 0, 0, false)
+		balances = append(balances, balance)
+		sum += balance.Net
+	}
+	if sum != 0 {
+		t.Fatalf("balances %v add up to %d, want 0", balances, sum)
+	}
+
+	transfers := settleUp(balances)
+	for _, transfer := range transfers {
+		for i := range balances {
+			if balances[i].UserID == transfer.FromUserID {
+				balances[i].Net += transfer.Amount
+			}
+			if balances[i].UserID == transfer.ToUserID {
+				balances[i].Net -= transfer.Amount
+			}
+		}
+	}
+	for _, balance := range balances {
+		if balance.Net != 0 {
+			t.Errorf("user %d is left with %d after %v", balance.UserID, balance.Net, transfers)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/period"
+	"gorm.io/gorm"
+	"math"
+	"net/http"
+	"time"
+)
+
+var errTooManyPeriods = errors.New("too many periods, use a longer period or a shorter date range")
+
+// statsUnits are the calendar units of the periods of statistics
+var statsUnits = map[string]period.Unit{
+	consts.StatsDay:   period.Day,
+	consts.StatsWeek:  period.Week,
+	consts.StatsMonth: period.Month,
+	consts.StatsYear:  period.Year,
+}
+
+// statsPeriodStart returns the start of the period containing t, the same periods as date_trunc
+func statsPeriodStart(t time.Time, p string) time.Time {
+	return period.Start(t, statsUnits[p])
+}
+
+// statsPeriodEnd returns the end of the period starting at start, exclusive
+func statsPeriodEnd(start time.Time, p string) time.Time {
+	return period.End(start, statsUnits[p])
+}
+
+// statsPeriod reads ?period=, day, week, month (default) or year
+func statsPeriod(c *gin.Context) (string, bool) {
+	period := c.DefaultQuery("period", consts.StatsMonth)
+	switch period {
+	case consts.StatsDay, consts.StatsWeek, consts.StatsMonth, consts.StatsYear:
+		return period, true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"errno":   40001,
+		"message": "period must be one of day, week, month, year",
+	})
+	c.Abort()
+	return "", false
+}
+
+// statsBills is the bills of the family matching the filters of SelectBills, aborts on invalid filters
+func statsBills(c *gin.Context) *gorm.DB {
+	query, err := applyBillFilters(c, billQuery(c.GetUint("family_id")))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "invalid statistics filter: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+	return query
+}
+
+// percentOf is part of total in percent with one decimal, 0 when total is 0
+func percentOf(part int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(part)*1000/float64(total)) / 10
+}
+
+// PeriodSummary is what the bills of one period add up to, in 分 of the base currency
+type PeriodSummary struct {
+	Period      time.Time `json:"period"` // start of the period
+	Count       int64     `json:"count"`
+	Income      int64     `json:"income"`
+	Expense     int64     `json:"expense"`
+	Net         int64     `json:"net"`
+	Unconverted int64     `json:"unconverted"` // bills left out of the sums, their currency has no exchange rate
+}
+
+// StatsSummary sums the bills per day, week, month or year with the filters of SelectBills.
+// The periods between the first and the last one with bills are all returned, the empty ones as zeros.
+func StatsSummary(c *gin.Context) {
+	period, ok := statsPeriod(c)
+	if !ok {
+		return
+	}
+	query := statsBills(c)
+	if c.IsAborted() {
+		return
+	}
+
+	var rows []PeriodSummary
+	if err := query.
+		Select("date_trunc('" + period + "', bill.date AT TIME ZONE 'UTC') AS period, " + billSumsSQL).
+		Group("period").Order("period").
+		Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to sum bills: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	summaries := []PeriodSummary{}
+	for i, row := range rows {
+		if i > 0 {
+			for start := statsPeriodEnd(rows[i-1].Period, period); start.Before(row.Period); start = statsPeriodEnd(start, period) {
+				summaries = append(summaries, PeriodSummary{Period: start})
+				if len(summaries) > consts.MaxStatsPeriods {
+					break
+				}
+			}
+		}
+		row.Net = row.Income - row.Expense
+		summaries = append(summaries, row)
+		if len(summaries) > consts.MaxStatsPeriods {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40003,
+				"message": errTooManyPeriods.Error(),
+			})
+			c.Abort()
+			return
+		}
+	}
+
+	var totals PeriodSummary
+	for _, summary := range summaries {
+		totals.Count += summary.Count
+		totals.Income += summary.Income
+		totals.Expense += summary.Expense
+		totals.Unconverted += summary.Unconverted
+	}
+	totals.Net = totals.Income - totals.Expense
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Stats Summary Successfully",
+		"data":    summaries,
+		"totals": gin.H{
+			"count":       totals.Count,
+			"income":      totals.Income,
+			"expense":     totals.Expense,
+			"net":         totals.Net,
+			"unconverted": totals.Unconverted,
+		},
+		"period":        period,
+		"base_currency": baseCurrency(c),
+	})
+}
+
+// CategoryStat is what the bills of one category add up to, in 分 of the base currency
+type CategoryStat struct {
+	Type        string  `json:"type"`
+	CategoryID  uint    `json:"category_id"`
+	Category    string  `json:"category"`
+	ParentID    uint    `json:"parent_id"` // 0 for top level
+	Count       int64   `json:"count"`
+	Amount      int64   `json:"amount"`
+	Unconverted int64   `json:"unconverted"`
+	Percent     float64 `json:"percent"` // of the amount of every bill of the type
+}
+
+// StatsCategories sums the bills per category, largest first, with the filters of SelectBills.
+// ?rollup=true adds subcategories into their top level category.
+func StatsCategories(c *gin.Context) {
+	query := statsBills(c)
+	if c.IsAborted() {
+		return
+	}
+
+	query = query.Joins("LEFT JOIN " + consts.CategoryTable + " ON category.id = bill.category_id")
+	if c.Query("rollup") == "true" {
+		query = query.Joins("LEFT JOIN " + consts.CategoryTable + " AS parent ON parent.id = category.parent_id").
+			Select("bill.type, CASE WHEN category.parent_id > 0 THEN category.parent_id ELSE bill.category_id END AS category_id, " +
+				"COALESCE(MAX(parent.name), MAX(bill.category)) AS category, 0 AS parent_id, " +
+				"COUNT(*) AS count, COALESCE(SUM(bill.base_amount), 0) AS amount, COUNT(*) - COUNT(bill.base_amount) AS unconverted").
+			Group("bill.type, 2")
+	} else {
+		query = query.Select("bill.type, bill.category_id, MAX(bill.category) AS category, COALESCE(MAX(category.parent_id), 0) AS parent_id, " +
+			"COUNT(*) AS count, COALESCE(SUM(bill.base_amount), 0) AS amount, COUNT(*) - COUNT(bill.base_amount) AS unconverted").
+			Group("bill.type, bill.category_id")
+	}
+
+	stats := []CategoryStat{}
+	if err := query.Order("bill.type, amount DESC, count DESC, category_id").Scan(&stats).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to sum bills: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	totals := map[string]int64{}
+	for _, stat := range stats {
+		totals[stat.Type] += stat.Amount
+	}
+	for i := range stats {
+		stats[i].Percent = percentOf(stats[i].Amount, totals[stats[i].Type])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Stats Categories Successfully",
+		"data":    stats,
+		"totals": gin.H{
+			consts.BillTypeIncome:  totals[consts.BillTypeIncome],
+			consts.BillTypeExpense: totals[consts.BillTypeExpense],
+		},
+		"base_currency": baseCurrency(c),
+	})
+}
+
+// MemberStat is what the bills of one member add up to, in 分 of the base currency
+type MemberStat struct {
+	Username       string  `json:"username"`
+	Count          int64   `json:"count"`
+	Income         int64   `json:"income"`
+	Expense        int64   `json:"expense"`
+	Net            int64   `json:"net"`
+	Unconverted    int64   `json:"unconverted"`
+	IncomePercent  float64 `json:"income_percent"`  // of the income of every member
+	ExpensePercent float64 `json:"expense_percent"` // of the expense of every member
+}
+
+// StatsMembers sums the bills per member, the username of the bills, with the filters of SelectBills
+func StatsMembers(c *gin.Context) {
+	query := statsBills(c)
+	if c.IsAborted() {
+		return
+	}
+
+	stats := []MemberStat{}
+	if err := query.Select("bill.username, " + billSumsSQL).
+		Group("bill.username").
+		Order("expense DESC, income DESC, bill.username").
+		Scan(&stats).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to sum bills: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	var income, expense int64
+	for _, stat := range stats {
+		income += stat.Income
+		expense += stat.Expense
+	}
+	for i := range stats {
+		stats[i].Net = stats[i].Income - stats[i].Expense
+		stats[i].IncomePercent = percentOf(stats[i].Income, income)
+		stats[i].ExpensePercent = percentOf(stats[i].Expense, expense)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Stats Members Successfully",
+		"data":    stats,
+		"totals": gin.H{
+			"income":  income,
+			"expense": expense,
+			"net":     income - expense,
+		},
+		"base_currency": baseCurrency(c),
+	})
+}
+
+// PeriodTotals is what the bills of a period add up to, in 分 of the base currency
+type PeriodTotals struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"` // exclusive
+	Count       int64     `json:"count"`
+	Income      int64     `json:"income"`
+	Expense     int64     `json:"expense"`
+	Net         int64     `json:"net"`
+	Unconverted int64     `json:"unconverted"`
+}
+
+// PeriodChange compares a period with an earlier one, the percents are nil when the earlier amount is 0
+type PeriodChange struct {
+	Income         int64    `json:"income"`
+	Expense        int64    `json:"expense"`
+	Net            int64    `json:"net"`
+	IncomePercent  *float64 `json:"income_percent"`
+	ExpensePercent *float64 `json:"expense_percent"`
+}
+
+func changePercent(now int64, before int64) *float64 {
+	if before == 0 {
+		return nil
+	}
+	percent := math.Round(float64(now-before)*1000/math.Abs(float64(before))) / 10
+	return &percent
+}
+
+func comparePeriods(now *PeriodTotals, before *PeriodTotals) PeriodChange {
+	return PeriodChange{
+		Income:         now.Income - before.Income,
+		Expense:        now.Expense - before.Expense,
+		Net:            now.Net - before.Net,
+		IncomePercent:  changePercent(now.Income, before.Income),
+		ExpensePercent: changePercent(now.Expense, before.Expense),
+	}
+}
+
+// periodTotals sums the bills of query between start and end
+func periodTotals(query *gorm.DB, start time.Time, end time.Time) (*PeriodTotals, error) {
+	totals := &PeriodTotals{Start: start, End: end}
+	if err := query.Session(&gorm.Session{}).Where("bill.date >= ? AND bill.date < ?", start, end).
+		Select(billSumsSQL).Scan(totals).Error; err != nil {
+		return nil, err
+	}
+	totals.Start, totals.End = start, end
+	totals.Net = totals.Income - totals.Expense
+	return totals, nil
+}
+
+// StatsCompare compares the period containing ?date= (default now) with the period before it and with
+// the same period a year before, with the filters of SelectBills. The dates of the filters narrow every period.
+func StatsCompare(c *gin.Context) {
+	period, ok := statsPeriod(c)
+	if !ok {
+		return
+	}
+	at := db.BillNow()
+	if value := c.Query("date"); value != "" {
+		date, err := parseFilterDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		at = date
+	}
+	query := statsBills(c)
+	if c.IsAborted() {
+		return
+	}
+
+	start := statsPeriodStart(at, period)
+	previousStart := statsPeriodStart(start.Add(-time.Second), period)
+	lastYearStart := statsPeriodStart(start.AddDate(-1, 0, 0), period)
+
+	var totals [3]*PeriodTotals
+	var err error
+	for i, periodStart := range []time.Time{start, previousStart, lastYearStart} {
+		if totals[i], err = periodTotals(query, periodStart, statsPeriodEnd(periodStart, period)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to sum bills: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Stats Compare Successfully",
+		"data": gin.H{
+			"current":      totals[0],
+			"previous":     totals[1],
+			"last_year":    totals[2],
+			"vs_previous":  comparePeriods(totals[0], totals[1]),
+			"vs_last_year": comparePeriods(totals[0], totals[2]),
+		},
+		"period":        period,
+		"base_currency": baseCurrency(c),
+	})
+}
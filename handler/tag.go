@@ -0,0 +1,390 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	errTagNotFound  = errors.New("tag not found")
+	errTagNameTaken = errors.New("tag with the same name already exists")
+)
+
+// checkTagIDs returns the sorted unique ids, all of them must be tags of the family
+func checkTagIDs(tx *gorm.DB, familyID uint, tagIDs []uint) ([]uint, error) {
+	unique := uniqueIDs(tagIDs)
+	if len(unique) == 0 {
+		return unique, nil
+	}
+
+	var count int64
+	if err := tx.Table(consts.TagTable).Where("id IN ? AND family_id = ?", unique, familyID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if int(count) != len(unique) {
+		return nil, errTagNotFound
+	}
+	return unique, nil
+}
+
+// billTagIDs returns the sorted tag ids of a bill
+func billTagIDs(tx *gorm.DB, billID uint) ([]uint, error) {
+	tagIDs := []uint{}
+	err := tx.Table(consts.BillTagTable).Where("bill_id = ?", billID).Order("tag_id").Pluck("tag_id", &tagIDs).Error
+	return tagIDs, err
+}
+
+// uniqueIDs returns the ids sorted without duplicates
+func uniqueIDs(ids []uint) []uint {
+	seen := map[uint]bool{}
+	unique := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i] < unique[j] })
+	return unique
+}
+
+func equalIDs(a []uint, b []uint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// setBillTags replaces the tags of a bill, tagIDs must be checked by checkTagIDs
+func setBillTags(tx *gorm.DB, billID uint, tagIDs []uint) error {
+	if err := tx.Table(consts.BillTagTable).Where("bill_id = ?", billID).Delete(&models.BillTag{}).Error; err != nil {
+		return err
+	}
+	if len(tagIDs) == 0 {
+		return nil
+	}
+
+	links := make([]models.BillTag, 0, len(tagIDs))
+	for _, tagID := range tagIDs {
+		links = append(links, models.BillTag{BillID: billID, TagID: tagID})
+	}
+	return tx.Table(consts.BillTagTable).Create(&links).Error
+}
+
+// loadBillTags fills Bill.Tags
+func loadBillTags(tx *gorm.DB, bills []models.Bill) error {
+	if len(bills) == 0 {
+		return nil
+	}
+
+	billIDs := make([]uint, 0, len(bills))
+	for _, bill := range bills {
+		billIDs = append(billIDs, bill.ID)
+	}
+
+	var rows []struct {
+		models.Tag
+		BillID uint
+	}
+	if err := tx.Table(consts.BillTagTable).
+		Select("tag.*, bill_tag.bill_id").
+		Joins("JOIN tag ON tag.id = bill_tag.tag_id AND tag.deleted_at IS NULL").
+		Where("bill_tag.bill_id IN ?", billIDs).
+		Order("tag.name").
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	tags := map[uint][]models.Tag{}
+	for _, row := range rows {
+		tags[row.BillID] = append(tags[row.BillID], row.Tag)
+	}
+	for i := range bills {
+		bills[i].Tags = tags[bills[i].ID]
+		if bills[i].Tags == nil {
+			bills[i].Tags = []models.Tag{}
+		}
+	}
+	return nil
+}
+
+// checkTagName keeps tag names unique in a family, case-insensitive
+func checkTagName(tx *gorm.DB, tag *models.Tag) error {
+	var count int64
+	if err := tx.Table(consts.TagTable).
+		Where("family_id = ? AND LOWER(name) = LOWER(?) AND id <> ?", tag.FamilyID, tag.Name, tag.ID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errTagNameTaken
+	}
+	return nil
+}
+
+type TagResponse struct {
+	models.Tag
+	BillCount int64 `json:"bill_count"`
+}
+
+func ListTags(c *gin.Context) {
+	var tags []TagResponse
+	if err := db.DB.Table(consts.TagTable).
+		Select("tag.*, (SELECT COUNT(*) FROM bill_tag JOIN bill ON bill.id = bill_tag.bill_id AND bill.deleted_at IS NULL WHERE bill_tag.tag_id = tag.id) AS bill_count").
+		Where("tag.family_id = ? AND tag.deleted_at IS NULL", c.GetUint("family_id")).
+		Order("tag.name").
+		Scan(&tags).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list tags: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Tags Successfully",
+		"data":    tags,
+	})
+}
+
+type createTagRequest struct {
+	Name  string `json:"name" binding:"required,max=50"`
+	Color string `json:"color" binding:"omitempty,hexcolor"`
+}
+
+func CreateTag(c *gin.Context) {
+	var req createTagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateTag Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	tag := models.NewTag()
+	tag.FamilyID = c.GetUint("family_id")
+	tag.Name = strings.TrimSpace(req.Name)
+	tag.Color = req.Color
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkTagName(tx, tag); err != nil {
+			return err
+		}
+		return tx.Table(consts.TagTable).Create(tag).Error
+	})
+	if err != nil {
+		tagErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Create Tag Successfully",
+		"data":    tag,
+	})
+}
+
+func tagErrorResponse(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errTagNameTaken):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to save tag: " + err.Error(),
+		})
+	}
+	c.Abort()
+}
+
+// findTag loads the tag of :tag_id in the family, aborts if not found
+func findTag(c *gin.Context) *models.Tag {
+	tagID, err := strconv.ParseUint(c.Param("tag_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid tag_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	tag := models.NewTag()
+	if err := db.DB.Table(consts.TagTable).Where("id = ? AND family_id = ?", uint(tagID), c.GetUint("family_id")).First(tag).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "tag not found: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+	return tag
+}
+
+type updateTagRequest struct {
+	Name  *string `json:"name" binding:"omitnil,min=1,max=50"`
+	Color *string `json:"color" binding:"omitnil,omitempty,hexcolor"`
+}
+
+func UpdateTag(c *gin.Context) {
+	var req updateTagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateTag Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	tag := findTag(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if req.Name != nil {
+		tag.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Color != nil {
+		tag.Color = *req.Color
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkTagName(tx, tag); err != nil {
+			return err
+		}
+		return tx.Table(consts.TagTable).Save(tag).Error
+	})
+	if err != nil {
+		tagErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Update Tag Successfully",
+		"data":    tag,
+	})
+}
+
+// DeleteTag removes the tag from every bill, the bills stay
+func DeleteTag(c *gin.Context) {
+	tag := findTag(c)
+	if c.IsAborted() {
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.BillTagTable).Where("tag_id = ?", tag.ID).Delete(&models.BillTag{}).Error; err != nil {
+			return err
+		}
+		return tx.Table(consts.TagTable).Unscoped().Where("id = ?", tag.ID).Delete(&models.Tag{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete tag: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "tag deleted successfully",
+	})
+}
+
+// TagSummary is in the base currency, Currencies has the original amounts
+type TagSummary struct {
+	TagID       uint             `json:"tag_id"`
+	Name        string           `json:"name"`
+	Count       int64            `json:"count"`
+	Income      int64            `json:"income"`
+	Expense     int64            `json:"expense"`
+	Unconverted int64            `json:"unconverted"`
+	Currencies  []CurrencyTotals `json:"currencies" gorm:"-"`
+}
+
+// TagSummaries sums the bills matched by the SelectBills filters per tag in the base currency,
+// a bill with several tags is counted under each of them
+func TagSummaries(c *gin.Context) {
+	query, err := applyBillFilters(c, billQuery(c.GetUint("family_id")))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "invalid TagSummaries filter: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	query = query.
+		Joins("JOIN bill_tag ON bill_tag.bill_id = bill.id").
+		Joins("JOIN tag ON tag.id = bill_tag.tag_id AND tag.deleted_at IS NULL").
+		Session(&gorm.Session{})
+
+	summaries := []TagSummary{}
+	if err := query.
+		Select("tag.id AS tag_id, tag.name, " + billSumsSQL).
+		Group("tag.id, tag.name").
+		Order("expense DESC, tag.name").
+		Scan(&summaries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to sum bills by tag: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	var currencies []struct {
+		CurrencyTotals
+		TagID uint
+	}
+	if err := query.
+		Select("tag.id AS tag_id, " + currencySumsSQL).
+		Group("tag.id, bill.currency").
+		Order("bill.currency").
+		Scan(&currencies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to sum bills by tag: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	byTag := map[uint][]CurrencyTotals{}
+	for _, row := range currencies {
+		byTag[row.TagID] = append(byTag[row.TagID], row.CurrencyTotals)
+	}
+	for i := range summaries {
+		summaries[i].Currencies = byTag[summaries[i].TagID]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Tag Summaries Successfully",
+		"data":    summaries,
+	})
+}
@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/jwt"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"time"
+)
+
+type TokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds
+}
+
+// issueTokens creates an access token and stores a new refresh token for subject
+func issueTokens(tx *gorm.DB, subject string, audience string) (*TokenPair, error) {
+	accessToken, err := jwt.GenerateJWT(subject, audience)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, hash, err := jwt.GenerateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	record := models.NewRefreshToken()
+	record.TokenHash = hash
+	record.Subject = subject
+	record.Audience = audience
+	record.ExpiresAt = time.Now().Add(consts.RefreshTokenExpire)
+
+	if err := tx.Table(consts.RefreshTokenTable).Create(record).Error; err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(consts.AccessTokenExpire.Seconds()),
+	}, nil
+}
+
+// revokeAllRefreshTokens logs subject out of every device
+func revokeAllRefreshTokens(tx *gorm.DB, subject string, audience string) error {
+	return tx.Table(consts.RefreshTokenTable).
+		Where("subject = ? AND audience = ? AND revoked_at IS NULL", subject, audience).
+		Update("revoked_at", time.Now()).Error
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func RefreshToken(c *gin.Context) {
+	var req refreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind RefreshToken Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	record := models.NewRefreshToken()
+	if err := db.DB.Table(consts.RefreshTokenTable).Where("token_hash = ?", jwt.HashToken(req.RefreshToken)).First(record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"errno":   40102,
+				"message": "Unauthorized, invalid refresh token",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to query database: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	// a rotated token is used again, someone else may hold it, so end every session
+	if record.RevokedAt != nil {
+		if err := revokeAllRefreshTokens(db.DB, record.Subject, record.Audience); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to revoke refresh tokens: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"errno":   40103,
+			"message": "Unauthorized, refresh token has been revoked",
+		})
+		c.Abort()
+		return
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"errno":   40104,
+			"message": "Unauthorized, refresh token expired",
+		})
+		c.Abort()
+		return
+	}
+
+	if record.Audience == consts.User {
+		user := models.NewUser()
+		result := db.DB.Table(consts.UserTable).Where("phone = ?", record.Subject).Limit(1).Find(user)
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50000,
+				"message": "failed to query database: " + result.Error.Error(),
+			})
+			c.Abort()
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"errno":   40101,
+				"message": "Unauthorized, user in refresh token not found",
+			})
+			c.Abort()
+			return
+		}
+		if user.Disabled {
+			c.JSON(http.StatusForbidden, gin.H{
+				"errno":   40300,
+				"message": "Forbidden, account has been disabled",
+			})
+			c.Abort()
+			return
+		}
+	}
+
+	var tokens *TokenPair
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		// only the request that flips revoked_at may rotate the token
+		result := tx.Table(consts.RefreshTokenTable).
+			Where("id = ? AND revoked_at IS NULL", record.ID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		var err error
+		tokens, err = issueTokens(tx, record.Subject, record.Audience)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"errno":   40103,
+				"message": "Unauthorized, refresh token has been revoked",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50004,
+				"message": "failed to refresh token: " + err.Error(),
+			})
+		}
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "refresh token successfully",
+		"results": tokens,
+	})
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Logout revokes the access token in use and, if given, the refresh token of this device
+func Logout(c *gin.Context) {
+	var req logoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind Logout Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	jti := c.GetString("jti")
+	subject := c.GetString("subject")
+	expiresAt := time.Unix(c.GetInt64("token_exp"), 0)
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		// expired entries are useless, clean them while we are here
+		if err := tx.Table(consts.RevokedTokenTable).Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Table(consts.RevokedTokenTable).Create(&models.RevokedToken{
+			JTI:       jti,
+			ExpiresAt: expiresAt,
+		}).Error; err != nil {
+			return err
+		}
+
+		if req.RefreshToken != "" {
+			return tx.Table(consts.RefreshTokenTable).
+				Where("token_hash = ? AND subject = ? AND revoked_at IS NULL", jwt.HashToken(req.RefreshToken), subject).
+				Update("revoked_at", time.Now()).Error
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to logout: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "logout successfully",
+	})
+}
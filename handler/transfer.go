@@ -0,0 +1,319 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	errTransferSameAccount = errors.New("cannot transfer to the same account")
+	errTransferToAmount    = errors.New("to_amount is required between accounts of different currencies")
+)
+
+// canModifyTransfer: managers can modify every transfer, members only the ones they created
+func canModifyTransfer(c *gin.Context, transfer *models.Transfer) bool {
+	familyUser := currentFamilyUser(c)
+	if familyUser.Can(consts.FamilyManager) {
+		return true
+	}
+	return familyUser.Can(consts.FamilyMember) && transfer.CreatedBy == familyUser.UserID
+}
+
+// checkTransferAccounts checks both accounts of a transfer and sets ToAmount, which is Amount between
+// accounts of one currency and must be given between different currencies. Archived accounts are only
+// refused for newly chosen accounts, so the transfers of an archived account stay editable.
+func checkTransferAccounts(tx *gorm.DB, transfer *models.Transfer, toAmount int, newAccounts bool) error {
+	if transfer.FromAccountID == transfer.ToAccountID {
+		return errTransferSameAccount
+	}
+
+	var accounts []models.Account
+	if err := tx.Table(consts.AccountTable).
+		Where("id IN ? AND family_id = ?", []uint{transfer.FromAccountID, transfer.ToAccountID}, transfer.FamilyID).
+		Find(&accounts).Error; err != nil {
+		return err
+	}
+	if len(accounts) != 2 {
+		return errAccountNotFound
+	}
+	for _, account := range accounts {
+		if newAccounts && account.ArchivedAt != nil {
+			return errAccountArchived
+		}
+	}
+
+	switch {
+	case accounts[0].Currency == accounts[1].Currency:
+		transfer.ToAmount = transfer.Amount
+	case toAmount > 0:
+		transfer.ToAmount = toAmount
+	default:
+		return errTransferToAmount
+	}
+	return nil
+}
+
+func transferErrorResponse(c *gin.Context, err error) {
+	if errors.Is(err, errTransferSameAccount) || errors.Is(err, errTransferToAmount) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40003,
+			"message": err.Error(),
+		})
+		c.Abort()
+		return
+	}
+	accountErrorResponse(c, err, "failed to save transfer: ")
+}
+
+type createTransferRequest struct {
+	FromAccountID uint   `json:"from_account_id" binding:"required"`
+	ToAccountID   uint   `json:"to_account_id" binding:"required"`
+	Amount        int    `json:"amount" binding:"required,gt=0"`
+	ToAmount      int    `json:"to_amount" binding:"gte=0"` // only between accounts of different currencies
+	Date          string `json:"date"`                      // defaults to now
+	Description   string `json:"description" binding:"max=255"`
+}
+
+func CreateTransfer(c *gin.Context) {
+	var req createTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind CreateTransfer Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	transfer := models.NewTransfer()
+	transfer.FamilyID = c.GetUint("family_id")
+	transfer.FromAccountID = req.FromAccountID
+	transfer.ToAccountID = req.ToAccountID
+	transfer.Amount = req.Amount
+	transfer.Date = db.BillNow()
+	transfer.Description = req.Description
+	transfer.CreatedBy = c.GetUint("user_id")
+	if req.Date != "" {
+		date, err := time.Parse(consts.TimeFormat, req.Date)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		transfer.Date = date
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkTransferAccounts(tx, transfer, req.ToAmount, true); err != nil {
+			return err
+		}
+		return tx.Table(consts.TransferTable).Create(transfer).Error
+	})
+	if err != nil {
+		transferErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Create Transfer Successfully",
+		"data":    transfer,
+	})
+}
+
+// ListTransfers lists the transfers of the family, newest first,
+// ?account_id= for the ones of one account, start_date and end_date as in SelectBills
+func ListTransfers(c *gin.Context) {
+	query := db.DB.Table(consts.TransferTable).Where("family_id = ?", c.GetUint("family_id"))
+
+	if value := c.Query("account_id"); value != "" {
+		accountID, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "invalid account_id: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		query = query.Where("from_account_id = ? OR to_account_id = ?", uint(accountID), uint(accountID))
+	}
+	if value := c.Query("start_date"); value != "" {
+		date, err := parseFilterDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse start_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		query = query.Where("date >= ?", date)
+	}
+	if value := c.Query("end_date"); value != "" {
+		date, err := parseFilterDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse end_date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		query = query.Where("date <= ?", date)
+	}
+
+	transfers := []models.Transfer{}
+	if err := query.Order("date DESC, id DESC").Find(&transfers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to list transfers: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "List Transfers Successfully",
+		"data":    transfers,
+	})
+}
+
+// findModifiableTransfer loads the transfer of :transfer_id in the family, aborts if
+// not found or the current user cannot modify it
+func findModifiableTransfer(c *gin.Context) *models.Transfer {
+	transferID, err := strconv.ParseUint(c.Param("transfer_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40001,
+			"message": "invalid transfer_id: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	transfer := models.NewTransfer()
+	if err := db.DB.Table(consts.TransferTable).Where("id = ? AND family_id = ?", uint(transferID), c.GetUint("family_id")).First(transfer).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40002,
+			"message": "transfer not found: " + err.Error(),
+		})
+		c.Abort()
+		return nil
+	}
+
+	if !canModifyTransfer(c, transfer) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40301,
+			"message": "permission denied, only manager can modify transfers created by others",
+		})
+		c.Abort()
+		return nil
+	}
+	return transfer
+}
+
+type updateTransferRequest struct {
+	FromAccountID *uint   `json:"from_account_id" binding:"omitnil,gt=0"`
+	ToAccountID   *uint   `json:"to_account_id" binding:"omitnil,gt=0"`
+	Amount        *int    `json:"amount" binding:"omitnil,gt=0"`
+	ToAmount      *int    `json:"to_amount" binding:"omitnil,gt=0"`
+	Date          *string `json:"date" binding:"omitnil,min=1"`
+	Description   *string `json:"description" binding:"omitnil,max=255"`
+}
+
+func UpdateTransfer(c *gin.Context) {
+	var req updateTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"errno":   40000,
+			"message": "failed to bind UpdateTransfer Request: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	transfer := findModifiableTransfer(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if req.FromAccountID != nil {
+		transfer.FromAccountID = *req.FromAccountID
+	}
+	if req.ToAccountID != nil {
+		transfer.ToAccountID = *req.ToAccountID
+	}
+	if req.Amount != nil {
+		transfer.Amount = *req.Amount
+	}
+	if req.Date != nil {
+		date, err := time.Parse(consts.TimeFormat, *req.Date)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40001,
+				"message": "failed to parse date: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+		transfer.Date = date
+	}
+	if req.Description != nil {
+		transfer.Description = *req.Description
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		// between different currencies the received amount is kept unless given
+		toAmount := transfer.ToAmount
+		if req.ToAmount != nil {
+			toAmount = *req.ToAmount
+		}
+		if err := checkTransferAccounts(tx, transfer, toAmount, req.FromAccountID != nil || req.ToAccountID != nil); err != nil {
+			return err
+		}
+		return tx.Table(consts.TransferTable).Save(transfer).Error
+	})
+	if err != nil {
+		transferErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "Update Transfer Successfully",
+		"data":    transfer,
+	})
+}
+
+func DeleteTransfer(c *gin.Context) {
+	transfer := findModifiableTransfer(c)
+	if c.IsAborted() {
+		return
+	}
+
+	if err := db.DB.Table(consts.TransferTable).Where("id = ?", transfer.ID).Delete(&models.Transfer{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50000,
+			"message": "failed to delete transfer: " + err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"errno":   20000,
+		"message": "transfer deleted successfully",
+	})
+}
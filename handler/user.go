@@ -7,7 +7,9 @@ import (
 	"github.com/hewo233/hdu-dx2/shared/consts"
 	"github.com/hewo233/hdu-dx2/utils/jwt"
 	"github.com/hewo233/hdu-dx2/utils/password"
+	"gorm.io/gorm"
 	"net/http"
+	"time"
 )
 
 type UserRegisterRequest struct {
@@ -97,7 +99,9 @@ type UserLoginResponse struct {
 		Phone    string `json:"phone"`
 		Username string `json:"username"`
 	} `json:"user"`
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
 }
 
 func UserLogin(c *gin.Context) {
@@ -148,7 +152,16 @@ func UserLogin(c *gin.Context) {
 		return
 	}
 
-	jwtToken, err := jwt.GenerateJWT(req.Phone, consts.User)
+	if user.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40300,
+			"message": "this account has been disabled",
+		})
+		c.Abort()
+		return
+	}
+
+	tokens, err := issueTokens(db.DB, user.Phone, consts.User)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"errno":   50004,
@@ -159,7 +172,9 @@ func UserLogin(c *gin.Context) {
 	}
 
 	var rep UserLoginResponse
-	rep.Token = jwtToken
+	rep.Token = tokens.Token
+	rep.RefreshToken = tokens.RefreshToken
+	rep.ExpiresIn = tokens.ExpiresIn
 	rep.User.Username = user.Username
 	rep.User.Phone = user.Phone
 
@@ -244,17 +259,7 @@ func GetUserInfoByPhone(c *gin.Context) {
 }
 
 func ModifyUserSelf(c *gin.Context) {
-	phone, user, err := jwt.GetPhoneFromJWT(c)
-
-	if phone == "admin" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errno":   40012,
-			"message": "admin is not user",
-		})
-		c.Abort()
-		return
-	}
-
+	_, user, err := jwt.GetPhoneFromJWT(c)
 	if err != nil {
 		if err.Error() == "user not found" {
 			c.JSON(http.StatusUnauthorized, gin.H{
@@ -291,6 +296,7 @@ func ModifyUserSelf(c *gin.Context) {
 	}
 
 	// 密码不为空就改
+	passwordChanged := false
 	if updateData.Password != "" {
 		if len(updateData.Password) < 6 {
 			c.JSON(http.StatusBadRequest, gin.H{
@@ -311,9 +317,31 @@ func ModifyUserSelf(c *gin.Context) {
 			return
 		}
 		user.Password = hashedPassword
+
+		// 改密码后所有旧 token 作废
+		now := time.Now().Truncate(time.Microsecond) // stored exactly, tokens are compared to it in microseconds
+		user.TokensRevokedAt = &now
+		passwordChanged = true
 	}
 
-	if err := db.DB.Table(consts.UserTable).Save(&user).Error; err != nil {
+	var tokens *TokenPair
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table(consts.UserTable).Save(&user).Error; err != nil {
+			return err
+		}
+		if !passwordChanged {
+			return nil
+		}
+
+		if err := revokeAllRefreshTokens(tx, user.Phone, consts.User); err != nil {
+			return err
+		}
+		// keep the current device logged in
+		var issueErr error
+		tokens, issueErr = issueTokens(tx, user.Phone, consts.User)
+		return issueErr
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"errno":   50011,
 			"message": "failed to update user: " + err.Error(),
@@ -325,45 +353,7 @@ func ModifyUserSelf(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"errno":   20000,
 		"message": "user updated successfully",
-	})
-}
-
-type ListUserResponse struct {
-	Phone    string `json:"phone"`
-	Username string `json:"username"`
-}
-
-func ListUser(c *gin.Context) {
-
-	if ok := CheckUser(c); !ok {
-		return
-	}
-
-	var users []models.User
-
-	result := db.DB.Table(consts.UserTable).Find(&users)
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errno":   50007,
-			"message": "failed to query database: " + result.Error.Error(),
-		})
-		c.Abort()
-		return
-	}
-
-	var rep []ListUserResponse
-
-	for _, user := range users {
-		rep = append(rep, ListUserResponse{
-			Phone:    user.Phone,
-			Username: user.Username,
-		})
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"errno":   20000,
-		"message": "get user list successfully",
-		"results": rep,
+		"results": tokens,
 	})
 }
 
@@ -400,7 +390,7 @@ func ListUserFamily(c *gin.Context) {
 	var families []models.Family
 	for _, fu := range familyUsers {
 		var family models.Family
-		res := db.DB.Table(consts.FamilyTable).Where("id = ?", fu.FamilyID).First(&family)
+		res := db.DB.Table(consts.FamilyTable).Where("id = ?", fu.FamilyID).Limit(1).Find(&family)
 		if res.Error != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"errno":   50009,
@@ -409,6 +399,10 @@ func ListUserFamily(c *gin.Context) {
 			c.Abort()
 			return
 		}
+		// deleted family waiting to be purged
+		if res.RowsAffected == 0 {
+			continue
+		}
 		families = append(families, family)
 	}
 
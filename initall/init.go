@@ -2,10 +2,14 @@ package initall
 
 import (
 	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/task"
 	"github.com/hewo233/hdu-dx2/utils/jwt"
+	"github.com/hewo233/hdu-dx2/utils/storage"
 )
 
 func Init() {
 	db.Init()
 	jwt.InitJWTKey()
+	storage.Init()
+	task.Init()
 }
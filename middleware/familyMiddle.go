@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+)
+
+// FamilyAuth must run after JWTAuth, it checks the user has at least permission in :family_id
+// and sets user_id, family_id, family and family_user for handlers
+func FamilyAuth(permission string) gin.HandlerFunc {
+	return familyAuth(permission, false)
+}
+
+// DeletedFamilyAuth is FamilyAuth that also accepts families waiting to be purged
+func DeletedFamilyAuth(permission string) gin.HandlerFunc {
+	return familyAuth(permission, true)
+}
+
+func familyAuth(permission string, withDeleted bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		familyID, err := strconv.ParseUint(c.Param("family_id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"errno":   40000,
+				"message": "invalid family_id: " + err.Error(),
+			})
+			c.Abort()
+			return
+		}
+
+		user := models.NewUser()
+		if err := db.DB.Table(consts.UserTable).Where("phone = ?", c.GetString("phone")).First(user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"errno":   40101,
+					"message": "Unauthorized, user in jwt not found",
+				})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"errno":   50000,
+					"message": "failed to query database: " + err.Error(),
+				})
+			}
+			c.Abort()
+			return
+		}
+
+		query := db.DB.Table(consts.FamilyTable)
+		if withDeleted {
+			query = query.Unscoped()
+		}
+
+		family := models.NewFamily()
+		if err := query.Where("id = ?", uint(familyID)).First(family).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"errno":   40004,
+					"message": "this family does not exist",
+				})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"errno":   50000,
+					"message": "failed to query database: " + err.Error(),
+				})
+			}
+			c.Abort()
+			return
+		}
+
+		familyUser := &models.FamilyUser{}
+		if err := db.DB.Table(consts.FamilyUserTable).Where("user_id = ? AND family_id = ?", user.ID, family.ID).First(familyUser).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"errno":   40300,
+					"message": "user not in family",
+				})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"errno":   50000,
+					"message": "failed to query database: " + err.Error(),
+				})
+			}
+			c.Abort()
+			return
+		}
+
+		if !familyUser.Can(permission) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"errno":   40301,
+				"message": "permission denied, " + permission + " required",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set("user_id", user.ID)
+		c.Set("family_id", family.ID)
+		c.Set("family", family)
+		c.Set("family_user", familyUser)
+	}
+}
+
+// FamilyWritable must run after FamilyAuth, it rejects changes to an archived family
+func FamilyWritable() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		family := c.MustGet("family").(*models.Family)
+		if family.ArchivedAt != nil {
+			c.JSON(http.StatusForbidden, gin.H{
+				"errno":   40302,
+				"message": "family is archived and read-only",
+			})
+			c.Abort()
+			return
+		}
+	}
+}
@@ -3,6 +3,9 @@ package middleware
 import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/models"
+	"github.com/hewo233/hdu-dx2/shared/consts"
 	myjwt "github.com/hewo233/hdu-dx2/utils/jwt"
 	"log"
 	"net/http"
@@ -47,7 +50,97 @@ func JWTAuth(audience string) gin.HandlerFunc {
 				return
 			}
 
-			c.Set("phone", claims.StandardClaims.Id)
+			if !checkTokenNotRevoked(c, claims) {
+				return
+			}
+
+			c.Set("subject", claims.Subject)
+			if audience == consts.Admin {
+				c.Set("admin", claims.Subject)
+			} else {
+				c.Set("phone", claims.Subject)
+			}
+			c.Set("jti", claims.Id)
+			c.Set("token_exp", claims.ExpiresAt)
 		}
 	}
 }
+
+// checkTokenNotRevoked rejects logged out tokens and tokens issued before the last password change
+func checkTokenNotRevoked(c *gin.Context, claims *myjwt.Claims) bool {
+	result := db.DB.Table(consts.RevokedTokenTable).Where("jti = ?", claims.Id).Limit(1).Find(&models.RevokedToken{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50051,
+			"message": "failed to query database: " + result.Error.Error(),
+		})
+		c.Abort()
+		return false
+	}
+	if result.RowsAffected > 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"errno":   40151,
+			"message": "Unauthorized, token has been revoked",
+		})
+		c.Abort()
+		return false
+	}
+
+	if claims.Audience == consts.Admin {
+		result = db.DB.Table(consts.AdminTable).Where("username = ?", claims.Subject).Limit(1).Find(models.NewAdmin())
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"errno":   50051,
+				"message": "failed to query database: " + result.Error.Error(),
+			})
+			c.Abort()
+			return false
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"errno":   40152,
+				"message": "Unauthorized, admin in jwt not found",
+			})
+			c.Abort()
+			return false
+		}
+		return true
+	}
+
+	user := models.NewUser()
+	result = db.DB.Table(consts.UserTable).Where("phone = ?", claims.Subject).Limit(1).Find(user)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"errno":   50051,
+			"message": "failed to query database: " + result.Error.Error(),
+		})
+		c.Abort()
+		return false
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"errno":   40152,
+			"message": "Unauthorized, user in jwt not found",
+		})
+		c.Abort()
+		return false
+	}
+	if user.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{
+			"errno":   40350,
+			"message": "Forbidden, account has been disabled",
+		})
+		c.Abort()
+		return false
+	}
+	if user.TokensRevokedAt != nil && claims.IssuedBefore(*user.TokensRevokedAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"errno":   40151,
+			"message": "Unauthorized, token has been revoked",
+		})
+		c.Abort()
+		return false
+	}
+
+	return true
+}
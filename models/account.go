@@ -0,0 +1,42 @@
+package models
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// Account is where the money of a family is kept, its balance is computed from
+// the opening balance, the bills linked to it and the transfers
+type Account struct {
+	gorm.Model
+	FamilyID       uint       `json:"family_id" gorm:"not null;index"`
+	Name           string     `json:"name" gorm:"size:100;not null"`
+	Type           string     `json:"type" gorm:"size:20;not null"`                  // cash, debit, credit, ewallet
+	Currency       string     `json:"currency" gorm:"size:3;not null;default:'CNY'"` // bills of the account are in it
+	OpeningBalance int        `json:"opening_balance" gorm:"not null"`               // 分, negative for a credit card in debt
+	OpeningDate    time.Time  `json:"opening_date" gorm:"not null"`                  // the opening balance counts from this date
+	Note           string     `json:"note" gorm:"size:255"`
+	SortOrder      int        `json:"sort_order" gorm:"not null;default:0"`
+	ArchivedAt     *time.Time `json:"archived_at"` // archived account cannot be used by new bills and transfers
+}
+
+func NewAccount() *Account {
+	return &Account{}
+}
+
+// Transfer moves money between two accounts of a family, it is neither income nor expense
+type Transfer struct {
+	gorm.Model
+	FamilyID      uint      `json:"family_id" gorm:"not null;index"`
+	FromAccountID uint      `json:"from_account_id" gorm:"not null;index"`
+	ToAccountID   uint      `json:"to_account_id" gorm:"not null;index"`
+	Amount        int       `json:"amount" gorm:"not null"`              // 分 taken from FromAccountID, in its currency
+	ToAmount      int       `json:"to_amount" gorm:"not null;default:0"` // 分 put into ToAccountID, in its currency
+	Date          time.Time `json:"date" gorm:"not null;index"`
+	Description   string    `json:"description" gorm:"size:255"`
+	CreatedBy     uint      `json:"created_by" gorm:"not null"`
+}
+
+func NewTransfer() *Transfer {
+	return &Transfer{}
+}
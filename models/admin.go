@@ -0,0 +1,14 @@
+package models
+
+import "gorm.io/gorm"
+
+// Admin is an operator account, it is not a family user and logs in with the admin audience
+type Admin struct {
+	gorm.Model
+	Username string `json:"username" gorm:"uniqueIndex;size:50;not null"`
+	Password string `json:"-" gorm:"size:100;not null"`
+}
+
+func NewAdmin() *Admin {
+	return &Admin{}
+}
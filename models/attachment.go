@@ -0,0 +1,26 @@
+package models
+
+import "gorm.io/gorm"
+
+// Attachment is a receipt or invoice file of a bill, the file itself is in storage
+type Attachment struct {
+	gorm.Model
+	BillID     uint   `json:"bill_id" gorm:"not null;index"`
+	FamilyID   uint   `json:"family_id" gorm:"not null;index"`
+	FileName   string `json:"file_name" gorm:"size:255;not null"` // name on the uploader's device
+	MimeType   string `json:"mime_type" gorm:"size:100;not null"` // sniffed from the content, not trusted from the client
+	Size       int64  `json:"size" gorm:"not null"`
+	StorageKey string `json:"-" gorm:"size:255;not null"`
+	ThumbKey   string `json:"-" gorm:"size:255;not null;default:''"` // empty when there is no thumbnail
+	HasThumb   bool   `json:"has_thumb" gorm:"-"`
+	UploadedBy uint   `json:"uploaded_by" gorm:"not null"`
+}
+
+func NewAttachment() *Attachment {
+	return &Attachment{}
+}
+
+func (a *Attachment) AfterFind(tx *gorm.DB) error {
+	a.HasThumb = a.ThumbKey != ""
+	return nil
+}
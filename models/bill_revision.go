@@ -0,0 +1,84 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"time"
+)
+
+type BillFieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// BillChanges is stored as json text
+type BillChanges []BillFieldChange
+
+func (bc BillChanges) Value() (driver.Value, error) {
+	if bc == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(bc)
+	return string(b), err
+}
+
+func (bc *BillChanges) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), bc)
+	case []byte:
+		return json.Unmarshal(v, bc)
+	case nil:
+		*bc = nil
+		return nil
+	}
+	return errors.New("unsupported type for BillChanges")
+}
+
+// BillRevision is one change of a bill, revisions are never modified
+type BillRevision struct {
+	ID        uint        `json:"id" gorm:"primaryKey"`
+	BillID    uint        `json:"bill_id" gorm:"not null;index"`
+	FamilyID  uint        `json:"family_id" gorm:"not null;index"`
+	Action    string      `json:"action" gorm:"size:20;not null"` // create, update, delete
+	EditorID  uint        `json:"editor_id" gorm:"not null"`
+	Changes   BillChanges `json:"changes" gorm:"type:text;not null"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// DiffBill lists the user visible fields that differ between old and new
+func DiffBill(old *Bill, new *Bill) BillChanges {
+	changes := BillChanges{}
+	add := func(field string, oldValue interface{}, newValue interface{}) {
+		if oldValue != newValue {
+			changes = append(changes, BillFieldChange{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+
+	add("date", FormatBillDate(old.Date), FormatBillDate(new.Date))
+	add("type", old.Type, new.Type)
+	add("amount", old.Amount, new.Amount)
+	add("currency", old.Currency, new.Currency)
+	add("category", old.Category, new.Category)
+	add("category_id", old.CategoryID, new.CategoryID)
+	add("description", old.Description, new.Description)
+	add("object", old.Object, new.Object)
+	add("counterparty_id", old.CounterpartyID, new.CounterpartyID)
+	add("username", old.Username, new.Username)
+	add("account_id", old.AccountID, new.AccountID)
+	add("payer_id", old.PayerID, new.PayerID)
+	add("split_mode", old.SplitMode, new.SplitMode)
+
+	return changes
+}
+
+// FormatBillDate is how dates of bills show up in revisions, empty for the zero time
+func FormatBillDate(date time.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.Format(consts.TimeFormat)
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/period"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Budget limits the expense of a family, or of a category and its children, in every period.
+// Weekly, monthly and yearly periods follow the calendar, weeks start on Monday; a custom
+// budget has one period from StartDate to EndDate.
+type Budget struct {
+	gorm.Model
+	FamilyID    uint       `json:"family_id" gorm:"not null;index"`
+	CategoryID  uint       `json:"category_id" gorm:"not null;default:0"` // 0 for every expense of the family
+	Name        string     `json:"name" gorm:"size:100;not null"`
+	Amount      int        `json:"amount" gorm:"not null"`                 // 分 in the base currency, per period, converted when it changes
+	Period      string     `json:"period" gorm:"size:20;not null"`         // weekly, monthly, yearly, custom
+	StartDate   time.Time  `json:"start_date" gorm:"not null"`             // start of a day, the budget begins with the period containing it
+	EndDate     *time.Time `json:"end_date"`                               // start of the last day, required for custom
+	Rollover    bool       `json:"rollover" gorm:"not null;default:false"` // unspent amount is added to the next period
+	WarnPercent int        `json:"warn_percent" gorm:"not null;default:80"`
+	CreatedBy   uint       `json:"created_by" gorm:"not null"`
+}
+
+func NewBudget() *Budget {
+	return &Budget{}
+}
+
+// periodUnit is the calendar unit of the period, false for custom
+func (b *Budget) periodUnit() (period.Unit, bool) {
+	switch b.Period {
+	case consts.BudgetWeekly:
+		return period.Week, true
+	case consts.BudgetMonthly:
+		return period.Month, true
+	case consts.BudgetYearly:
+		return period.Year, true
+	}
+	return 0, false
+}
+
+// PeriodStart returns the start of the period containing t
+func (b *Budget) PeriodStart(t time.Time) time.Time {
+	if unit, ok := b.periodUnit(); ok {
+		return period.Start(t, unit)
+	}
+	return b.StartDate
+}
+
+// PeriodEnd returns the end of the period starting at start, exclusive
+func (b *Budget) PeriodEnd(start time.Time) time.Time {
+	if unit, ok := b.periodUnit(); ok {
+		return period.End(start, unit)
+	}
+	if b.EndDate == nil {
+		return start
+	}
+	return b.EndDate.AddDate(0, 0, 1)
+}
+
+// PeriodAt returns the period containing t, ok is false outside of the budget
+func (b *Budget) PeriodAt(t time.Time) (start time.Time, end time.Time, ok bool) {
+	start = b.PeriodStart(t)
+	end = b.PeriodEnd(start)
+	if t.Before(b.PeriodStart(b.StartDate)) || !t.Before(end) {
+		return start, end, false
+	}
+	if b.EndDate != nil && start.After(*b.EndDate) {
+		return start, end, false
+	}
+	return start, end, true
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Category is a bill category of a family, at most two levels deep
+type Category struct {
+	gorm.Model
+	FamilyID   uint       `json:"family_id" gorm:"not null;index"`
+	ParentID   uint       `json:"parent_id" gorm:"not null;default:0;index"` // 0 for top level
+	Name       string     `json:"name" gorm:"size:100;not null"`
+	Type       string     `json:"type" gorm:"size:20;not null"` // income or expense, same as the parent
+	Icon       string     `json:"icon" gorm:"size:100"`
+	Color      string     `json:"color" gorm:"size:20"` // #RRGGBB
+	SortOrder  int        `json:"sort_order" gorm:"not null;default:0"`
+	ArchivedAt *time.Time `json:"archived_at"` // archived category cannot be used by new bills
+}
+
+func NewCategory() *Category {
+	return &Category{}
+}
+
+// DefaultCategories are seeded into every new family
+var DefaultCategories = []Category{
+	{Name: "餐饮", Type: consts.BillTypeExpense, Icon: "food", Color: "#FF8A65"},
+	{Name: "交通", Type: consts.BillTypeExpense, Icon: "transport", Color: "#4FC3F7"},
+	{Name: "购物", Type: consts.BillTypeExpense, Icon: "shopping", Color: "#F06292"},
+	{Name: "住房", Type: consts.BillTypeExpense, Icon: "house", Color: "#A1887F"},
+	{Name: "水电燃气", Type: consts.BillTypeExpense, Icon: "utilities", Color: "#FFD54F"},
+	{Name: "通讯", Type: consts.BillTypeExpense, Icon: "phone", Color: "#90A4AE"},
+	{Name: "医疗", Type: consts.BillTypeExpense, Icon: "medical", Color: "#E57373"},
+	{Name: "教育", Type: consts.BillTypeExpense, Icon: "education", Color: "#7986CB"},
+	{Name: "娱乐", Type: consts.BillTypeExpense, Icon: "entertainment", Color: "#BA68C8"},
+	{Name: "人情", Type: consts.BillTypeExpense, Icon: "gift", Color: "#FFB74D"},
+	{Name: consts.OtherCategoryName, Type: consts.BillTypeExpense, Icon: "other", Color: "#BDBDBD"},
+	{Name: "工资", Type: consts.BillTypeIncome, Icon: "salary", Color: "#81C784"},
+	{Name: "奖金", Type: consts.BillTypeIncome, Icon: "bonus", Color: "#AED581"},
+	{Name: "投资", Type: consts.BillTypeIncome, Icon: "investment", Color: "#4DB6AC"},
+	{Name: "红包", Type: consts.BillTypeIncome, Icon: "red-packet", Color: "#E53935"},
+	{Name: consts.OtherCategoryName, Type: consts.BillTypeIncome, Icon: "other", Color: "#BDBDBD"},
+}
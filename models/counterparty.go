@@ -0,0 +1,32 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// Counterparty is who the money of bills came from or went to, Bill.Object is its name kept in sync
+type Counterparty struct {
+	gorm.Model
+	FamilyID uint   `json:"family_id" gorm:"not null;index"`
+	Name     string `json:"name" gorm:"size:100;not null"`
+	Kind     string `json:"kind" gorm:"size:20;not null;default:'other'"` // person, merchant, employer, other
+	Phone    string `json:"phone" gorm:"size:50"`
+	Email    string `json:"email" gorm:"size:100"`
+	Address  string `json:"address" gorm:"size:255"`
+	Note     string `json:"note" gorm:"size:255"`
+
+	// only loaded by the handlers that return them
+	Aliases []string `json:"aliases" gorm:"-"` // from counterparty_alias
+}
+
+func NewCounterparty() *Counterparty {
+	return &Counterparty{}
+}
+
+// CounterpartyAlias is another name a counterparty is found by, like "老张" for "张三"
+type CounterpartyAlias struct {
+	ID             uint   `json:"id" gorm:"primaryKey"`
+	CounterpartyID uint   `json:"counterparty_id" gorm:"not null;index"`
+	FamilyID       uint   `json:"family_id" gorm:"not null;index"`
+	Alias          string `json:"alias" gorm:"size:100;not null"`
+}
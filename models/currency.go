@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// ExchangeRate is the price of one unit of Currency in BaseCurrency on Date,
+// it is used for bills dated from Date until the next rate
+type ExchangeRate struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	FamilyID     uint      `json:"family_id" gorm:"not null;uniqueIndex:idx_exchange_rate,priority:1"`
+	Currency     string    `json:"currency" gorm:"size:3;not null;uniqueIndex:idx_exchange_rate,priority:2"`
+	BaseCurrency string    `json:"base_currency" gorm:"size:3;not null;uniqueIndex:idx_exchange_rate,priority:3"`
+	Date         time.Time `json:"date" gorm:"not null;uniqueIndex:idx_exchange_rate,priority:4"` // start of the day
+	Rate         float64   `json:"rate" gorm:"type:numeric(20,10);not null"`
+	CreatedBy    uint      `json:"created_by" gorm:"not null"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func NewExchangeRate() *ExchangeRate {
+	return &ExchangeRate{}
+}
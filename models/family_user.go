@@ -1,6 +1,7 @@
 package models
 
 import (
+	"github.com/hewo233/hdu-dx2/shared/consts"
 	"gorm.io/gorm"
 	"time"
 )
@@ -11,6 +12,11 @@ type User struct {
 	Password string       `json:"-" gorm:"size:100;not null"`
 	Phone    string       `json:"phone" gorm:"size:11;not null"`
 	Families []FamilyUser `json:"families" gorm:"foreignKey:UserID"`
+
+	Disabled bool `json:"disabled" gorm:"not null;default:false"`
+
+	// tokens issued before this time are rejected, set on password change
+	TokensRevokedAt *time.Time `json:"-"`
 }
 
 func NewUser() *User {
@@ -21,7 +27,13 @@ type Family struct {
 	gorm.Model
 	Name     string       `json:"name" gorm:"size:100;not null"`
 	Users    []FamilyUser `json:"users" gorm:"foreignKey:FamilyID"`
-	Password string       `json:"-" gorm:"size:100;not null"` // for joining family
+	Password string       `json:"-" gorm:"size:100;not null"` // bcrypt hash for joining family, empty disables joining by password
+
+	RequireApproval bool       `json:"require_approval" gorm:"not null;default:false"` // joining by password needs a manager to approve
+	ArchivedAt      *time.Time `json:"archived_at"`                                    // archived family is read-only
+
+	TrashRetentionDays int    `json:"trash_retention_days" gorm:"not null;default:30"`    // deleted bills are purged after this
+	BaseCurrency       string `json:"base_currency" gorm:"size:3;not null;default:'CNY'"` // totals are reported in it
 }
 
 func NewFamily() *Family {
@@ -29,11 +41,29 @@ func NewFamily() *Family {
 }
 
 type FamilyUser struct {
-	UserID   uint   `json:"user_id" gorm:"primaryKey"`
-	FamilyID uint   `json:"family_id" gorm:"primaryKey"`
-	Role     string `json:"role" gorm:"size:20;not null"` // father, mother, son, daughter...
+	UserID     uint   `json:"user_id" gorm:"primaryKey"`
+	FamilyID   uint   `json:"family_id" gorm:"primaryKey"`
+	Role       string `json:"role" gorm:"size:20;not null"`                      // father, mother, son, daughter... only for display
+	Permission string `json:"permission" gorm:"size:20;not null;default:member"` // owner, manager, member, viewer
 
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
+
+var permissionLevel = map[string]int{
+	consts.FamilyViewer:  1,
+	consts.FamilyMember:  2,
+	consts.FamilyManager: 3,
+	consts.FamilyOwner:   4,
+}
+
+// PermissionLevel returns 0 for an unknown permission
+func PermissionLevel(permission string) int {
+	return permissionLevel[permission]
+}
+
+// Can reports whether the member has at least the given permission
+func (fu *FamilyUser) Can(permission string) bool {
+	return PermissionLevel(fu.Permission) >= PermissionLevel(permission)
+}
@@ -7,14 +7,27 @@ import (
 
 type Bill struct {
 	gorm.Model
-	Date        time.Time `json:"date" gorm:"not null"`
-	Type        string    `json:"type" gorm:"size:100;not null;oneof:income,expense"`
-	Amount      int       `json:"amount" gorm:"not null"` // 分
-	Category    string    `json:"category" gorm:"size:100;not null"`
-	Description string    `json:"description" gorm:"size:255"`
-	Object      string    `json:"object" gorm:"size:100;not null"` // 谁给的/给谁的
-	Username    string    `json:"username" gorm:"size:100;not null"`
-	FamilyID    uint      `json:"family_id" gorm:"not null;index"`
+	Date           time.Time `json:"date" gorm:"not null;index:idx_bill_family_date,priority:2"`
+	Type           string    `json:"type" gorm:"size:100;not null;oneof:income,expense"`
+	Amount         int       `json:"amount" gorm:"not null;index:idx_bill_family_amount,priority:2"` // 分 of Currency
+	Currency       string    `json:"currency" gorm:"size:3;not null;default:'CNY'"`                  // ISO 4217
+	BaseAmount     *int      `json:"base_amount"`                                                    // Amount in the base currency of the family, nil without an exchange rate
+	Category       string    `json:"category" gorm:"size:100;not null"`                              // name of CategoryID, kept in sync for old clients
+	CategoryID     uint      `json:"category_id" gorm:"not null;default:0;index"`
+	Description    string    `json:"description" gorm:"size:255"`
+	Object         string    `json:"object" gorm:"size:100;not null"` // 谁给的/给谁的, name of CounterpartyID kept in sync for old clients
+	CounterpartyID uint      `json:"counterparty_id" gorm:"not null;default:0;index"`
+	Username       string    `json:"username" gorm:"size:100;not null"`
+	FamilyID       uint      `json:"family_id" gorm:"not null;index;index:idx_bill_family_date,priority:1;index:idx_bill_family_amount,priority:1"`
+	CreatedBy      uint      `json:"created_by"`                                    // user id, 0 for bills created before it was recorded
+	RecurringID    uint      `json:"recurring_id" gorm:"not null;default:0;index"`  // rule that generated the bill, 0 if entered by hand
+	AccountID      uint      `json:"account_id" gorm:"not null;default:0;index"`    // account the money came from or went to, 0 if none
+	PayerID        uint      `json:"payer_id" gorm:"not null;default:0"`            // member who paid a split bill
+	SplitMode      string    `json:"split_mode" gorm:"size:20;not null;default:''"` // equal, share, exact, empty if not split
+
+	// only loaded by the handlers that return them
+	Tags   []Tag       `json:"tags" gorm:"-"`   // from bill_tag
+	Splits []BillSplit `json:"splits" gorm:"-"` // from bill_split
 }
 
 func NewBill() *Bill {
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// SavingsGoal is money a family saves toward something, its progress is the sum of the contributions
+type SavingsGoal struct {
+	gorm.Model
+	FamilyID     uint       `json:"family_id" gorm:"not null;index"`
+	Name         string     `json:"name" gorm:"size:100;not null"`
+	TargetAmount int        `json:"target_amount" gorm:"not null"` // 分 in the base currency, converted when it changes
+	TargetDate   *time.Time `json:"target_date"`                   // nil for no deadline
+	Note         string     `json:"note" gorm:"size:255"`
+	CreatedBy    uint       `json:"created_by" gorm:"not null"`
+	ArchivedAt   *time.Time `json:"archived_at"` // archived goal takes no more contributions
+}
+
+func NewSavingsGoal() *SavingsGoal {
+	return &SavingsGoal{}
+}
+
+// GoalContribution is money put into a goal, negative when taken out. It may come from a bill
+// or a transfer, it does not count while that bill or transfer is deleted.
+type GoalContribution struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	GoalID     uint      `json:"goal_id" gorm:"not null;index"`
+	FamilyID   uint      `json:"family_id" gorm:"not null;index"`
+	Amount     int       `json:"amount" gorm:"not null"` // 分 in the base currency, converted when it changes
+	Date       time.Time `json:"date" gorm:"not null"`
+	BillID     uint      `json:"bill_id" gorm:"not null;default:0;index"`
+	TransferID uint      `json:"transfer_id" gorm:"not null;default:0;index"`
+	Note       string    `json:"note" gorm:"size:255"`
+	CreatedBy  uint      `json:"created_by" gorm:"not null"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func NewGoalContribution() *GoalContribution {
+	return &GoalContribution{}
+}
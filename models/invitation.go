@@ -0,0 +1,30 @@
+package models
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+type FamilyInvitation struct {
+	gorm.Model
+	FamilyID   uint       `json:"family_id" gorm:"not null;index"`
+	Code       string     `json:"code" gorm:"size:16;uniqueIndex;not null"`
+	CreatedBy  uint       `json:"created_by" gorm:"not null"`
+	Permission string     `json:"permission" gorm:"size:20;not null"` // permission given to who joins with it
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null"`
+	MaxUses    int        `json:"max_uses" gorm:"not null;default:1"` // 0 means unlimited
+	Uses       int        `json:"uses" gorm:"not null;default:0"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+func NewFamilyInvitation() *FamilyInvitation {
+	return &FamilyInvitation{}
+}
+
+// Usable reports whether someone can still join with the invitation at now
+func (i *FamilyInvitation) Usable(now time.Time) bool {
+	if i.RevokedAt != nil || now.After(i.ExpiresAt) {
+		return false
+	}
+	return i.MaxUses == 0 || i.Uses < i.MaxUses
+}
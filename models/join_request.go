@@ -0,0 +1,21 @@
+package models
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+type FamilyJoinRequest struct {
+	gorm.Model
+	FamilyID   uint       `json:"family_id" gorm:"not null;index"`
+	UserID     uint       `json:"user_id" gorm:"not null;index"`
+	Role       string     `json:"role" gorm:"size:20;not null"`
+	Status     string     `json:"status" gorm:"size:20;not null;index"` // pending, approved, rejected, cancelled
+	Reason     string     `json:"reason" gorm:"size:255"`               // why it was rejected
+	ReviewedBy *uint      `json:"reviewed_by"`
+	ReviewedAt *time.Time `json:"reviewed_at"`
+}
+
+func NewFamilyJoinRequest() *FamilyJoinRequest {
+	return &FamilyJoinRequest{}
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// Loan is money lent to or borrowed from a counterparty. What is still owed is
+// the principal plus the interest minus the repayments.
+type Loan struct {
+	gorm.Model
+	FamilyID       uint       `json:"family_id" gorm:"not null;index"`
+	Direction      string     `json:"direction" gorm:"size:20;not null"`     // lent, borrowed
+	Object         string     `json:"object" gorm:"size:100;not null;index"` // 借给谁/向谁借的, name of CounterpartyID kept in sync
+	CounterpartyID uint       `json:"counterparty_id" gorm:"not null;default:0;index"`
+	Principal      int        `json:"principal" gorm:"not null"`                        // 分 of Currency
+	Currency       string     `json:"currency" gorm:"size:3;not null;default:'CNY'"`    // ISO 4217
+	InterestRate   float64    `json:"interest_rate" gorm:"type:numeric(8,4);default:0"` // simple yearly interest in percent, 0 for none
+	StartDate      time.Time  `json:"start_date" gorm:"not null"`
+	DueDate        *time.Time `json:"due_date"` // nil for no due date
+	Note           string     `json:"note" gorm:"size:255"`
+	CreatedBy      uint       `json:"created_by" gorm:"not null"`
+	ClosedAt       *time.Time `json:"closed_at"` // closed by hand, e.g. forgiven, it is no longer owed
+}
+
+func NewLoan() *Loan {
+	return &Loan{}
+}
+
+// LoanRepayment pays back part of a loan. It may come from a bill, it does not count while the bill is deleted.
+type LoanRepayment struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	LoanID    uint      `json:"loan_id" gorm:"not null;index"`
+	FamilyID  uint      `json:"family_id" gorm:"not null;index"`
+	Amount    int       `json:"amount" gorm:"not null"` // 分 of the currency of the loan
+	Date      time.Time `json:"date" gorm:"not null"`
+	BillID    uint      `json:"bill_id" gorm:"not null;default:0;index"`
+	Note      string    `json:"note" gorm:"size:255"`
+	CreatedBy uint      `json:"created_by" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewLoanRepayment() *LoanRepayment {
+	return &LoanRepayment{}
+}
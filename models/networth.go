@@ -0,0 +1,82 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Asset is something a family owns besides the money in its accounts, like a house or a car,
+// or with Kind liability something it owes, like a mortgage. Its value is kept up to date by hand.
+type Asset struct {
+	gorm.Model
+	FamilyID   uint       `json:"family_id" gorm:"not null;index"`
+	Name       string     `json:"name" gorm:"size:100;not null"`
+	Kind       string     `json:"kind" gorm:"size:20;not null"` // asset, liability
+	Category   string     `json:"category" gorm:"size:50"`      // free text, like property, vehicle, mortgage
+	Value      int        `json:"value" gorm:"not null"`        // 分 of Currency, positive for liabilities too
+	Currency   string     `json:"currency" gorm:"size:3;not null;default:'CNY'"`
+	Note       string     `json:"note" gorm:"size:255"`
+	ArchivedAt *time.Time `json:"archived_at"` // sold or paid off, no longer counted
+}
+
+func NewAsset() *Asset {
+	return &Asset{}
+}
+
+// NetWorthItem is one part of a net worth: an account, an asset or a liability
+type NetWorthItem struct {
+	Kind       string `json:"kind"` // account, asset, liability
+	ID         uint   `json:"id"`
+	Name       string `json:"name"`
+	Currency   string `json:"currency"`
+	Amount     int64  `json:"amount"`      // 分 of Currency, negative for what is owed
+	BaseAmount *int64 `json:"base_amount"` // Amount in the base currency, nil without an exchange rate
+}
+
+// NetWorthItems is stored as json text
+type NetWorthItems []NetWorthItem
+
+func (items NetWorthItems) Value() (driver.Value, error) {
+	if items == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(items)
+	return string(b), err
+}
+
+func (items *NetWorthItems) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), items)
+	case []byte:
+		return json.Unmarshal(v, items)
+	case nil:
+		*items = nil
+		return nil
+	}
+	return errors.New("unsupported type for NetWorthItems")
+}
+
+// NetWorthSnapshot is the net worth of a family at a moment with what it was made of,
+// amounts in 分 of BaseCurrency. Snapshots are never modified.
+type NetWorthSnapshot struct {
+	ID           uint          `json:"id" gorm:"primaryKey"`
+	FamilyID     uint          `json:"family_id" gorm:"not null;index:idx_net_worth_family_date,priority:1"`
+	Date         time.Time     `json:"date" gorm:"not null;index:idx_net_worth_family_date,priority:2"`
+	BaseCurrency string        `json:"base_currency" gorm:"size:3;not null"`
+	Assets       int64         `json:"assets" gorm:"not null"`
+	Liabilities  int64         `json:"liabilities" gorm:"not null"` // positive
+	NetWorth     int64         `json:"net_worth" gorm:"not null"`   // assets - liabilities
+	Unconverted  int           `json:"unconverted" gorm:"not null"` // items left out of the sums, their currency has no exchange rate
+	Source       string        `json:"source" gorm:"size:20;not null"`
+	Items        NetWorthItems `json:"items" gorm:"type:text;not null"`
+	CreatedBy    uint          `json:"created_by" gorm:"not null;default:0"` // 0 for automatic snapshots
+	CreatedAt    time.Time     `json:"created_at"`
+}
+
+func NewNetWorthSnapshot() *NetWorthSnapshot {
+	return &NetWorthSnapshot{}
+}
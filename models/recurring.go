@@ -0,0 +1,97 @@
+package models
+
+import (
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"gorm.io/gorm"
+	"time"
+)
+
+// RecurringBill is a rule that creates the same bill on a schedule
+type RecurringBill struct {
+	gorm.Model
+	FamilyID  uint `json:"family_id" gorm:"not null;index"`
+	CreatedBy uint `json:"created_by" gorm:"not null"`
+
+	// template of the bills, same meaning as in Bill
+	Type           string `json:"type" gorm:"size:20;not null"`
+	Amount         int    `json:"amount" gorm:"not null"`
+	Currency       string `json:"currency" gorm:"size:3;not null;default:'CNY'"`
+	CategoryID     uint   `json:"category_id" gorm:"not null"`
+	Category       string `json:"category" gorm:"size:100;not null"`
+	Description    string `json:"description" gorm:"size:255"`
+	Object         string `json:"object" gorm:"size:100;not null"`
+	CounterpartyID uint   `json:"counterparty_id" gorm:"not null;default:0"`
+	Username       string `json:"username" gorm:"size:100;not null"`
+
+	Frequency      string     `json:"frequency" gorm:"size:20;not null"`  // daily, weekly, monthly, yearly
+	Interval       int        `json:"interval" gorm:"not null;default:1"` // every Interval days/weeks/months/years
+	StartDate      time.Time  `json:"start_date" gorm:"not null"`         // first occurrence, its time of day, weekday and day are kept
+	EndDate        *time.Time `json:"end_date"`                           // no occurrence after it
+	Count          int        `json:"count" gorm:"not null;default:0"`    // number of occurrences, 0 for no limit
+	LastDayOfMonth bool       `json:"last_day_of_month" gorm:"not null;default:false"`
+
+	Generated int        `json:"generated" gorm:"not null;default:0"` // occurrences before this seq are done
+	NextDate  *time.Time `json:"next_date" gorm:"index"`              // nil when the rule has ended
+	PausedAt  *time.Time `json:"paused_at"`
+}
+
+func NewRecurringBill() *RecurringBill {
+	return &RecurringBill{}
+}
+
+// Occurrence returns the date of the seq-th occurrence, counted from 0.
+// Every date is computed from StartDate, so the 31st stays the 31st after a short month.
+func (r *RecurringBill) Occurrence(seq int) time.Time {
+	start := r.StartDate.UTC()
+	n := seq * r.Interval
+
+	switch r.Frequency {
+	case consts.FrequencyDaily:
+		return start.AddDate(0, 0, n)
+	case consts.FrequencyWeekly:
+		return start.AddDate(0, 0, 7*n)
+	case consts.FrequencyYearly:
+		return addMonths(start, 12*n, r.LastDayOfMonth)
+	default:
+		return addMonths(start, n, r.LastDayOfMonth)
+	}
+}
+
+// Ended reports whether the seq-th occurrence is past Count or EndDate
+func (r *RecurringBill) Ended(seq int) bool {
+	if r.Count > 0 && seq >= r.Count {
+		return true
+	}
+	return r.EndDate != nil && r.Occurrence(seq).After(*r.EndDate)
+}
+
+// addMonths clamps the day to the end of shorter months, time.AddDate would overflow into the next one
+func addMonths(t time.Time, months int, lastDay bool) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+
+	day := t.Day()
+	if lastDay || day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+}
+
+// RecurringOccurrence records what happened to one occurrence of a rule,
+// the unique index makes generating a bill twice impossible
+type RecurringOccurrence struct {
+	ID     uint      `json:"id" gorm:"primaryKey"`
+	RuleID uint      `json:"rule_id" gorm:"not null;uniqueIndex:idx_recurring_occurrence,priority:1"`
+	Seq    int       `json:"seq" gorm:"not null;uniqueIndex:idx_recurring_occurrence,priority:2"`
+	Date   time.Time `json:"date" gorm:"not null"` // scheduled date
+	Status string    `json:"status" gorm:"size:20;not null"`
+	BillID uint      `json:"bill_id" gorm:"not null;default:0"` // bill generated for it
+
+	// changes of a single pending occurrence, nil keeps the rule's value
+	Amount      *int       `json:"amount"`
+	Description *string    `json:"description" gorm:"size:255"`
+	BillDate    *time.Time `json:"bill_date"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// BillSplit is the part of an expense one member has to bear, the parts add up to the amount of the bill
+type BillSplit struct {
+	ID       uint `json:"id" gorm:"primaryKey"`
+	BillID   uint `json:"bill_id" gorm:"not null;uniqueIndex:idx_bill_split_user,priority:1"`
+	FamilyID uint `json:"family_id" gorm:"not null;index"`
+	UserID   uint `json:"user_id" gorm:"not null;uniqueIndex:idx_bill_split_user,priority:2"`
+	Amount   int  `json:"amount" gorm:"not null"`           // 分
+	Shares   int  `json:"shares" gorm:"not null;default:0"` // weight in equal and share mode, 0 in exact mode
+}
+
+// Settlement is money paid back between members, it moves their balances towards zero
+type Settlement struct {
+	gorm.Model
+	FamilyID   uint      `json:"family_id" gorm:"not null;index"`
+	FromUserID uint      `json:"from_user_id" gorm:"not null"` // who paid
+	ToUserID   uint      `json:"to_user_id" gorm:"not null"`   // who received
+	Amount     int       `json:"amount" gorm:"not null"`       // 分 in the base currency of the family
+	Date       time.Time `json:"date" gorm:"not null"`
+	Note       string    `json:"note" gorm:"size:255"`
+	CreatedBy  uint      `json:"created_by" gorm:"not null"`
+}
+
+func NewSettlement() *Settlement {
+	return &Settlement{}
+}
@@ -0,0 +1,21 @@
+package models
+
+import "gorm.io/gorm"
+
+// Tag is a free label of a family, a bill can have many of them
+type Tag struct {
+	gorm.Model
+	FamilyID uint   `json:"family_id" gorm:"not null;index"`
+	Name     string `json:"name" gorm:"size:50;not null"`
+	Color    string `json:"color" gorm:"size:20"`
+}
+
+func NewTag() *Tag {
+	return &Tag{}
+}
+
+// BillTag links bills and tags, rows are hard deleted
+type BillTag struct {
+	BillID uint `json:"bill_id" gorm:"primaryKey"`
+	TagID  uint `json:"tag_id" gorm:"primaryKey;index"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// RefreshToken only keeps the sha256 of the token handed to the client
+type RefreshToken struct {
+	gorm.Model
+	TokenHash string     `json:"-" gorm:"size:64;uniqueIndex;not null"`
+	Subject   string     `json:"subject" gorm:"size:100;not null;index"` // phone for user
+	Audience  string     `json:"audience" gorm:"size:20;not null"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+func NewRefreshToken() *RefreshToken {
+	return &RefreshToken{}
+}
+
+// RevokedToken is an access token (by jti) that must not be accepted before it expires
+type RevokedToken struct {
+	JTI       string    `json:"jti" gorm:"primaryKey;size:64"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null;index"`
+	CreatedAt time.Time
+}
@@ -21,6 +21,8 @@ func InitRoute() {
 	{
 		auth.POST("/register", handler.UserRegister)
 		auth.POST("/login", handler.UserLogin)
+		auth.POST("/refresh", handler.RefreshToken)
+		auth.POST("/logout", middleware.JWTAuth(consts.User), handler.Logout)
 	}
 
 	user := R.Group("/user")
@@ -28,27 +30,174 @@ func InitRoute() {
 	{
 		user.GET("/info/:phone", handler.GetUserInfoByPhone)
 		user.POST("/update", handler.ModifyUserSelf)
-		// Test
-		user.GET("/list", handler.ListUser)
 
 		user.GET("/family", handler.ListUserFamily)
 	}
 
+	R.POST("/admin/login", handler.AdminLogin)
+
+	admin := R.Group("/admin")
+	admin.Use(middleware.JWTAuth(consts.Admin))
+	{
+		admin.POST("/logout", handler.Logout)
+
+		admin.GET("/users", handler.AdminListUsers)
+		admin.POST("/user/disable/:user_id", handler.AdminDisableUser)
+		admin.POST("/user/enable/:user_id", handler.AdminEnableUser)
+		admin.POST("/user/reset-password/:user_id", handler.AdminResetPassword)
+
+		admin.GET("/families", handler.AdminListFamilies)
+		admin.GET("/family/bills/:family_id", handler.AdminFamilyBillCount)
+	}
+
 	family := R.Group("/family")
 	family.Use(middleware.JWTAuth(consts.User))
 	{
 		family.POST("/create", handler.CreateFamily)
 		family.POST("/join", handler.AddUserToFamily)
-		family.GET("/members/:family_id", handler.ListFamilyMember)
-		family.GET("/list", handler.ListAllFamilies)
+		family.POST("/join/invitation", handler.JoinFamilyByInvitation)
+		family.GET("/members/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListFamilyMember)
+		family.GET("/goals/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.FamilyGoalStatuses)
+		family.POST("/member/update/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.UpdateFamilyMember)
+		family.POST("/member/remove/:family_id/:user_id", middleware.FamilyAuth(consts.FamilyManager), handler.RemoveFamilyMember)
+		family.POST("/leave/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.LeaveFamily)
+		family.POST("/owner/transfer/:family_id", middleware.FamilyAuth(consts.FamilyOwner), handler.TransferFamilyOwnership)
+
+		family.GET("/list", handler.ListMyFamilies)
+		family.POST("/password/:family_id", middleware.FamilyAuth(consts.FamilyOwner), handler.SetFamilyPassword)
+		family.POST("/settings/:family_id", middleware.FamilyAuth(consts.FamilyManager), handler.UpdateFamilySettings)
+
+		family.POST("/archive/:family_id", middleware.FamilyAuth(consts.FamilyOwner), handler.ArchiveFamily)
+		family.POST("/restore/:family_id", middleware.DeletedFamilyAuth(consts.FamilyOwner), handler.RestoreFamily)
+		family.DELETE("/delete/:family_id", middleware.FamilyAuth(consts.FamilyOwner), handler.DeleteFamily)
+
+		family.POST("/invitation/create/:family_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.CreateInvitation)
+		family.GET("/invitation/list/:family_id", middleware.FamilyAuth(consts.FamilyManager), handler.ListInvitations)
+		family.POST("/invitation/revoke/:family_id/:invitation_id", middleware.FamilyAuth(consts.FamilyManager), handler.RevokeInvitation)
+
+		family.GET("/request/list/:family_id", middleware.FamilyAuth(consts.FamilyManager), handler.ListJoinRequests)
+		family.POST("/request/approve/:family_id/:request_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.ApproveJoinRequest)
+		family.POST("/request/reject/:family_id/:request_id", middleware.FamilyAuth(consts.FamilyManager), handler.RejectJoinRequest)
+		family.GET("/request/mine", handler.ListMyJoinRequests)
+		family.POST("/request/cancel/:request_id", handler.CancelJoinRequest)
 	}
 
 	financial := R.Group("/financial")
 	financial.Use(middleware.JWTAuth(consts.User))
 	{
-		financial.POST("/bill/create/:family_id", handler.CreateBill)
-		financial.GET("/bill/list/:family_id", handler.ListBills)
-		financial.GET("/bill/select/:family_id", handler.SelectBills)
-		financial.DELETE("/bill/delete/:family_id/:bill_id", handler.DeleteBill)
+		financial.POST("/bill/create/:family_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.CreateBill)
+		financial.GET("/bill/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListBills)
+		financial.GET("/bill/select/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.SelectBills)
+		financial.PUT("/bill/:family_id/:bill_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.UpdateBill)
+		financial.DELETE("/bill/delete/:family_id/:bill_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.DeleteBill)
+		financial.GET("/bill/revisions/:family_id/:bill_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListBillRevisions)
+
+		financial.GET("/bill/trash/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListTrashBills)
+		financial.POST("/bill/restore/:family_id/:bill_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.RestoreBill)
+		financial.DELETE("/bill/purge/:family_id/:bill_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.PurgeBill)
+
+		financial.POST("/bill/attachment/upload/:family_id/:bill_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.UploadAttachment)
+		financial.GET("/bill/attachment/list/:family_id/:bill_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListAttachments)
+		financial.GET("/bill/attachment/download/:family_id/:attachment_id", middleware.FamilyAuth(consts.FamilyViewer), handler.DownloadAttachment)
+		financial.DELETE("/bill/attachment/delete/:family_id/:attachment_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.DeleteAttachment)
+
+		financial.GET("/category/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListCategories)
+		financial.POST("/category/create/:family_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.CreateCategory)
+		financial.POST("/category/update/:family_id/:category_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.UpdateCategory)
+		financial.POST("/category/archive/:family_id/:category_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.ArchiveCategory)
+		financial.POST("/category/unarchive/:family_id/:category_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.UnarchiveCategory)
+		financial.DELETE("/category/delete/:family_id/:category_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.DeleteCategory)
+
+		financial.GET("/stats/summary/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.StatsSummary)
+		financial.GET("/stats/category/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.StatsCategories)
+		financial.GET("/stats/member/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.StatsMembers)
+		financial.GET("/stats/compare/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.StatsCompare)
+		financial.GET("/stats/pivot/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.StatsPivot)
+
+		financial.GET("/counterparty/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListCounterparties)
+		financial.GET("/counterparty/totals/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.CounterpartyTotals)
+		financial.POST("/counterparty/create/:family_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.CreateCounterparty)
+		financial.POST("/counterparty/update/:family_id/:counterparty_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.UpdateCounterparty)
+		financial.POST("/counterparty/merge/:family_id/:counterparty_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.MergeCounterparties)
+		financial.DELETE("/counterparty/delete/:family_id/:counterparty_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.DeleteCounterparty)
+
+		financial.GET("/account/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListAccounts)
+		financial.GET("/account/ledger/:family_id/:account_id", middleware.FamilyAuth(consts.FamilyViewer), handler.AccountLedger)
+		financial.POST("/account/create/:family_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.CreateAccount)
+		financial.POST("/account/update/:family_id/:account_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.UpdateAccount)
+		financial.POST("/account/archive/:family_id/:account_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.ArchiveAccount)
+		financial.POST("/account/unarchive/:family_id/:account_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.UnarchiveAccount)
+		financial.DELETE("/account/delete/:family_id/:account_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.DeleteAccount)
+
+		financial.GET("/transfer/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListTransfers)
+		financial.POST("/transfer/create/:family_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.CreateTransfer)
+		financial.POST("/transfer/update/:family_id/:transfer_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.UpdateTransfer)
+		financial.DELETE("/transfer/delete/:family_id/:transfer_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.DeleteTransfer)
+
+		financial.GET("/budget/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListBudgets)
+		financial.GET("/budget/status/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.BudgetStatuses)
+		financial.POST("/budget/create/:family_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.CreateBudget)
+		financial.POST("/budget/update/:family_id/:budget_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.UpdateBudget)
+		financial.DELETE("/budget/delete/:family_id/:budget_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.DeleteBudget)
+
+		financial.GET("/currency/rate/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListExchangeRates)
+		financial.POST("/currency/rate/set/:family_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.SetExchangeRate)
+		financial.POST("/currency/rate/import/:family_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.ImportExchangeRates)
+		financial.DELETE("/currency/rate/delete/:family_id/:rate_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.DeleteExchangeRate)
+
+		financial.GET("/split/balance/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.SplitBalances)
+		financial.GET("/split/settlement/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListSettlements)
+		financial.POST("/split/settlement/create/:family_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.CreateSettlement)
+		financial.DELETE("/split/settlement/delete/:family_id/:settlement_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.DeleteSettlement)
+
+		financial.GET("/goal/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListGoals)
+		financial.POST("/goal/create/:family_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.CreateGoal)
+		financial.POST("/goal/update/:family_id/:goal_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.UpdateGoal)
+		financial.POST("/goal/archive/:family_id/:goal_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.ArchiveGoal)
+		financial.POST("/goal/unarchive/:family_id/:goal_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.UnarchiveGoal)
+		financial.DELETE("/goal/delete/:family_id/:goal_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.DeleteGoal)
+		financial.GET("/goal/contribution/list/:family_id/:goal_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListContributions)
+		financial.POST("/goal/contribution/add/:family_id/:goal_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.AddContribution)
+		financial.DELETE("/goal/contribution/delete/:family_id/:goal_id/:contribution_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.DeleteContribution)
+
+		financial.GET("/loan/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListLoans)
+		financial.GET("/loan/counterparty/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.LoanCounterparties)
+		financial.GET("/loan/overdue/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.OverdueLoans)
+		financial.POST("/loan/create/:family_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.CreateLoan)
+		financial.POST("/loan/update/:family_id/:loan_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.UpdateLoan)
+		financial.POST("/loan/close/:family_id/:loan_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.CloseLoan)
+		financial.POST("/loan/reopen/:family_id/:loan_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.ReopenLoan)
+		financial.DELETE("/loan/delete/:family_id/:loan_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.DeleteLoan)
+		financial.GET("/loan/repayment/list/:family_id/:loan_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListRepayments)
+		financial.POST("/loan/repayment/add/:family_id/:loan_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.AddRepayment)
+		financial.DELETE("/loan/repayment/delete/:family_id/:loan_id/:repayment_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.DeleteRepayment)
+
+		financial.GET("/networth/asset/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListAssets)
+		financial.POST("/networth/asset/create/:family_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.CreateAsset)
+		financial.POST("/networth/asset/update/:family_id/:asset_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.UpdateAsset)
+		financial.POST("/networth/asset/archive/:family_id/:asset_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.ArchiveAsset)
+		financial.POST("/networth/asset/unarchive/:family_id/:asset_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.UnarchiveAsset)
+		financial.DELETE("/networth/asset/delete/:family_id/:asset_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.DeleteAsset)
+		financial.GET("/networth/current/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.CurrentNetWorth)
+		financial.GET("/networth/history/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.NetWorthHistory)
+		financial.POST("/networth/snapshot/create/:family_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.CreateNetWorthSnapshot)
+		financial.DELETE("/networth/snapshot/delete/:family_id/:snapshot_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.DeleteNetWorthSnapshot)
+
+		financial.POST("/recurring/create/:family_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.CreateRecurringBill)
+		financial.GET("/recurring/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListRecurringBills)
+		financial.GET("/recurring/occurrences/:family_id/:rule_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListRecurringOccurrences)
+		financial.POST("/recurring/update/:family_id/:rule_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.UpdateRecurringBill)
+		financial.POST("/recurring/pause/:family_id/:rule_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.PauseRecurringBill)
+		financial.POST("/recurring/resume/:family_id/:rule_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.ResumeRecurringBill)
+		financial.DELETE("/recurring/delete/:family_id/:rule_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.DeleteRecurringBill)
+		financial.POST("/recurring/occurrence/skip/:family_id/:rule_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.SkipOccurrence)
+		financial.POST("/recurring/occurrence/edit/:family_id/:rule_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.EditOccurrence)
+		financial.POST("/recurring/occurrence/reset/:family_id/:rule_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.ResetOccurrence)
+
+		financial.GET("/tag/list/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.ListTags)
+		financial.GET("/tag/summary/:family_id", middleware.FamilyAuth(consts.FamilyViewer), handler.TagSummaries)
+		financial.POST("/tag/create/:family_id", middleware.FamilyAuth(consts.FamilyMember), middleware.FamilyWritable(), handler.CreateTag)
+		financial.POST("/tag/update/:family_id/:tag_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.UpdateTag)
+		financial.DELETE("/tag/delete/:family_id/:tag_id", middleware.FamilyAuth(consts.FamilyManager), middleware.FamilyWritable(), handler.DeleteTag)
 	}
 }
@@ -9,6 +9,10 @@ const (
 
 	OneDay    = 24 * time.Hour
 	ThreeDays = 3 * OneDay
+	SevenDays = 7 * OneDay
+
+	AccessTokenExpire  = 30 * time.Minute
+	RefreshTokenExpire = SevenDays
 
 	MB     = 1024 * 1024
 	TreeMB = 3 * MB
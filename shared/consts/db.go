@@ -1,8 +1,44 @@
 package consts
 
 const (
-	UserTable       = "user"
-	FamilyTable     = "family"
-	FamilyUserTable = "family_user"
-	BillTable       = "bill"
+	UserTable         = "user"
+	FamilyTable       = "family"
+	FamilyUserTable   = "family_user"
+	BillTable         = "bill"
+	BillRevisionTable = "bill_revision"
+	CategoryTable     = "category"
+	TagTable          = "tag"
+	BillTagTable      = "bill_tag"
+	AttachmentTable   = "attachment"
+
+	BillSplitTable  = "bill_split"
+	SettlementTable = "settlement"
+
+	CounterpartyTable      = "counterparty"
+	CounterpartyAliasTable = "counterparty_alias"
+
+	AccountTable  = "account"
+	TransferTable = "transfer"
+
+	ExchangeRateTable = "exchange_rate"
+
+	AssetTable            = "asset"
+	NetWorthSnapshotTable = "net_worth_snapshot"
+
+	BudgetTable = "budget"
+
+	SavingsGoalTable      = "savings_goal"
+	GoalContributionTable = "goal_contribution"
+
+	LoanTable          = "loan"
+	LoanRepaymentTable = "loan_repayment"
+
+	RecurringBillTable       = "recurring_bill"
+	RecurringOccurrenceTable = "recurring_occurrence"
+	RefreshTokenTable        = "refresh_token"
+	RevokedTokenTable        = "revoked_token"
+	AdminTable               = "admin"
+
+	FamilyInvitationTable  = "family_invitation"
+	FamilyJoinRequestTable = "family_join_request"
 )
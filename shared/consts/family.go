@@ -0,0 +1,30 @@
+package consts
+
+import "time"
+
+// permission of a member inside a family, from high to low
+const (
+	FamilyOwner   = "owner"
+	FamilyManager = "manager"
+	FamilyMember  = "member"
+	FamilyViewer  = "viewer"
+)
+
+const (
+	InvitationExpire    = 7 * 24 * time.Hour
+	MaxInvitationExpire = 30 * 24 * time.Hour
+
+	// payload for QR codes, the app opens the join page with the code
+	InvitationJoinURL = "hdudx2://family/join?code="
+
+	// a deleted family can be restored within this period, then it is purged
+	FamilyPurgeDelay = 7 * 24 * time.Hour
+)
+
+// status of a join request
+const (
+	JoinRequestPending   = "pending"
+	JoinRequestApproved  = "approved"
+	JoinRequestRejected  = "rejected"
+	JoinRequestCancelled = "cancelled"
+)
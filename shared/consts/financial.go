@@ -0,0 +1,157 @@
+package consts
+
+import "time"
+
+const (
+	BillTypeIncome  = "income"
+	BillTypeExpense = "expense"
+)
+
+// category of bills whose category text is empty
+const OtherCategoryName = "其他"
+
+// what happened to a bill in a revision
+const (
+	BillActionCreate  = "create"
+	BillActionUpdate  = "update"
+	BillActionDelete  = "delete"
+	BillActionRestore = "restore"
+)
+
+// how an expense is split between members, empty for a bill that is not split
+const (
+	SplitEqual = "equal"
+	SplitShare = "share"
+	SplitExact = "exact"
+
+	MaxSplitMembers = 50
+)
+
+const (
+	DefaultCurrency = "CNY"
+
+	MaxExchangeRateImportSize = 1 * MB
+	MaxExchangeRateImportRows = 10000
+)
+
+// kinds of counterparties
+const (
+	CounterpartyPerson   = "person"
+	CounterpartyMerchant = "merchant"
+	CounterpartyEmployer = "employer"
+	CounterpartyOther    = "other"
+)
+
+// types of accounts
+const (
+	AccountCash    = "cash"
+	AccountDebit   = "debit"
+	AccountCredit  = "credit"
+	AccountEWallet = "ewallet"
+
+	MaxLedgerEntries = 1000
+)
+
+// periods of statistics, weeks start on Monday as in budgets
+const (
+	StatsDay   = "day"
+	StatsWeek  = "week"
+	StatsMonth = "month"
+	StatsYear  = "year"
+
+	MaxStatsPeriods = 1000
+	MaxPivotCells   = 10000
+)
+
+// kinds of the items of a net worth, an Asset is an asset or a liability
+const (
+	NetWorthAccount   = "account"
+	NetWorthAsset     = "asset"
+	NetWorthLiability = "liability"
+)
+
+// how a net worth snapshot was taken
+const (
+	SnapshotAuto   = "auto" // by the monthly task
+	SnapshotManual = "manual"
+
+	NetWorthCheckInterval = time.Hour
+)
+
+// periods of budgets
+const (
+	BudgetWeekly  = "weekly"
+	BudgetMonthly = "monthly"
+	BudgetYearly  = "yearly"
+	BudgetCustom  = "custom"
+
+	DefaultBudgetWarnPercent = 80
+)
+
+// status of a budget in a period
+const (
+	BudgetOK       = "ok"
+	BudgetWarning  = "warning"  // spent reached the warn percent
+	BudgetExceeded = "exceeded" // spent more than the budget
+)
+
+// status of a savings goal
+const (
+	GoalAchieved   = "achieved"
+	GoalOnTrack    = "on_track"
+	GoalBehind     = "behind"      // saved less than the time passed would need
+	GoalOverdue    = "overdue"     // target date passed before the target was reached
+	GoalNoDeadline = "no_deadline" // not achieved, no target date
+)
+
+// directions of loans
+const (
+	LoanLent     = "lent"     // money the family lent, owed to it
+	LoanBorrowed = "borrowed" // money the family borrowed, owed by it
+)
+
+// status of a loan
+const (
+	LoanOpen    = "open"
+	LoanOverdue = "overdue" // open after the due date
+	LoanRepaid  = "repaid"
+	LoanClosed  = "closed" // closed by hand before it was repaid
+)
+
+// frequencies of recurring bills
+const (
+	FrequencyDaily   = "daily"
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+	FrequencyYearly  = "yearly"
+)
+
+// status of an occurrence of a recurring bill
+const (
+	OccurrencePending   = "pending" // edited before it is due
+	OccurrenceSkipped   = "skipped"
+	OccurrenceGenerated = "generated"
+)
+
+const (
+	RecurringCheckInterval   = 10 * time.Minute
+	MaxOccurrencesPerRun     = 1000 // a rule far behind is caught up over several runs
+	MaxRecurringPreviewCount = 100
+)
+
+// attachments of bills
+const (
+	MaxAttachmentSize  = TreeMB
+	MaxBillAttachments = 10
+	ThumbnailSize      = 256              // px, longer side
+	StorageTimeout     = 30 * time.Second // a whole request to S3, body included
+)
+
+// AttachmentMimeTypes are the sniffed types that can be uploaded, true if a thumbnail can be made
+var AttachmentMimeTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      false,
+	"application/pdf": false,
+}
@@ -1,6 +1,10 @@
 package consts
 
 const (
-	JWTKeyFile = "./config/jwt"
-	DBEnvFile  = "./config/db"
+	JWTKeyFile   = "./config/jwt"
+	DBEnvFile    = "./config/db"
+	AdminEnvFile = "./config/admin"
+
+	StorageEnvFile    = "./config/storage"
+	DefaultStorageDir = "./data/attachments"
 )
@@ -0,0 +1,38 @@
+package task
+
+import (
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/storage"
+	"gorm.io/gorm"
+)
+
+const purgeBatchSize = 500
+
+// purgeExpiredBills empties the trash of every family according to its retention days
+func purgeExpiredBills() error {
+	for {
+		var billIDs []uint
+		if err := db.DB.Table(consts.BillTable).
+			Joins("JOIN family ON family.id = bill.family_id").
+			Where("bill.deleted_at IS NOT NULL AND bill.deleted_at < NOW() - family.trash_retention_days * INTERVAL '1 day'").
+			Limit(purgeBatchSize).
+			Pluck("bill.id", &billIDs).Error; err != nil {
+			return err
+		}
+		if len(billIDs) == 0 {
+			return nil
+		}
+
+		var keys []string
+		err := db.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			keys, err = db.PurgeBills(tx, billIDs)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		storage.DeleteAll(keys)
+	}
+}
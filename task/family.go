@@ -0,0 +1,34 @@
+package task
+
+import (
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/hewo233/hdu-dx2/utils/storage"
+	"gorm.io/gorm"
+	"time"
+)
+
+// purgeDeletedFamilies removes families deleted longer than the grace period
+func purgeDeletedFamilies() error {
+	var familyIDs []uint
+	if err := db.DB.Table(consts.FamilyTable).
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-consts.FamilyPurgeDelay)).
+		Pluck("id", &familyIDs).Error; err != nil {
+		return err
+	}
+
+	for _, familyID := range familyIDs {
+		var keys []string
+		err := db.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			keys, err = db.PurgeFamily(tx, familyID)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		storage.DeleteAll(keys)
+	}
+
+	return nil
+}
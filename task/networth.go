@@ -0,0 +1,26 @@
+package task
+
+import (
+	"github.com/hewo233/hdu-dx2/db"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"log"
+	"time"
+)
+
+// takeNetWorthSnapshots takes the monthly snapshot of every family that has none this month yet,
+// a failing family does not block the others
+func takeNetWorthSnapshots() error {
+	now := db.BillNow()
+	familyIDs, err := db.FamiliesWithoutSnapshot(time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		return err
+	}
+
+	for _, familyID := range familyIDs {
+		if _, err := db.TakeNetWorthSnapshot(db.DB, familyID, consts.SnapshotAuto, 0); err != nil {
+			log.Println("take net worth snapshot of family", familyID, "failed: ", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package task
+
+import (
+	"github.com/hewo233/hdu-dx2/db"
+	"log"
+)
+
+// generateRecurringBills catches up every due rule, a failing rule does not block the others
+func generateRecurringBills() error {
+	ruleIDs, err := db.DueRecurringBills()
+	if err != nil {
+		return err
+	}
+
+	for _, ruleID := range ruleIDs {
+		if _, err := db.GenerateRecurringBills(ruleID); err != nil {
+			log.Println("generate recurring bill", ruleID, "failed: ", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package task
+
+import (
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"log"
+	"time"
+)
+
+// Init starts the background jobs, call it after db is ready
+func Init() {
+	go every(time.Hour, "purge deleted families", purgeDeletedFamilies)
+	go every(time.Hour, "purge expired bills", purgeExpiredBills)
+	go every(consts.RecurringCheckInterval, "generate recurring bills", generateRecurringBills)
+	go every(consts.NetWorthCheckInterval, "take net worth snapshots", takeNetWorthSnapshots)
+}
+
+// every runs job at start and then once per interval, errors are only logged
+func every(interval time.Duration, name string, job func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := job(); err != nil {
+			log.Println(name+" failed: ", err)
+		}
+		<-ticker.C
+	}
+}
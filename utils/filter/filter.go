@@ -0,0 +1,398 @@
+// Package filter compiles a small filter language into a parameterized SQL condition.
+//
+// Grammar, keywords are case-insensitive:
+//
+//	expr   = term { "OR" term }
+//	term   = factor { "AND" factor }
+//	factor = "NOT" factor | "(" expr ")" | cond
+//	cond   = field op value
+//	op     = "=" | "!=" | ">" | ">=" | "<" | "<=" | "~" | "!~"
+//	value  = word | "quoted string" | "[" value { "," value } "]"
+//
+// "~" is a case-insensitive substring match and only works on text fields.
+// A list value means IN and only works with "=" and "!=".
+// Field names are whitelisted by the caller, values always become placeholders.
+//
+// Example:
+//
+//	category=[餐饮,交通] AND amount>=1000 AND NOT (object="张三" OR description~报销)
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type Kind int
+
+const (
+	Text Kind = iota
+	Int
+	Time
+)
+
+// Field maps a name in the language to a SQL column.
+// If Format is set the condition on Column is put into it with %s,
+// e.g. "bill.id IN (SELECT bill_id FROM bill_tag WHERE %s)" for a field that lives in another table.
+type Field struct {
+	Column string
+	Kind   Kind
+	Format string
+}
+
+func (f Field) wrap(cond string) string {
+	if f.Format == "" {
+		return cond
+	}
+	return fmt.Sprintf(f.Format, cond)
+}
+
+const (
+	maxDepth      = 10
+	maxConditions = 50
+)
+
+var (
+	ErrTooDeep           = fmt.Errorf("filter is nested more than %d levels deep", maxDepth)
+	ErrTooManyConditions = fmt.Errorf("filter has more than %d conditions", maxConditions)
+)
+
+var (
+	dateLayouts = []string{"2006-01-02 15:04:05", "2006-01-02"}
+	likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+)
+
+// EscapeLike escapes the wildcards of ILIKE so s is matched literally
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// Compile turns input into a condition for gorm's Where(sql, args...)
+func Compile(input string, fields map[string]Field) (string, []interface{}, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p := &parser{tokens: tokens, fields: fields}
+	sql, err := p.expr(0)
+	if err != nil {
+		return "", nil, err
+	}
+	if !p.done() {
+		return "", nil, fmt.Errorf("unexpected %q", p.peek().text)
+	}
+
+	return sql, p.args, nil
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func isSpecial(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(`()[],=!<>~"`, r)
+}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")"})
+			i++
+		case r == '[':
+			tokens = append(tokens, token{tokLBracket, "["})
+			i++
+		case r == ']':
+			tokens = append(tokens, token{tokRBracket, "]"})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokComma, ","})
+			i++
+		case r == '"':
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, errors.New("unterminated string")
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					sb.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '"' {
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, token{tokString, sb.String()})
+		case strings.ContainsRune("=!<>~", r):
+			op := string(r)
+			if i+1 < len(runes) && (runes[i+1] == '=' || (r == '!' && runes[i+1] == '~')) {
+				op += string(runes[i+1])
+			}
+			switch op {
+			case "=", "!=", ">", ">=", "<", "<=", "~", "!~":
+			default:
+				return nil, fmt.Errorf("unknown operator %q", op)
+			}
+			tokens = append(tokens, token{tokOp, op})
+			i += len([]rune(op))
+		default:
+			start := i
+			for i < len(runes) && !isSpecial(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokWord, string(runes[start:i])})
+		}
+	}
+
+	return tokens, nil
+}
+
+type parser struct {
+	tokens     []token
+	pos        int
+	fields     map[string]Field
+	args       []interface{}
+	conditions int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{kind: -1, text: "end of filter"}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokWord && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expr(depth int) (string, error) {
+	left, err := p.term(depth)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{left}
+	for p.keyword("OR") {
+		right, err := p.term(depth)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, right)
+	}
+
+	if len(parts) == 1 {
+		return left, nil
+	}
+	return "(" + strings.Join(parts, " OR ") + ")", nil
+}
+
+func (p *parser) term(depth int) (string, error) {
+	left, err := p.factor(depth)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{left}
+	for p.keyword("AND") {
+		right, err := p.factor(depth)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, right)
+	}
+
+	if len(parts) == 1 {
+		return left, nil
+	}
+	return "(" + strings.Join(parts, " AND ") + ")", nil
+}
+
+// factor is where every NOT and ( goes one level deeper, so the depth is checked here
+func (p *parser) factor(depth int) (string, error) {
+	if depth > maxDepth {
+		return "", ErrTooDeep
+	}
+
+	if p.keyword("NOT") {
+		inner, err := p.factor(depth + 1)
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + inner, nil
+	}
+
+	if p.peek().kind == tokLParen {
+		p.next()
+		inner, err := p.expr(depth + 1)
+		if err != nil {
+			return "", err
+		}
+		if p.next().kind != tokRParen {
+			return "", errors.New("missing )")
+		}
+		return "(" + inner + ")", nil
+	}
+
+	return p.cond()
+}
+
+func (p *parser) cond() (string, error) {
+	p.conditions++
+	if p.conditions > maxConditions {
+		return "", ErrTooManyConditions
+	}
+
+	name := p.next()
+	if name.kind != tokWord {
+		return "", fmt.Errorf("expected field, got %q", name.text)
+	}
+	field, ok := p.fields[strings.ToLower(name.text)]
+	if !ok {
+		return "", fmt.Errorf("unknown field %q", name.text)
+	}
+
+	op := p.next()
+	if op.kind != tokOp {
+		return "", fmt.Errorf("expected operator after %s, got %q", name.text, op.text)
+	}
+
+	if p.peek().kind == tokLBracket {
+		return p.listCond(name.text, field, op.text)
+	}
+
+	raw, err := p.value()
+	if err != nil {
+		return "", err
+	}
+
+	switch op.text {
+	case "~", "!~":
+		if field.Kind != Text {
+			return "", fmt.Errorf("~ only works on text fields, not %s", name.text)
+		}
+		p.args = append(p.args, "%"+EscapeLike(raw)+"%")
+		if op.text == "!~" {
+			return field.wrap(field.Column + " NOT ILIKE ?"), nil
+		}
+		return field.wrap(field.Column + " ILIKE ?"), nil
+	case ">", ">=", "<", "<=":
+		if field.Kind == Text {
+			return "", fmt.Errorf("%s only works on number and date fields, not %s", op.text, name.text)
+		}
+	case "=", "!=":
+		if op.text == "!=" {
+			op.text = "<>"
+		}
+	}
+
+	value, err := convert(raw, field.Kind)
+	if err != nil {
+		return "", fmt.Errorf("invalid value for %s: %w", name.text, err)
+	}
+	p.args = append(p.args, value)
+	return field.wrap(field.Column + " " + op.text + " ?"), nil
+}
+
+func (p *parser) listCond(name string, field Field, op string) (string, error) {
+	if op != "=" && op != "!=" {
+		return "", fmt.Errorf("list value only works with = and !=")
+	}
+	p.next()
+
+	var values []interface{}
+	for {
+		raw, err := p.value()
+		if err != nil {
+			return "", err
+		}
+		value, err := convert(raw, field.Kind)
+		if err != nil {
+			return "", fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+		values = append(values, value)
+
+		t := p.next()
+		if t.kind == tokRBracket {
+			break
+		}
+		if t.kind != tokComma {
+			return "", errors.New("missing ]")
+		}
+	}
+
+	p.args = append(p.args, values)
+	if op == "!=" {
+		return field.wrap(field.Column + " NOT IN ?"), nil
+	}
+	return field.wrap(field.Column + " IN ?"), nil
+}
+
+func (p *parser) value() (string, error) {
+	t := p.next()
+	if t.kind != tokWord && t.kind != tokString {
+		return "", fmt.Errorf("expected value, got %q", t.text)
+	}
+	return t.text, nil
+}
+
+func convert(raw string, kind Kind) (interface{}, error) {
+	switch kind {
+	case Int:
+		return strconv.Atoi(raw)
+	case Time:
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, raw); err == nil {
+				return t, nil
+			}
+		}
+		return nil, errors.New("date must be like 2006-01-02 or \"2006-01-02 15:04:05\"")
+	}
+	return raw, nil
+}
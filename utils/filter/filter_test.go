@@ -0,0 +1,116 @@
+package filter
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testFields = map[string]Field{
+	"category":    {Column: "bill.category", Kind: Text},
+	"object":      {Column: "bill.object", Kind: Text},
+	"description": {Column: "bill.description", Kind: Text},
+	"amount":      {Column: "bill.amount", Kind: Int},
+	"date":        {Column: "bill.date", Kind: Time},
+	"tag":         {Column: "tag.name", Kind: Text, Format: "bill.id IN (SELECT bill_id FROM bill_tag JOIN tag ON tag.id = bill_tag.tag_id WHERE %s)"},
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		input string
+		sql   string
+		args  []interface{}
+	}{
+		{`category=餐饮`, `bill.category = ?`, []interface{}{"餐饮"}},
+		{`amount>=1000 AND amount<2000`, `(bill.amount >= ? AND bill.amount < ?)`, []interface{}{1000, 2000}},
+		{`category!=餐饮 OR object="张 三"`, `(bill.category <> ? OR bill.object = ?)`, []interface{}{"餐饮", "张 三"}},
+		{`category=a or not amount=1`, `(bill.category = ? OR NOT bill.amount = ?)`, []interface{}{"a", 1}},
+		{`category=a OR category=b AND amount>1`, `(bill.category = ? OR (bill.category = ? AND bill.amount > ?))`, []interface{}{"a", "b", 1}},
+		{`NOT (category=a OR category=b) AND amount>1`, `(NOT ((bill.category = ? OR bill.category = ?)) AND bill.amount > ?)`, []interface{}{"a", "b", 1}},
+		{`description~50%_off`, `bill.description ILIKE ?`, []interface{}{`%50\%\_off%`}},
+		{`description!~报销`, `bill.description NOT ILIKE ?`, []interface{}{"%报销%"}},
+		{`category=[餐饮,交通]`, `bill.category IN ?`, []interface{}{[]interface{}{"餐饮", "交通"}}},
+		{`amount!=[1, 2]`, `bill.amount NOT IN ?`, []interface{}{[]interface{}{1, 2}}},
+		{`date>=2024-01-01`, `bill.date >= ?`, []interface{}{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}},
+		{`date<"2024-01-01 08:30:00"`, `bill.date < ?`, []interface{}{time.Date(2024, 1, 1, 8, 30, 0, 0, time.UTC)}},
+		{`object="say \"hi\""`, `bill.object = ?`, []interface{}{`say "hi"`}},
+		{`tag=出差`, `bill.id IN (SELECT bill_id FROM bill_tag JOIN tag ON tag.id = bill_tag.tag_id WHERE tag.name = ?)`, []interface{}{"出差"}},
+		{`CATEGORY="'; DROP TABLE bill; --"`, `bill.category = ?`, []interface{}{"'; DROP TABLE bill; --"}},
+	}
+
+	for _, tt := range tests {
+		sql, args, err := Compile(tt.input, testFields)
+		if err != nil {
+			t.Errorf("Compile(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if sql != tt.sql {
+			t.Errorf("Compile(%q) sql = %q, want %q", tt.input, sql, tt.sql)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("Compile(%q) args = %#v, want %#v", tt.input, args, tt.args)
+		}
+		if strings.Count(sql, "?") != len(args) {
+			t.Errorf("Compile(%q) has %d placeholders for %d args", tt.input, strings.Count(sql, "?"), len(args))
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{``, `expected field`},
+		{`unknown=1`, `unknown field "unknown"`},
+		{`category`, `expected operator`},
+		{`category=`, `expected value`},
+		{`category==a`, `unknown operator "=="`},
+		{`category>a`, `only works on number and date fields`},
+		{`amount~1`, `~ only works on text fields`},
+		{`amount=abc`, `invalid value for amount`},
+		{`date=2024-13-01`, `date must be like`},
+		{`object="abc`, `unterminated string`},
+		{`(category=a`, `missing )`},
+		{`category=[a,b`, `missing ]`},
+		{`category>[a]`, `list value only works with = and !=`},
+		{`category=a category=b`, `unexpected "category"`},
+	}
+
+	for _, tt := range tests {
+		_, _, err := Compile(tt.input, testFields)
+		if err == nil {
+			t.Errorf("Compile(%q) succeeded, want error containing %q", tt.input, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Compile(%q) error = %q, want it to contain %q", tt.input, err, tt.err)
+		}
+	}
+}
+
+func TestCompileLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   error
+	}{
+		{"max NOT", strings.Repeat("NOT ", maxDepth) + "amount=1", nil},
+		{"too many NOT", strings.Repeat("NOT ", maxDepth+1) + "amount=1", ErrTooDeep},
+		{"huge NOT chain", strings.Repeat("NOT ", 1000000) + "amount=1", ErrTooDeep},
+		{"max parens", strings.Repeat("(", maxDepth) + "amount=1" + strings.Repeat(")", maxDepth), nil},
+		{"too many parens", strings.Repeat("(", maxDepth+1) + "amount=1" + strings.Repeat(")", maxDepth+1), ErrTooDeep},
+		{"NOT and parens", strings.Repeat("NOT (", maxDepth/2+1) + "amount=1" + strings.Repeat(")", maxDepth/2+1), ErrTooDeep},
+		{"max conditions", strings.Repeat("amount=1 AND ", maxConditions-1) + "amount=1", nil},
+		{"too many conditions", strings.Repeat("amount=1 AND ", maxConditions) + "amount=1", ErrTooManyConditions},
+	}
+
+	for _, tt := range tests {
+		_, _, err := Compile(tt.input, testFields)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package jwt
 
 import (
 	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/hewo233/hdu-dx2/shared/consts"
 	"log"
@@ -44,11 +47,35 @@ func InitJWTKey() {
 
 type Claims struct {
 	jwt.StandardClaims
+	IssuedAtMicro int64 `json:"iat_us,omitempty"` // iat is in seconds, this tells apart tokens issued in the same second
 }
 
+// IssuedBefore tells whether the token was issued before t, tokens without iat_us
+// issued in the same second as t count as before
+func (c *Claims) IssuedBefore(t time.Time) bool {
+	if c.IssuedAtMicro == 0 {
+		return c.IssuedAt <= t.Unix()
+	}
+	return c.IssuedAtMicro < t.UnixMicro()
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GenerateJWT issues a short-lived access token, the subject is the phone and the id is a random jti
 func GenerateJWT(phone string, audience string) (string, error) {
 	nowTime := time.Now()
-	expireTime := nowTime.Add(consts.ThreeDays)
+	expireTime := nowTime.Add(consts.AccessTokenExpire)
+
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
 
 	claims := &Claims{
 		StandardClaims: jwt.StandardClaims{
@@ -56,8 +83,10 @@ func GenerateJWT(phone string, audience string) (string, error) {
 			Audience:  audience,
 			IssuedAt:  nowTime.Unix(),
 			Issuer:    consts.Issuer,
-			Id:        phone,
+			Id:        jti,
+			Subject:   phone,
 		},
+		IssuedAtMicro: nowTime.UnixMicro(),
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -68,3 +97,17 @@ func GenerateJWT(phone string, audience string) (string, error) {
 
 	return ss, nil
 }
+
+// GenerateRefreshToken returns the opaque token for the client and the hash to store
+func GenerateRefreshToken() (string, string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+	return token, HashToken(token), nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
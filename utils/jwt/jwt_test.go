@@ -0,0 +1,36 @@
+package jwt
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"testing"
+	"time"
+)
+
+func TestIssuedBefore(t *testing.T) {
+	revokedAt := time.Date(2024, 5, 1, 12, 0, 0, 500000000, time.UTC)
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		micro    bool // issued with iat_us
+		want     bool
+	}{
+		{"earlier second", revokedAt.Add(-time.Second), true, true},
+		{"same second before", revokedAt.Add(-100 * time.Millisecond), true, true},
+		{"same microsecond", revokedAt, true, false},
+		{"same second after", revokedAt.Add(100 * time.Millisecond), true, false},
+		{"later second", revokedAt.Add(time.Second), true, false},
+		{"same second without iat_us", revokedAt.Add(100 * time.Millisecond), false, true},
+		{"later second without iat_us", revokedAt.Add(time.Second), false, false},
+	}
+
+	for _, tt := range tests {
+		claims := &Claims{StandardClaims: jwt.StandardClaims{IssuedAt: tt.issuedAt.Unix()}}
+		if tt.micro {
+			claims.IssuedAtMicro = tt.issuedAt.UnixMicro()
+		}
+		if got := claims.IssuedBefore(revokedAt); got != tt.want {
+			t.Errorf("%s: IssuedBefore = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
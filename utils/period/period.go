@@ -0,0 +1,45 @@
+// Package period is the calendar arithmetic shared by budgets and statistics. Periods are in UTC
+// and weeks start on Monday, the same as date_trunc in PostgreSQL.
+package period
+
+import "time"
+
+type Unit int
+
+const (
+	Day Unit = iota
+	Week
+	Month
+	Year
+)
+
+// Start returns the start of the period of unit containing t
+func Start(t time.Time, unit Unit) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch unit {
+	case Week:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case Year:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+// End returns the end of the period of unit starting at start, exclusive
+func End(start time.Time, unit Unit) time.Time {
+	switch unit {
+	case Week:
+		return start.AddDate(0, 0, 7)
+	case Month:
+		return start.AddDate(0, 1, 0)
+	case Year:
+		return start.AddDate(1, 0, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
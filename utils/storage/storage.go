@@ -0,0 +1,68 @@
+// Package storage keeps uploaded files, on the local disk by default or in an S3-compatible bucket
+package storage
+
+import (
+	"errors"
+	"github.com/hewo233/hdu-dx2/shared/consts"
+	"github.com/joho/godotenv"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+var ErrNotFound = errors.New("file not found in storage")
+
+// Storage is keyed by slash separated paths generated by the server, never by user input
+type Storage interface {
+	Put(key string, data []byte, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error // deleting a missing key is not an error
+}
+
+var Default Storage
+
+// Init picks the storage from config/storage, without the file files go to consts.DefaultStorageDir
+func Init() {
+	if err := godotenv.Load(consts.StorageEnvFile); err != nil {
+		log.Println("no storage config file, store files in " + consts.DefaultStorageDir)
+		Default = NewLocal(consts.DefaultStorageDir)
+		return
+	}
+
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "local":
+		dir := os.Getenv("STORAGE_LOCAL_DIR")
+		if dir == "" {
+			dir = consts.DefaultStorageDir
+		}
+		Default = NewLocal(dir)
+	case "s3":
+		s3 := &S3{
+			Endpoint:  strings.TrimRight(os.Getenv("S3_ENDPOINT"), "/"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PathStyle: os.Getenv("S3_PATH_STYLE") == "true",
+		}
+		if s3.Endpoint == "" || s3.Region == "" || s3.Bucket == "" || s3.AccessKey == "" || s3.SecretKey == "" {
+			log.Fatal("S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required for s3 storage")
+		}
+		Default = s3
+	default:
+		log.Fatal("unknown STORAGE_DRIVER " + driver)
+	}
+}
+
+// DeleteAll is used after the rows of the files are gone, a failure only leaves garbage behind so it is logged
+func DeleteAll(keys []string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := Default.Delete(key); err != nil {
+			log.Println("failed to delete "+key+" from storage: ", err)
+		}
+	}
+}